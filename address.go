@@ -0,0 +1,240 @@
+package trafficlog
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// The capture length used in compiling user-supplied filters. This is the maximum snap length used
+// by libpcap.
+const filterCaptureLength = 262144
+
+// portRange is an inclusive range of ports.
+type portRange struct {
+	first, last uint16
+}
+
+// allPorts is the range of all ports. An address with this range is not restricted by port.
+var allPorts = portRange{0, 65535}
+
+func (pr portRange) contains(port uint16) bool {
+	return port >= pr.first && port <= pr.last
+}
+
+// addressSpec is the parsed form of an address passed to TrafficLog.UpdateAddresses.
+type addressSpec struct {
+	// proto is ipProtoTCP, ipProtoUDP, or zero for any protocol.
+	proto uint8
+
+	// Exactly one of host and network is set. The host may be a hostname or an IP.
+	host    string
+	network *net.IPNet
+
+	ports portRange
+
+	// filter is an optional BPF expression, further restricting the packets captured.
+	filter string
+
+	// settings for the capture of this address. These are not part of the address, but are set by
+	// the TrafficLog.
+	settings CaptureSettings
+}
+
+// parseAddress parses an address in one of the forms described by TrafficLog.UpdateAddresses. Any
+// error returned is an ErrorMalformedAddress.
+func parseAddress(addr string) (*addressSpec, error) {
+	spec, err := func() (*addressSpec, error) {
+		spec := addressSpec{ports: allPorts}
+		rest, filter, err := splitFilter(addr)
+		if err != nil {
+			return nil, err
+		}
+		spec.filter = filter
+		if i := strings.Index(rest, "://"); i >= 0 {
+			switch scheme := strings.ToLower(rest[:i]); scheme {
+			case "tcp":
+				spec.proto = ipProtoTCP
+			case "udp":
+				spec.proto = ipProtoUDP
+			default:
+				return nil, fmt.Errorf("unsupported protocol %q", scheme)
+			}
+			rest = rest[i+len("://"):]
+		}
+
+		host, portStr, err := net.SplitHostPort(rest)
+		switch {
+		case err == nil:
+			if portStr == "" {
+				return nil, errors.New("missing port")
+			}
+			if spec.ports, err = parsePorts(portStr); err != nil {
+				return nil, err
+			}
+		case strings.HasPrefix(rest, "[") && strings.HasSuffix(rest, "]"):
+			host = rest[1 : len(rest)-1]
+		case strings.Contains(rest, ":") && !isIPOrNetwork(rest):
+			// Either a malformed host:port or a malformed IPv6 address.
+			return nil, err
+		default:
+			host = rest
+		}
+
+		if host == "" {
+			return nil, errors.New("missing host")
+		}
+		if strings.Contains(host, "/") {
+			_, network, err := net.ParseCIDR(host)
+			if err != nil {
+				return nil, err
+			}
+			if ip4 := network.IP.To4(); ip4 != nil {
+				network.IP = ip4
+			}
+			spec.network = network
+		} else {
+			spec.host = host
+		}
+		return &spec, nil
+	}()
+	if err != nil {
+		return nil, ErrorMalformedAddress{err}
+	}
+	return spec, nil
+}
+
+// splitFilter splits the input into the text preceding any filter expression and the expression
+// itself. The expression follows the first whitespace and the word "and". The expression is
+// validated, so that no capture is started with a bad filter.
+func splitFilter(s string) (head, filter string, err error) {
+	i := strings.IndexFunc(s, unicode.IsSpace)
+	if i < 0 {
+		return s, "", nil
+	}
+	head, filter = s[:i], strings.TrimLeftFunc(s[i:], unicode.IsSpace)
+	if !strings.HasPrefix(filter, "and") || len(filter) == len("and") ||
+		!unicode.IsSpace(rune(filter[len("and")])) {
+		return "", "", fmt.Errorf(`%q may only be followed by "and" and a filter expression`, head)
+	}
+	filter = strings.TrimSpace(filter[len("and"):])
+	if filter == "" {
+		return "", "", errors.New("missing filter expression")
+	}
+	if _, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, filterCaptureLength, filter); err != nil {
+		return "", "", fmt.Errorf("bad filter expression: %w", err)
+	}
+	return head, filter, nil
+}
+
+// parseInterfaceCapture parses an entry passed to TrafficLog.UpdateInterfaces: the name of a
+// network interface (or AllInterfaces), optionally followed by "and" and a filter expression. Any
+// error returned is an ErrorMalformedAddress.
+func parseInterfaceCapture(s string) (iface, filter string, err error) {
+	iface, filter, err = splitFilter(s)
+	if err == nil && iface == "" {
+		err = errors.New("missing interface name")
+	}
+	if err != nil {
+		return "", "", ErrorMalformedAddress{err}
+	}
+	return iface, filter, nil
+}
+
+func isIPOrNetwork(s string) bool {
+	if net.ParseIP(s) != nil {
+		return true
+	}
+	_, _, err := net.ParseCIDR(s)
+	return err == nil
+}
+
+// parsePorts parses a single port like 443 or a range of ports like 8000-8100.
+func parsePorts(s string) (portRange, error) {
+	parsePort := func(s string) (uint16, error) {
+		port, err := strconv.ParseUint(s, 10, 16)
+		if err != nil {
+			return 0, fmt.Errorf("bad port %q", s)
+		}
+		return uint16(port), nil
+	}
+
+	parts := strings.SplitN(s, "-", 2)
+	first, err := parsePort(parts[0])
+	if err != nil {
+		return portRange{}, err
+	}
+	if len(parts) == 1 {
+		return portRange{first, first}, nil
+	}
+	last, err := parsePort(parts[1])
+	if err != nil {
+		return portRange{}, err
+	}
+	if last < first {
+		return portRange{}, fmt.Errorf("bad port range %q", s)
+	}
+	return portRange{first, last}, nil
+}
+
+// resolveHost is the host which should be resolved to find routes for this address. For network
+// addresses, this is the network's IP.
+func (spec addressSpec) resolveHost() string {
+	if spec.network != nil {
+		return spec.network.IP.String()
+	}
+	return spec.host
+}
+
+// routeFor returns a route for this address, to be captured using the input hook. For host
+// addresses, ip is the IP to which the host resolved. For network addresses, ip is ignored.
+func (spec addressSpec) routeFor(ip net.IP, hook *sharedBufferHook) *captureRoute {
+	network := spec.network
+	if network == nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		bits := len(ip) * 8
+		network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	}
+	return &captureRoute{
+		network: network, proto: spec.proto, ports: spec.ports, filter: spec.filter,
+		settings: spec.settings, hook: hook,
+	}
+}
+
+// userFilter evaluates a BPF expression in user space. Captures are shared by several addresses, so
+// a packet admitted by the capture filter for one address' expression must be checked against the
+// expressions of any other addresses it matches.
+type userFilter struct {
+	bpf      *pcap.BPF
+	linkType LinkType
+}
+
+func newUserFilter(lt LinkType, expr string) (*userFilter, error) {
+	// Linux cooked capture v2 is not supported by the gopacket package. We compile for v1 and
+	// convert packets before matching.
+	bpf, err := pcap.NewBPF(lt.gopacketLinkType(), filterCaptureLength, expr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile filter expression: %w", err)
+	}
+	return &userFilter{bpf, lt}, nil
+}
+
+func (f *userFilter) matches(ci gopacket.CaptureInfo, data []byte) bool {
+	if f.linkType == LinkTypeLinuxSLL2 {
+		var err error
+		if data, err = sll2ToSLL(data); err != nil {
+			return false
+		}
+		ci.CaptureLength = len(data)
+	}
+	return f.bpf.Matches(ci, data)
+}
@@ -0,0 +1,137 @@
+package trafficlog
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAddress(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		addr     string
+		expected string // the capture filter for the address, resolved to 10.0.0.1 if needed
+	}{
+		{"example.com:443", "(ip dst 10.0.0.1 and dst port 443) or (ip src 10.0.0.1 and src port 443)"},
+		{"tcp://example.com:443", "(ip dst 10.0.0.1 and tcp dst port 443) or (ip src 10.0.0.1 and tcp src port 443)"},
+		{"UDP://10.0.0.1:53", "(ip dst 10.0.0.1 and udp dst port 53) or (ip src 10.0.0.1 and udp src port 53)"},
+		{"example.com:8000-8100", "(ip dst 10.0.0.1 and dst portrange 8000-8100) or (ip src 10.0.0.1 and src portrange 8000-8100)"},
+		{"10.0.0.0/8:443", "(ip dst net 10.0.0.0/8 and dst port 443) or (ip src net 10.0.0.0/8 and src port 443)"},
+		{"example.com", "ip host 10.0.0.1"},
+		{"tcp://example.com", "ip host 10.0.0.1 and tcp"},
+		{"10.0.0.0/8", "ip net 10.0.0.0/8"},
+		{"2001:db8::1", "ip6 host 2001:db8::1"},
+		{"[2001:db8::/32]:443", "(ip6 dst net 2001:db8::/32 and dst port 443) or (ip6 src net 2001:db8::/32 and src port 443)"},
+		{"example.com:443 and src host 10.0.0.1", "((ip dst 10.0.0.1 and dst port 443) or (ip src 10.0.0.1 and src port 443)) and (src host 10.0.0.1)"},
+		{"example.com\tand  not tcp", "(ip host 10.0.0.1) and (not tcp)"},
+	} {
+		spec, err := parseAddress(tc.addr)
+		require.NoError(t, err, tc.addr)
+		ip := net.ParseIP("10.0.0.1")
+		if resolved := net.ParseIP(spec.host); resolved != nil {
+			ip = resolved
+		}
+		require.Equal(t, tc.expected, spec.routeFor(ip, nil).bpf(), tc.addr)
+	}
+
+	for _, addr := range []string{
+		"", "example.com:", ":443", "example.com:http", "example.com:100-10", "example.com:70000",
+		"sctp://example.com:443", "10.0.0.0/33:443", "2001:db8::1:443:xyz",
+		"example.com:443 src host 10.0.0.1", "example.com:443 and", "example.com:443 andnot tcp",
+		"example.com:443 and not a (filter",
+	} {
+		_, err := parseAddress(addr)
+		require.True(t, errors.As(err, new(ErrorMalformedAddress)), "expected error for %q, got %v", addr, err)
+	}
+}
+
+func TestCaptureRouteMatches(t *testing.T) {
+	t.Parallel()
+
+	var (
+		tcp = testFrame{src: "10.0.0.1:50000", dst: "10.1.2.3:8080"}.serialize(t)
+		// The same packet as a non-initial fragment, with no transport header.
+		fragment = append([]byte{}, tcp...)
+		// A router reporting that it could not deliver the packet.
+		icmpError = testICMPError("192.168.1.1", "10.0.0.1", tcp)
+	)
+	fragment[ethernetHeaderLen+6], fragment[ethernetHeaderLen+7] = 0x00, 0x10
+
+	type expectation struct{ tcp, fragment, icmpError bool }
+	for _, tc := range []struct {
+		addr string
+		// Expectations with and without Options.CaptureICMPAndFragments.
+		unrelated, related expectation
+	}{
+		{"10.1.2.3:8080", expectation{true, false, false}, expectation{true, true, true}},
+		{"tcp://10.1.2.3:8000-8100", expectation{true, false, false}, expectation{true, true, true}},
+		{"udp://10.1.2.3:8080", expectation{false, false, false}, expectation{false, false, false}},
+		{"10.1.2.3:443", expectation{false, false, false}, expectation{false, true, false}},
+		{"10.0.0.0/8:50000", expectation{true, false, false}, expectation{true, true, true}},
+		{"10.1.2.3", expectation{true, true, false}, expectation{true, true, true}},
+		{"tcp://10.0.0.0/16", expectation{true, true, false}, expectation{true, true, true}},
+		{"192.168.0.0/16", expectation{false, false, true}, expectation{false, false, true}},
+	} {
+		spec, err := parseAddress(tc.addr)
+		require.NoError(t, err)
+		for _, related := range []bool{false, true} {
+			r := spec.routeFor(net.ParseIP(spec.host), nil)
+			r.related = related
+			expected := tc.unrelated
+			if related {
+				expected = tc.related
+			}
+			for _, pkt := range []struct {
+				lt       LinkType
+				data     []byte
+				expected bool
+			}{
+				{LinkTypeEthernet, tcp, expected.tcp},
+				{LinkTypeEthernet, fragment, expected.fragment},
+				{LinkTypeRaw, icmpError, expected.icmpError},
+			} {
+				addrs, ok := decodeAddrs(pkt.lt, pkt.data)
+				require.True(t, ok)
+				require.Equal(t, pkt.expected, r.matches(addrs), "%s (related: %t)", tc.addr, related)
+			}
+		}
+	}
+}
+
+func TestCaptureRouteRelatedBPF(t *testing.T) {
+	t.Parallel()
+
+	const icmpTypes = "(icmp[0] == 3 or icmp[0] == 4 or icmp[0] == 5 or icmp[0] == 11 or icmp[0] == 12)"
+	for _, tc := range []struct {
+		addr     string
+		expected string
+	}{
+		{
+			"tcp://10.0.0.1:443",
+			"((ip dst 10.0.0.1 and tcp dst port 443) or (ip src 10.0.0.1 and tcp src port 443)) or " +
+				"(icmp and " + icmpTypes + " and ((icmp[20:4] == 0x0a000001) or (icmp[24:4] == 0x0a000001))) or " +
+				"(ip host 10.0.0.1 and ip[6:2] & 0x3fff != 0 and ip[9] == 6)",
+		},
+		{
+			"10.16.0.0/12 and not udp",
+			"((ip net 10.16.0.0/12) or " +
+				"(icmp and " + icmpTypes + " and ((icmp[20:4] & 0xfff00000 == 0x0a100000) or (icmp[24:4] & 0xfff00000 == 0x0a100000))) or " +
+				"(ip net 10.16.0.0/12 and ip[6:2] & 0x3fff != 0)) and (not udp)",
+		},
+		{
+			"udp://[2001:db8::/32]:53",
+			"((ip6 dst net 2001:db8::/32 and udp dst port 53) or (ip6 src net 2001:db8::/32 and udp src port 53)) or " +
+				"(ip6[6] == 58 and ip6[40] >= 1 and ip6[40] <= 4 and ((ip6[56:4] == 0x20010db8) or (ip6[72:4] == 0x20010db8))) or " +
+				"(ip6 net 2001:db8::/32 and ip6[6] == 44 and ip6[40] == 17)",
+		},
+	} {
+		spec, err := parseAddress(tc.addr)
+		require.NoError(t, err)
+		r := spec.routeFor(net.ParseIP(spec.host), nil)
+		r.related = true
+		require.Equal(t, tc.expected, r.bpf(), tc.addr)
+	}
+}
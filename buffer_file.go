@@ -0,0 +1,739 @@
+package trafficlog
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/google/gopacket/pcap"
+	"github.com/oxtoacart/bpool"
+)
+
+// A buffer file holds the packet data of the capture and save buffers (see Options.BufferFile). The
+// file is laid out as follows, with all integers little-endian:
+//
+//	header            bufferFileHeaderLen bytes, locating the sections below
+//	interface table   interfaceTableLen bytes of interface frames
+//	capture region    packet frames for the capture buffer
+//	save region       packet frames for the save buffer
+//
+// Interfaces and packets are written in frames. Each frame begins with a magic number identifying
+// its type, the frame's length and a CRC of its contents, so intact frames can be found by
+// scanning. Frames are aligned to frameAlignment bytes.
+//
+// Each region is written as a circular log. Once the end of a region is reached, writing wraps
+// around to the start of the region, overwriting the oldest frames. The packets held in overwritten
+// frames are evicted from their buffer. Frames of packets evicted by the buffer are marked as such,
+// so that they are not recovered.
+//
+// Each time a buffer file is opened, its generation is incremented. Frames belong to the generation
+// in which they were written, and frames from earlier generations are ignored.
+const (
+	bufferFileMagic     = "TLBUFFER"
+	bufferFileVersion   = 1
+	bufferFileHeaderLen = 72
+	interfaceTableLen   = 64 * 1024
+
+	frameAlignment = 8
+
+	// The common header of all frames:
+	//
+	//	magic       uint32
+	//	flags       uint32  not covered by the CRC, as these change after the frame is written
+	//	crc         uint32  CRC-32C of the remainder of the frame, including padding
+	//	length      uint32  including the header and padding
+	//	generation  uint64
+	frameHeaderLen = 24
+
+	// Interface frames describe a network interface:
+	//
+	//	id          uint32  referenced by packet frames
+	//	index       int32
+	//	link type   uint32  a LINKTYPE_ value
+	//	snap length uint32
+	//	flags       uint32  interfaceNanoTimestamps
+	//	name length uint16
+	//	desc length uint16
+	//	name, description
+	interfaceFrameMagic     = 0x544c4946 // "TLIF"
+	interfaceFrameHeaderLen = frameHeaderLen + 24
+	interfaceNanoTimestamps = 1
+
+	// Packet frames hold a packet:
+	//
+	//	seq             uint64  orders the frames within a region
+	//	id              uint64
+	//	timestamp       int64   nanoseconds since the Unix epoch
+	//	capture length  uint32
+	//	length          uint32
+	//	interface ID    uint32
+	//	interface index int32   as reported with the packet
+	//	data length     uint32
+	//	addresses       uint16  the number of addresses
+	//	reserved        uint16
+	//	addresses       each a uint16 length followed by the address
+	//	data
+	packetFrameMagic     = 0x544c504b // "TLPK"
+	packetFrameHeaderLen = frameHeaderLen + 48
+	packetEvicted        = 1
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// bufferFile holds the data of packets in the capture and save buffers.
+type bufferFile struct {
+	f          *os.File
+	path       string
+	generation uint64
+
+	ifaces        *interfaceTable
+	capture, save *fileRegion
+
+	// logError reports errors in using the file. Set before the file is used.
+	logError func(error)
+}
+
+// recoveredPackets are the packets recovered from a buffer file, in the order in which they were
+// written.
+type recoveredPackets struct {
+	capture, save []recoveredPacket
+}
+
+type recoveredPacket struct {
+	id    uint64
+	info  captureInfo
+	addrs []string
+	data  []byte
+}
+
+// openBufferFile opens or creates the buffer file at the input path, sized to hold buffers with the
+// input capacities. If the file holds packets from a previous generation, these are recovered.
+// Recovered interfaces with negative indices are replayed interfaces (see
+// TrafficLog.nextReplayIndex); these are assigned new indices using nextReplayIndex.
+func openBufferFile(
+	path string, captureBytes, saveBytes int, nextReplayIndex func() int) (*bufferFile, *recoveredPackets, error) {
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	bf, recovered, err := initBufferFile(f, captureBytes, saveBytes, nextReplayIndex)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	bf.path = path
+	return bf, recovered, nil
+}
+
+func initBufferFile(
+	f *os.File, captureBytes, saveBytes int, nextReplayIndex func() int) (*bufferFile, *recoveredPackets, error) {
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	var (
+		prev      bufferFileHeader
+		recovered = new(recoveredPackets)
+	)
+	if fi.Size() > 0 {
+		if prev, err = readBufferFileHeader(f, fi.Size()); err != nil {
+			return nil, nil, err
+		}
+		if recovered, err = recoverBufferFile(f, prev, nextReplayIndex); err != nil {
+			return nil, nil, fmt.Errorf("failed to recover packets: %w", err)
+		}
+	}
+
+	h := bufferFileHeader{
+		generation: prev.generation + 1,
+		ifaces:     section{bufferFileHeaderLen, interfaceTableLen},
+	}
+	h.capture = section{h.ifaces.end(), int64(nonNegative(captureBytes))}
+	h.save = section{h.capture.end(), int64(nonNegative(saveBytes))}
+	if err := f.Truncate(h.save.end()); err != nil {
+		return nil, nil, fmt.Errorf("failed to size file: %w", err)
+	}
+	if _, err := f.WriteAt(h.encode(), 0); err != nil {
+		return nil, nil, fmt.Errorf("failed to write header: %w", err)
+	}
+
+	bf := &bufferFile{f: f, generation: h.generation}
+	bf.ifaces = &interfaceTable{file: bf, section: h.ifaces, ids: map[interfaceDesc]uint32{}}
+	bf.capture = &fileRegion{file: bf, section: h.capture}
+	bf.save = &fileRegion{file: bf, section: h.save}
+	return bf, recovered, nil
+}
+
+func (bf *bufferFile) close() error {
+	return bf.f.Close()
+}
+
+// section is a section of a buffer file.
+type section struct {
+	offset, length int64
+}
+
+func (s section) end() int64 {
+	return s.offset + s.length
+}
+
+type bufferFileHeader struct {
+	generation            uint64
+	ifaces, capture, save section
+}
+
+// The header is laid out as follows:
+//
+//	magic       8 bytes
+//	version     uint32
+//	crc         uint32  CRC-32C of the remainder of the header
+//	generation  uint64
+//	sections    offset and length of the interface table, capture region and save region, each
+//	            as a pair of uint64s
+func (h bufferFileHeader) encode() []byte {
+	b := make([]byte, bufferFileHeaderLen)
+	copy(b, bufferFileMagic)
+	binary.LittleEndian.PutUint32(b[8:], bufferFileVersion)
+	binary.LittleEndian.PutUint64(b[16:], h.generation)
+	for i, s := range []section{h.ifaces, h.capture, h.save} {
+		binary.LittleEndian.PutUint64(b[24+16*i:], uint64(s.offset))
+		binary.LittleEndian.PutUint64(b[32+16*i:], uint64(s.length))
+	}
+	binary.LittleEndian.PutUint32(b[12:], crc32.Checksum(b[16:], crcTable))
+	return b
+}
+
+func readBufferFileHeader(f *os.File, size int64) (bufferFileHeader, error) {
+	var h bufferFileHeader
+	b := make([]byte, bufferFileHeaderLen)
+	if _, err := f.ReadAt(b, 0); err != nil && !errors.Is(err, io.EOF) {
+		return h, fmt.Errorf("failed to read header: %w", err)
+	}
+	if string(b[:len(bufferFileMagic)]) != bufferFileMagic {
+		return h, errors.New("not a buffer file")
+	}
+	if v := binary.LittleEndian.Uint32(b[8:]); v != bufferFileVersion {
+		return h, fmt.Errorf("unsupported buffer file version %d", v)
+	}
+	if binary.LittleEndian.Uint32(b[12:]) != crc32.Checksum(b[16:], crcTable) {
+		return h, errors.New("corrupt buffer file header")
+	}
+	h.generation = binary.LittleEndian.Uint64(b[16:])
+	for i, s := range []*section{&h.ifaces, &h.capture, &h.save} {
+		s.offset = int64(binary.LittleEndian.Uint64(b[24+16*i:]))
+		s.length = int64(binary.LittleEndian.Uint64(b[32+16*i:]))
+		if s.offset < bufferFileHeaderLen || s.length < 0 || s.end() > size || s.end() < s.offset {
+			return h, errors.New("corrupt buffer file header")
+		}
+	}
+	return h, nil
+}
+
+// recoverBufferFile reads the live packets in a buffer file described by the input header.
+func recoverBufferFile(f *os.File, h bufferFileHeader, nextReplayIndex func() int) (*recoveredPackets, error) {
+	readSection := func(s section) ([]byte, error) {
+		b := make([]byte, s.length)
+		_, err := f.ReadAt(b, s.offset)
+		return b, err
+	}
+
+	b, err := readSection(h.ifaces)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read interface table: %w", err)
+	}
+	ifaces := map[uint32]*networkInterface{}
+	for pos := 0; ; {
+		frame, ok := parseFrame(b[pos:], interfaceFrameMagic, h.generation)
+		if !ok {
+			break
+		}
+		pos += len(frame)
+		if id, iface, ok := parseInterfaceFrame(frame); ok {
+			if iface.netInterface.Index < 0 {
+				iface.netInterface.Index = nextReplayIndex()
+			}
+			ifaces[id] = iface
+		}
+	}
+
+	recovered := new(recoveredPackets)
+	for _, region := range []struct {
+		s       section
+		packets *[]recoveredPacket
+	}{{h.capture, &recovered.capture}, {h.save, &recovered.save}} {
+		b, err := readSection(region.s)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read region: %w", err)
+		}
+		*region.packets = scanRegion(b, h.generation, ifaces)
+	}
+	return recovered, nil
+}
+
+// scanRegion returns the live packets in a region, in the order in which they were written.
+// Packets attributed to unknown interfaces are ignored.
+func scanRegion(b []byte, generation uint64, ifaces map[uint32]*networkInterface) []recoveredPacket {
+	type seqPacket struct {
+		seq uint64
+		recoveredPacket
+	}
+	packets := []seqPacket{}
+	for pos := 0; pos+frameHeaderLen <= len(b); {
+		frame, ok := parseFrame(b[pos:], packetFrameMagic, generation)
+		if !ok {
+			// Frames may have been partially overwritten, so we search for the next intact frame.
+			pos += frameAlignment
+			continue
+		}
+		pos += len(frame)
+		if binary.LittleEndian.Uint32(frame[4:])&packetEvicted != 0 {
+			continue
+		}
+		seq, pkt, ifaceID, ok := parsePacketFrame(frame)
+		if !ok {
+			continue
+		}
+		if pkt.info.iface, ok = ifaces[ifaceID]; ok {
+			packets = append(packets, seqPacket{seq, pkt})
+		}
+	}
+	sort.Slice(packets, func(i, j int) bool { return packets[i].seq < packets[j].seq })
+	recovered := make([]recoveredPacket, len(packets))
+	for i, p := range packets {
+		recovered[i] = p.recoveredPacket
+	}
+	return recovered
+}
+
+// newFrame returns a frame of the input type with room for a body of the input length. The body
+// begins at frameHeaderLen. The frame should be completed using sealFrame.
+func newFrame(buf []byte, magic uint32, bodyLen int, generation uint64) []byte {
+	length := (frameHeaderLen + bodyLen + frameAlignment - 1) / frameAlignment * frameAlignment
+	if cap(buf) < length {
+		buf = make([]byte, length)
+	}
+	frame := buf[:length]
+	for i := frameHeaderLen + bodyLen; i < length; i++ {
+		frame[i] = 0
+	}
+	binary.LittleEndian.PutUint32(frame, magic)
+	binary.LittleEndian.PutUint32(frame[4:], 0)
+	binary.LittleEndian.PutUint32(frame[12:], uint32(length))
+	binary.LittleEndian.PutUint64(frame[16:], generation)
+	return frame
+}
+
+func sealFrame(frame []byte) {
+	binary.LittleEndian.PutUint32(frame[8:], crc32.Checksum(frame[12:], crcTable))
+}
+
+// parseFrame returns the intact frame of the input type and generation at the start of b, if there
+// is one.
+func parseFrame(b []byte, magic uint32, generation uint64) ([]byte, bool) {
+	if len(b) < frameHeaderLen || binary.LittleEndian.Uint32(b) != magic {
+		return nil, false
+	}
+	length := int(binary.LittleEndian.Uint32(b[12:]))
+	if length < frameHeaderLen || length > len(b) || length%frameAlignment != 0 {
+		return nil, false
+	}
+	frame := b[:length]
+	if binary.LittleEndian.Uint64(frame[16:]) != generation {
+		return nil, false
+	}
+	if binary.LittleEndian.Uint32(frame[8:]) != crc32.Checksum(frame[12:], crcTable) {
+		return nil, false
+	}
+	return frame, true
+}
+
+// interfaceDesc describes a network interface as recorded in a buffer file.
+type interfaceDesc struct {
+	name, description string
+	index, snapLen    int
+	linkType          LinkType
+	nanoTimestamps    bool
+}
+
+func describeInterface(iface *networkInterface) interfaceDesc {
+	return interfaceDesc{
+		iface.name(), iface.pcapInterface.Description, iface.index(), iface.snapLen, iface.linkType,
+		iface.nanoTimestamps,
+	}
+}
+
+func (d interfaceDesc) networkInterface() *networkInterface {
+	return &networkInterface{
+		pcapInterface:  pcap.Interface{Name: d.name, Description: d.description},
+		netInterface:   net.Interface{Index: d.index, MTU: d.snapLen, Name: d.name},
+		linkType:       d.linkType,
+		snapLen:        d.snapLen,
+		nanoTimestamps: d.nanoTimestamps,
+	}
+}
+
+// The LINKTYPE_ value recorded for a link type. Unlike gopacketLinkType, this can express SLL2.
+func (lt LinkType) fileLinkType() int {
+	if lt == LinkTypeLinuxSLL2 {
+		return linktypeLinuxSLL2
+	}
+	return int(lt.gopacketLinkType())
+}
+
+func encodeInterfaceFrame(id uint32, d interfaceDesc, generation uint64) []byte {
+	name, description := truncate(d.name, 0xffff), truncate(d.description, 0xffff)
+	bodyLen := interfaceFrameHeaderLen - frameHeaderLen + len(name) + len(description)
+	frame := newFrame(nil, interfaceFrameMagic, bodyLen, generation)
+	var flags uint32
+	if d.nanoTimestamps {
+		flags |= interfaceNanoTimestamps
+	}
+	binary.LittleEndian.PutUint32(frame[24:], id)
+	binary.LittleEndian.PutUint32(frame[28:], uint32(int32(d.index)))
+	binary.LittleEndian.PutUint32(frame[32:], uint32(d.linkType.fileLinkType()))
+	binary.LittleEndian.PutUint32(frame[36:], uint32(d.snapLen))
+	binary.LittleEndian.PutUint32(frame[40:], flags)
+	binary.LittleEndian.PutUint16(frame[44:], uint16(len(name)))
+	binary.LittleEndian.PutUint16(frame[46:], uint16(len(description)))
+	copy(frame[interfaceFrameHeaderLen:], name)
+	copy(frame[interfaceFrameHeaderLen+len(name):], description)
+	sealFrame(frame)
+	return frame
+}
+
+func parseInterfaceFrame(frame []byte) (id uint32, iface *networkInterface, ok bool) {
+	if len(frame) < interfaceFrameHeaderLen {
+		return 0, nil, false
+	}
+	nameLen := int(binary.LittleEndian.Uint16(frame[44:]))
+	descLen := int(binary.LittleEndian.Uint16(frame[46:]))
+	if interfaceFrameHeaderLen+nameLen+descLen > len(frame) {
+		return 0, nil, false
+	}
+	linkType, err := linkTypeFromDLT(int(binary.LittleEndian.Uint32(frame[32:])))
+	if err != nil {
+		return 0, nil, false
+	}
+	name := frame[interfaceFrameHeaderLen : interfaceFrameHeaderLen+nameLen]
+	d := interfaceDesc{
+		name:           string(name),
+		description:    string(frame[interfaceFrameHeaderLen+nameLen : interfaceFrameHeaderLen+nameLen+descLen]),
+		index:          int(int32(binary.LittleEndian.Uint32(frame[28:]))),
+		snapLen:        int(binary.LittleEndian.Uint32(frame[36:])),
+		linkType:       linkType,
+		nanoTimestamps: binary.LittleEndian.Uint32(frame[40:])&interfaceNanoTimestamps != 0,
+	}
+	return binary.LittleEndian.Uint32(frame[24:]), d.networkInterface(), true
+}
+
+// interfaceTable records the interfaces on which packets in a buffer file were captured. Interfaces
+// are recorded once for each combination of properties.
+type interfaceTable struct {
+	file *bufferFile
+	section
+
+	// The space used in the table.
+	used int64
+	ids  map[interfaceDesc]uint32
+	full bool
+
+	sync.Mutex
+}
+
+// idFor returns the ID of the interface in the table, adding the interface if necessary. Returns
+// false if the table has no room for the interface.
+func (t *interfaceTable) idFor(iface *networkInterface) (uint32, bool) {
+	d := describeInterface(iface)
+	t.Lock()
+	defer t.Unlock()
+	if id, ok := t.ids[d]; ok {
+		return id, true
+	}
+	if t.full {
+		return 0, false
+	}
+	id := uint32(len(t.ids))
+	frame := encodeInterfaceFrame(id, d, t.file.generation)
+	if t.used+int64(len(frame)) > t.length {
+		// This should only happen if capture is restarted with many different settings.
+		t.full = true
+		t.file.logError(errors.New("interface table is full; packets from new interfaces are held in memory"))
+		return 0, false
+	}
+	if _, err := t.file.f.WriteAt(frame, t.offset+t.used); err != nil {
+		t.file.logError(fmt.Errorf("failed to write interface: %w", err))
+		return 0, false
+	}
+	t.used += int64(len(frame))
+	t.ids[d] = id
+	return id, true
+}
+
+// fileRegion is a region of a buffer file holding the packets of a sharedRingBuffer. A fileRegion
+// is an itemStore and is used with its buffer locked.
+type fileRegion struct {
+	file *bufferFile
+	section
+
+	// The offset, within the region, at which the next frame will be written.
+	head int64
+
+	// records holds the region's records, in the order in which they were written. Records remain
+	// here until overwritten, even if their entries have been evicted.
+	records []*fileRecord
+
+	// The seq of the next frame written to the region.
+	nextSeq uint64
+
+	// Reused to encode frames.
+	frameBuf []byte
+}
+
+func (r *fileRegion) store(
+	buf *sharedRingBuffer, entry *sharedEntry, pkt capturedPacket, saved *packetIDSet) bool {
+
+	data, err := pkt.data()
+	if err != nil {
+		return false
+	}
+	ifaceID, ok := r.file.ifaces.idFor(pkt.info.iface)
+	if !ok {
+		return false
+	}
+	addrs := []string{}
+	for _, h := range *entry.hooks {
+		if h.address != "" {
+			addrs = append(addrs, truncate(h.address, 0xffff))
+		}
+	}
+	bodyLen := packetFrameHeaderLen - frameHeaderLen + len(data)
+	for _, addr := range addrs {
+		bodyLen += 2 + len(addr)
+	}
+	frame := newFrame(r.frameBuf, packetFrameMagic, bodyLen, r.file.generation)
+	r.frameBuf = frame
+	if int64(len(frame)) > r.length {
+		return false
+	}
+	seq := r.nextSeq
+	r.nextSeq++
+	binary.LittleEndian.PutUint64(frame[24:], seq)
+	binary.LittleEndian.PutUint64(frame[32:], pkt.id)
+	binary.LittleEndian.PutUint64(frame[40:], uint64(pkt.info.unixNano))
+	binary.LittleEndian.PutUint32(frame[48:], uint32(pkt.info.captureLength))
+	binary.LittleEndian.PutUint32(frame[52:], uint32(pkt.info.length))
+	binary.LittleEndian.PutUint32(frame[56:], ifaceID)
+	binary.LittleEndian.PutUint32(frame[60:], uint32(int32(pkt.info.interfaceIndex)))
+	binary.LittleEndian.PutUint32(frame[64:], uint32(len(data)))
+	binary.LittleEndian.PutUint16(frame[68:], uint16(len(addrs)))
+	binary.LittleEndian.PutUint16(frame[70:], 0)
+	pos := packetFrameHeaderLen
+	for _, addr := range addrs {
+		binary.LittleEndian.PutUint16(frame[pos:], uint16(len(addr)))
+		pos += 2 + copy(frame[pos+2:], addr)
+	}
+	copy(frame[pos:], data)
+	sealFrame(frame)
+
+	r.reserve(buf, int64(len(frame)))
+	if _, err := r.file.f.WriteAt(frame, r.offset+r.head); err != nil {
+		r.file.logError(fmt.Errorf("failed to write packet: %w", err))
+		return false
+	}
+	rec := &fileRecord{r, r.head, len(frame), pos, len(data), seq, entry, entry.seq, false}
+	r.head += int64(len(frame))
+	r.records = append(r.records, rec)
+	entry.item = bufferedPacket(pkt.storedAt(rec), saved)
+	return true
+}
+
+// reserve space for a frame of the input length at the head of the region, wrapping around to the
+// start of the region if necessary. Entries whose frames are overwritten are evicted.
+func (r *fileRegion) reserve(buf *sharedRingBuffer, length int64) {
+	if r.head+length > r.length {
+		// Frames between the head and the end of the region are no longer reachable by scanning
+		// from the start of the region, so these are evicted too.
+		r.evictBefore(buf, r.length)
+		r.head = 0
+	}
+	r.evictBefore(buf, r.head+length)
+}
+
+// Evicts the entries with frames between the head and the input offset.
+func (r *fileRegion) evictBefore(buf *sharedRingBuffer, end int64) {
+	for len(r.records) > 0 {
+		rec := r.records[0]
+		// Frames written since the region last wrapped precede the head.
+		if rec.offset < r.head || rec.offset >= end {
+			return
+		}
+		r.records[0] = nil
+		r.records = r.records[1:]
+		if rec.entry.live(rec.entrySeq) {
+			buf.evict(rec.entry)
+		}
+		// The release of an evicted entry is delayed while readers may hold it (see
+		// sharedRingBuffer.release), by which time its frame may be overwritten. The frame is
+		// marked now, while it is intact, and left alone when the release comes.
+		rec.markEvicted()
+	}
+}
+
+// fileRecord locates the frame of a packet in a fileRegion.
+type fileRecord struct {
+	region *fileRegion
+
+	// The offset of the frame within the region, the length of the frame and the offset and length
+	// of the packet's data within the frame.
+	offset             int64
+	length             int
+	dataStart, dataLen int
+
+	// The seq of the frame and the entry holding the packet, with the entry's seq as of the write.
+	seq      uint64
+	entry    *sharedEntry
+	entrySeq uint32
+
+	// Whether the frame has been marked as evicted. Once the record is dropped from its region's
+	// records, the frame may be overwritten at any time, so the frame is always marked by then.
+	// Guarded by the lock of the region's buffer.
+	marked bool
+}
+
+// data reads the packet's data from its frame. A reader may hold the record after its entry has
+// been evicted, in which case the frame may be overwritten, so the frame is verified.
+func (rec *fileRecord) data() ([]byte, error) {
+	frame := make([]byte, rec.length)
+	if _, err := rec.region.file.f.ReadAt(frame, rec.region.offset+rec.offset); err != nil {
+		return nil, ErrorBufferFile{rec.region.file.path, err}
+	}
+	frame, ok := parseFrame(frame, packetFrameMagic, rec.region.file.generation)
+	if !ok || binary.LittleEndian.Uint64(frame[24:]) != rec.seq {
+		return nil, errEvicted
+	}
+	return frame[rec.dataStart : rec.dataStart+rec.dataLen], nil
+}
+
+func (rec *fileRecord) len() int {
+	return rec.dataLen
+}
+
+// release marks the frame as evicted, so that the packet is not recovered. Should be called with the
+// region's buffer locked.
+func (rec *fileRecord) release() {
+	rec.markEvicted()
+}
+
+// markEvicted marks the frame as evicted, unless this has already been done. Should be called with
+// the region's buffer locked.
+func (rec *fileRecord) markEvicted() {
+	if rec.marked {
+		return
+	}
+	rec.marked = true
+	flags := make([]byte, 4)
+	binary.LittleEndian.PutUint32(flags, packetEvicted)
+	if _, err := rec.region.file.f.WriteAt(flags, rec.region.offset+rec.offset+4); err != nil {
+		rec.region.file.logError(fmt.Errorf("failed to mark packet as evicted: %w", err))
+	}
+}
+
+func parsePacketFrame(frame []byte) (seq uint64, pkt recoveredPacket, ifaceID uint32, ok bool) {
+	if len(frame) < packetFrameHeaderLen {
+		return 0, pkt, 0, false
+	}
+	seq = binary.LittleEndian.Uint64(frame[24:])
+	pkt.id = binary.LittleEndian.Uint64(frame[32:])
+	pkt.info = captureInfo{
+		unixNano:       int64(binary.LittleEndian.Uint64(frame[40:])),
+		captureLength:  int(binary.LittleEndian.Uint32(frame[48:])),
+		length:         int(binary.LittleEndian.Uint32(frame[52:])),
+		interfaceIndex: int(int32(binary.LittleEndian.Uint32(frame[60:]))),
+	}
+	ifaceID = binary.LittleEndian.Uint32(frame[56:])
+	dataLen := int(binary.LittleEndian.Uint32(frame[64:]))
+	numAddrs := int(binary.LittleEndian.Uint16(frame[68:]))
+
+	pos := packetFrameHeaderLen
+	for i := 0; i < numAddrs; i++ {
+		if pos+2 > len(frame) {
+			return 0, pkt, 0, false
+		}
+		addrLen := int(binary.LittleEndian.Uint16(frame[pos:]))
+		if pos+2+addrLen > len(frame) {
+			return 0, pkt, 0, false
+		}
+		pkt.addrs = append(pkt.addrs, string(frame[pos+2:pos+2+addrLen]))
+		pos += 2 + addrLen
+	}
+	if pos+dataLen > len(frame) {
+		return 0, pkt, 0, false
+	}
+	pkt.data = append([]byte{}, frame[pos:pos+dataLen]...)
+	return seq, pkt, ifaceID, true
+}
+
+// restore puts packets recovered from a buffer file back into the buffers. Recovered packets are
+// given new IDs, such that a recovered captured packet and its recovered saved copy share an ID.
+// Captured packets are held in the replay hooks for their addresses (see Options.BufferFile).
+func (tl *TrafficLog) restore(recovered *recoveredPackets) {
+	ids := map[uint64]uint64{}
+	packetFor := func(p recoveredPacket, pool *bpool.BufferPool) capturedPacket {
+		id, ok := ids[p.id]
+		if !ok {
+			id = tl.captures.nextPacketID()
+			ids[p.id] = id
+		}
+		dataBuf := pool.Get()
+		dataBuf.Write(p.data)
+		return capturedPacket{id, p.info, dataBuf, pool, nil}
+	}
+
+	tl.captureProcsLock.Lock()
+	for _, p := range recovered.capture {
+		hooks := []*sharedBufferHook{}
+		seen := map[*sharedBufferHook]bool{}
+		for _, addr := range p.addrs {
+			if hook := tl.replayHookFor(addr); !seen[hook] {
+				hooks = append(hooks, hook)
+				seen[hook] = true
+			}
+		}
+		if len(hooks) > 0 {
+			tl.captureBuffer.putPacket(packetFor(p, tl.capturePool), nil, hooks)
+		}
+	}
+	tl.captureProcsLock.Unlock()
+
+	for _, p := range recovered.save {
+		pkt := packetFor(p, tl.savePool)
+		if tl.savedIDs.add(pkt.id) {
+			tl.saveBuffer.putPacket(pkt, tl.savedIDs)
+		} else {
+			tl.savePool.Put(pkt.dataBuf)
+		}
+	}
+}
+
+// Truncates s to at most n bytes.
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+func nonNegative(n int) int {
+	if n < 0 {
+		return 0
+	}
+	return n
+}
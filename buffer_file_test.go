@@ -0,0 +1,230 @@
+package trafficlog
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/oxtoacart/bpool"
+	"github.com/stretchr/testify/require"
+)
+
+func tempBufferFile(t *testing.T) (path string, cleanup func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "trafficlog")
+	require.NoError(t, err)
+	return filepath.Join(dir, "buffers"), func() { os.RemoveAll(dir) }
+}
+
+func TestBufferFile(t *testing.T) {
+	t.Parallel()
+
+	const (
+		client  = "10.0.0.1:50000"
+		serverA = "10.0.0.2:443"
+		serverB = "10.0.0.3:443"
+	)
+
+	path, cleanup := tempBufferFile(t)
+	defer cleanup()
+	opts := &Options{BufferFile: path}
+
+	tl := New(1024*1024, 1024*1024, opts)
+	frames := []testFrame{
+		{client, serverA, "A request", time.Now()},
+		{serverA, client, "A response", time.Now()},
+		{client, serverB, "B request", time.Now()},
+		{serverB, client, "B response", time.Now()},
+	}
+	require.NoError(t, tl.Replay(bytes.NewReader(writePcapng(t, frames)), []string{serverA, serverB}, nil))
+	tl.SaveCaptures(serverA, time.Minute)
+	require.NoError(t, tl.Close())
+
+	// Saved packets are restored to the save buffer. Captured packets are held for their addresses.
+	tl = New(1024*1024, 1024*1024, opts)
+	buf := new(bytes.Buffer)
+	require.NoError(t, tl.WritePcapng(buf))
+	require.Equal(t, []string{"A request", "A response"}, readPayloads(t, buf.Bytes()))
+
+	// Recovered packets which were already saved are not saved again.
+	tl.SaveCaptures(serverA, time.Minute)
+	tl.SaveCaptures(serverB, time.Minute)
+	buf.Reset()
+	require.NoError(t, tl.WritePcapng(buf))
+	expected := []string{"A request", "A response", "B request", "B response"}
+	require.Equal(t, expected, readPayloads(t, buf.Bytes()))
+
+	// As after a crash, the log is not closed before the file is reopened.
+	crashed := tl
+	defer crashed.Close()
+	tl = New(1024*1024, 1024*1024, opts)
+	defer tl.Close()
+	buf.Reset()
+	require.NoError(t, tl.WritePcapng(buf))
+	require.Equal(t, expected, readPayloads(t, buf.Bytes()))
+
+	select {
+	case err := <-tl.Errors():
+		t.Fatal(err)
+	default:
+	}
+}
+
+func TestBufferFileUnrecognized(t *testing.T) {
+	t.Parallel()
+
+	path, cleanup := tempBufferFile(t)
+	defer cleanup()
+	contents := []byte("not a buffer file")
+	require.NoError(t, ioutil.WriteFile(path, contents, 0600))
+
+	tl := New(1024*1024, 1024*1024, &Options{BufferFile: path})
+	defer tl.Close()
+	err := <-tl.Errors()
+	require.True(t, errors.As(err, new(ErrorBufferFile)), "unexpected error: %v", err)
+
+	// The file is left alone and the buffers are held in memory.
+	onDisk, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, contents, onDisk)
+
+	frames := []testFrame{{"10.0.0.1:50000", "10.0.0.2:443", "request", time.Now()}}
+	require.NoError(t, tl.Replay(bytes.NewReader(writePcapng(t, frames)), []string{"10.0.0.2:443"}, nil))
+	tl.SaveCaptures("10.0.0.2:443", time.Minute)
+	buf := new(bytes.Buffer)
+	require.NoError(t, tl.WritePcapng(buf))
+	require.Equal(t, []string{"request"}, readPayloads(t, buf.Bytes()))
+}
+
+func TestBufferFileCloseError(t *testing.T) {
+	t.Parallel()
+
+	path, cleanup := tempBufferFile(t)
+	defer cleanup()
+	tl := New(1024*1024, 1024*1024, &Options{BufferFile: path})
+
+	// The file is closed out from under the log, so the log fails to close it.
+	require.NoError(t, tl.bufferFile.f.Close())
+	err := tl.Close()
+	require.True(t, errors.As(err, new(ErrorBufferFile)), "unexpected error: %v", err)
+
+	// The rest of the log is still torn down.
+	for range tl.Errors() {
+	}
+	for range tl.Stats() {
+	}
+}
+
+func TestFileRegion(t *testing.T) {
+	t.Parallel()
+
+	const (
+		regionSize = 4096
+		packetLen  = 100
+	)
+
+	path, cleanup := tempBufferFile(t)
+	defer cleanup()
+	bf, _, err := openBufferFile(path, regionSize, 0, func() int { return -1 })
+	require.NoError(t, err)
+	defer bf.close()
+	bf.logError = func(err error) { t.Error(err) }
+
+	var (
+		iface = &networkInterface{netInterface: net.Interface{Name: "test0"}, linkType: LinkTypeEthernet}
+		pool  = bpool.NewBufferPool(dataPoolSize)
+		rb    = newSharedRingBuffer(1024 * 1024)
+		h     = rb.newHookFor("10.0.0.1:443")
+	)
+	rb.store = bf.capture
+
+	// The buffer has room for all of the packets, but the region does not. Packets whose frames are
+	// overwritten as the region wraps around are evicted.
+	expected := [][]byte{}
+	for i := 0; i < 3*regionSize/packetLen; i++ {
+		data := bytes.Repeat([]byte{byte(i)}, packetLen)
+		pkt := newTestPacket(pool, uint64(i), data)
+		pkt.info.iface = iface
+		h.put(pkt)
+		expected = append(expected, data)
+	}
+	contents := hookContents(t, h)
+	require.NotEmpty(t, contents)
+	require.Less(t, len(contents), regionSize/packetLen)
+	require.Equal(t, expected[len(expected)-len(contents):], contents)
+
+	require.Equal(t, contents, recoveredCaptures(t, bf))
+
+	// Packets evicted by the buffer are not recovered.
+	rb.Lock()
+	rb.evict(rb.oldest())
+	rb.Unlock()
+	require.Equal(t, contents[1:], recoveredCaptures(t, bf))
+}
+
+func TestFileRegionWrapsDuringRead(t *testing.T) {
+	t.Parallel()
+
+	const regionSize = 4096
+
+	path, cleanup := tempBufferFile(t)
+	defer cleanup()
+	bf, _, err := openBufferFile(path, regionSize, 0, func() int { return -1 })
+	require.NoError(t, err)
+	defer bf.close()
+	bf.logError = func(err error) { t.Error(err) }
+
+	var (
+		iface = &networkInterface{netInterface: net.Interface{Name: "test0"}, linkType: LinkTypeEthernet}
+		pool  = bpool.NewBufferPool(dataPoolSize)
+		rb    = newSharedRingBuffer(1024 * 1024)
+		h     = rb.newHookFor("10.0.0.1:443")
+	)
+	rb.store = bf.capture
+
+	// A reader is active while the region wraps around several times, so the release of evicted
+	// packets is delayed until after their frames have been overwritten. Frames of varied sizes
+	// leave new frames straddling the old.
+	rb.Lock()
+	epoch := rb.beginRead()
+	rb.Unlock()
+	expected := [][]byte{}
+	for i := 0; i < 200; i++ {
+		data := bytes.Repeat([]byte{byte(i)}, 20+i*37%300)
+		pkt := newTestPacket(pool, uint64(i), data)
+		pkt.info.iface = iface
+		h.put(pkt)
+		expected = append(expected, data)
+	}
+	rb.endRead(epoch)
+
+	// The delayed releases leave the live packets intact, both in the buffer and in the file.
+	contents := hookContents(t, h)
+	require.NotEmpty(t, contents)
+	require.Equal(t, expected[len(expected)-len(contents):], contents)
+	require.Equal(t, contents, recoveredCaptures(t, bf))
+}
+
+// recoveredCaptures returns the data of the packets which would be recovered from the capture
+// region of the buffer file, each of which is expected to be held for 10.0.0.1:443 on test0.
+func recoveredCaptures(t *testing.T, bf *bufferFile) [][]byte {
+	t.Helper()
+	fi, err := bf.f.Stat()
+	require.NoError(t, err)
+	header, err := readBufferFileHeader(bf.f, fi.Size())
+	require.NoError(t, err)
+	packets, err := recoverBufferFile(bf.f, header, func() int { return -1 })
+	require.NoError(t, err)
+	data := [][]byte{}
+	for _, p := range packets.capture {
+		require.Equal(t, []string{"10.0.0.1:443"}, p.addrs)
+		require.Equal(t, "test0", p.info.iface.name())
+		data = append(data, p.data)
+	}
+	return data
+}
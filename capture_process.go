@@ -2,19 +2,16 @@ package trafficlog
 
 import (
 	"bytes"
-	"fmt"
-	"io"
-	"net"
 	"sync"
 	"time"
 
 	"github.com/google/gopacket"
-	"github.com/google/gopacket/pcap"
 	"github.com/oxtoacart/bpool"
 )
 
-// Overhead (in bytes) per packet. This figure is calculated empirically using the opp utility.
-var overheadPerPacket = 160
+// Overhead (in bytes) per packet. This figure is calculated empirically using the opp utility. It
+// can be approximated without a live capture by BenchmarkPacketOverhead.
+var overheadPerPacket = 100
 
 // SetMeasurementMode is used by test utilities to take measurements on traffic logs.
 func SetMeasurementMode(on bool) {
@@ -43,96 +40,170 @@ func (ci captureInfo) gopacketCI() gopacket.CaptureInfo {
 }
 
 type capturedPacket struct {
+	// id uniquely identifies the packet within a traffic log. A packet matching several addresses
+	// is stored once, shared by the addresses' hooks, so this identifies the packet as seen through
+	// any of these hooks.
+	id       uint64
 	info     captureInfo
 	dataBuf  *bytes.Buffer
 	dataPool *bpool.BufferPool
+
+	// If the packet's data is held by an itemStore, ref locates the data and dataBuf is nil.
+	ref dataRef
 }
 
 // size in bytes.
 func (pkt capturedPacket) size() int {
+	if pkt.dataBuf == nil {
+		return pkt.ref.len() + overheadPerPacket
+	}
 	return pkt.dataBuf.Len() + overheadPerPacket
 }
 
 func (pkt capturedPacket) onEvict() {
+	if pkt.dataBuf == nil {
+		pkt.ref.release()
+		return
+	}
 	pkt.dataPool.Put(pkt.dataBuf)
 }
 
+// data returns the packet's data, which should not be modified. An error is returned only if the
+// data is held by a store and cannot be read.
+func (pkt capturedPacket) data() ([]byte, error) {
+	if pkt.dataBuf == nil {
+		return pkt.ref.data()
+	}
+	return pkt.dataBuf.Bytes(), nil
+}
+
+func (pkt capturedPacket) timestamp() int64 {
+	return pkt.info.unixNano
+}
+
+func (pkt capturedPacket) captured() capturedPacket {
+	return pkt
+}
+
+// storedAt returns the packet with its data held by a store at ref. The packet's data buffer is
+// left to the caller.
+func (pkt capturedPacket) storedAt(ref dataRef) capturedPacket {
+	pkt.dataBuf, pkt.dataPool, pkt.ref = nil, nil, ref
+	return pkt
+}
+
+// savedPacket is a packet in the save buffer. The packet's ID is held in the saved set until the
+// packet is evicted.
+type savedPacket struct {
+	capturedPacket
+	saved *packetIDSet
+}
+
+func (pkt savedPacket) onEvict() {
+	pkt.saved.remove(pkt.id)
+	pkt.capturedPacket.onEvict()
+}
+
+// bufferedPacket returns the item holding a packet in a buffer: a savedPacket if saved is non-nil
+// and the packet itself otherwise.
+func bufferedPacket(pkt capturedPacket, saved *packetIDSet) bufferItem {
+	if saved != nil {
+		return savedPacket{pkt, saved}
+	}
+	return pkt
+}
+
+// packetIDSet is a set of packet IDs, safe for concurrent use.
+type packetIDSet struct {
+	ids map[uint64]bool
+	sync.Mutex
+}
+
+func newPacketIDSet() *packetIDSet {
+	return &packetIDSet{ids: map[uint64]bool{}}
+}
+
+// add the ID to the set. Returns false if the set already held the ID.
+func (s *packetIDSet) add(id uint64) bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.ids[id] {
+		return false
+	}
+	s.ids[id] = true
+	return true
+}
+
+func (s *packetIDSet) remove(id uint64) {
+	s.Lock()
+	delete(s.ids, id)
+	s.Unlock()
+}
+
 type captureProcess struct {
 	buffer    *sharedBufferHook
-	dataPool  *bpool.BufferPool
+	captures  *captureManager
 	errorChan chan error
-	statsChan chan CaptureStats
 	stopChan  chan struct{}
-	readGroup *sync.WaitGroup
-	f         MutatorFactory
+	doneChan  chan struct{}
+	r         Resolver
+
+	// ipGracePeriod is the period for which capture continues for an IP after the address' host no
+	// longer resolves to the IP.
+	ipGracePeriod time.Duration
+
+	// routeChanges signals changes to system routes. This is shared by all capture processes.
+	routeChanges *routeChangeBroadcaster
 }
 
-// startCapture for the input address, saving packets to the provided buffer. Non-blocking.
+// startCapture for the input address, saving packets to the provided buffer. Packets are captured
+// by the capture manager, using a capture shared with any other addresses routed over the same
+// network interface. Non-blocking.
 func startCapture(
-	addr string, buffer *sharedBufferHook, dataPool *bpool.BufferPool,
-	f MutatorFactory, statsInterval time.Duration) (*captureProcess, error) {
+	addr string, spec *addressSpec, buffer *sharedBufferHook, captures *captureManager, r Resolver,
+	ipGracePeriod time.Duration, routeChanges *routeChangeBroadcaster) (*captureProcess, error) {
 
 	proc := captureProcess{
 		buffer:    buffer,
-		dataPool:  dataPool,
+		captures:  captures,
 		errorChan: make(chan error),
-		statsChan: make(chan CaptureStats),
 		stopChan:  make(chan struct{}),
-		readGroup: new(sync.WaitGroup),
-		f:         f,
+		doneChan:  make(chan struct{}),
+		r:         r,
+
+		ipGracePeriod: ipGracePeriod,
+		routeChanges:  routeChanges,
 	}
 	initErr := make(chan error)
-	go proc.watchRoutes(addr, statsInterval, initErr)
+	go proc.watchRoutes(addr, spec, initErr)
 	if err := <-initErr; err != nil {
 		return nil, err
 	}
 	return &proc, nil
 }
 
-func (cp *captureProcess) watchRoutes(addr string, statsInterval time.Duration, initErr chan error) {
+func (cp *captureProcess) watchRoutes(addr string, spec *addressSpec, initErr chan error) {
+	defer close(cp.doneChan)
 
-	host, port, err := net.SplitHostPort(addr)
-	if err != nil {
-		initErr <- ErrorMalformedAddress{err}
-		close(initErr)
-		return
-	}
-
-	startRouteCapture := func(u routeUpdate) (stopChan chan struct{}, err error) {
-		handle, err := pcap.OpenLive(u.iface.pcapName(), int32(u.iface.mtu()), false, packetReadTimeout)
-		if err != nil {
-			return nil, fmt.Errorf("failed to open capture handle: %w", err)
-		}
-
-		network := "ip"
-		if u.ip.To4() == nil {
-			network = "ip6"
+	startRouteCapture := func(u routeUpdate) (*captureRoute, error) {
+		r := spec.routeFor(u.ip, cp.buffer)
+		if err := cp.captures.addRoute(u.iface, r); err != nil {
+			return nil, err
 		}
-		bpf := fmt.Sprintf(
-			"(%s) or (%s)",
-			fmt.Sprintf("%s dst %v and dst port %s", network, u.ip, port),
-			fmt.Sprintf("%s src %v and src port %s", network, u.ip, port),
-		)
-		if err := handle.SetBPFFilter(bpf); err != nil {
-			handle.Close()
-			return nil, fmt.Errorf("failed to set capture filter: %w", err)
-		}
-
-		stopChan = make(chan struct{})
-		go cp.readPackets(handle, u.iface, statsInterval, stopChan)
-		return stopChan, nil
+		return r, nil
 	}
 
-	rw, err := newRouteWatcher(host)
+	rw, err := newRouteWatcher(addr, spec.resolveHost(), cp.r, cp.ipGracePeriod, cp.routeChanges)
 	if err != nil {
-		initErr <- fmt.Errorf("failed to establish route to host: %w", err)
+		initErr <- err
 		close(initErr)
 		return
 	}
 
 	// If the first update causes an error, there's probably something wrong - fail fast.
-	t := capturedRouteTracker{make(map[string]capturedRoute), startRouteCapture}
+	t := capturedRouteTracker{make(map[string]capturedRoute), startRouteCapture, cp.captures.removeRoute}
 	if err := t.handleUpdate(<-rw.updates()); err != nil {
+		rw.close()
 		initErr <- err
 		close(initErr)
 		return
@@ -145,6 +216,8 @@ func (cp *captureProcess) watchRoutes(addr string, statsInterval time.Duration,
 			if err := t.handleUpdate(u); err != nil {
 				cp.logError(err)
 			}
+		case err := <-rw.errors():
+			cp.logError(err)
 		case <-cp.stopChan:
 			t.close()
 			rw.close()
@@ -153,53 +226,6 @@ func (cp *captureProcess) watchRoutes(addr string, statsInterval time.Duration,
 	}
 }
 
-func (cp *captureProcess) readPackets(
-	handle *pcap.Handle, iface networkInterface, statsInterval time.Duration, stopChan <-chan struct{}) {
-
-	var received, droppedByUs uint64
-	mutator := cp.f.MutatorFor(iface.linkType)
-	statsTimer := time.NewTimer(statsInterval)
-	cp.readGroup.Add(1)
-	go func() {
-		defer cp.readGroup.Done()
-		defer statsTimer.Stop()
-		for {
-			select {
-			case <-statsTimer.C:
-				cp.logStats(handle, received, droppedByUs)
-				statsTimer.Reset(statsInterval)
-			default:
-			}
-
-			data, ci, err := handle.ZeroCopyReadPacketData()
-			if err != nil && err == io.EOF {
-				return
-			}
-			if err != nil {
-				if nextErr, ok := err.(pcap.NextError); !ok || nextErr != pcap.NextErrorTimeoutExpired {
-					cp.logError(fmt.Errorf("failed to read packet from capture handle: %w", err))
-					droppedByUs++
-				}
-				continue
-			}
-
-			dataBuf := cp.dataPool.Get()
-			if err = mutator(data, dataBuf); err != nil {
-				cp.logError(fmt.Errorf("packet mutation error: %w", err))
-				cp.dataPool.Put(dataBuf)
-				droppedByUs++
-				continue
-			}
-			ci.CaptureLength = dataBuf.Len()
-			cp.buffer.put(capturedPacket{newCaptureInfo(ci, &iface), dataBuf, cp.dataPool})
-			received++
-		}
-	}()
-	<-stopChan
-	cp.logStats(handle, received, droppedByUs)
-	handle.Close()
-}
-
 func (cp *captureProcess) logError(err error) {
 	select {
 	case cp.errorChan <- err:
@@ -207,73 +233,60 @@ func (cp *captureProcess) logError(err error) {
 	}
 }
 
-// logStats should not be called concurrently with any other methods on h.
-func (cp *captureProcess) logStats(h *pcap.Handle, received, droppedByUs uint64) {
-	// The "received" packets in the handle stats include all packets the handle saw on the
-	// interface (pre-BPF). We ignore that, but the dropped statistics reflect packets we might have
-	// missed because we weren't keeping up with ingress.
-	stats, err := h.Stats()
-	if err != nil {
-		cp.logError(fmt.Errorf("failed to read capture stats: %w", err))
-		return
-	}
-	cs := CaptureStats{received, uint64(stats.PacketsDropped) + droppedByUs}
-	select {
-	case cp.statsChan <- cs:
-	default:
-	}
-}
-
+// stop capture for the address and close its buffer hook. Once this returns, no more packets will
+// be captured for the address.
 func (cp *captureProcess) stop() {
-	close(cp.stopChan)
-	cp.readGroup.Wait()
-	close(cp.statsChan)
-	close(cp.errorChan)
+	cp.halt()
 	cp.buffer.close()
 }
 
-// forEach applies the input function to all packets currently in the buffer. Packets will be
-// provided in the order in which they were captured. Capture will be blocked while this function
-// runs so care should be taken to ensure the input function is cheap. The data in each packet's
-// buffer is only valid while this function runs. Once the function returns, these buffers may be
-// overwritten.
-func (cp *captureProcess) forEach(do func(pkt capturedPacket)) {
-	cp.buffer.forEach(func(i bufferItem) {
-		do(i.(capturedPacket))
-	})
+// halt capture for the address, like stop, but leave the buffer hook open for reuse.
+func (cp *captureProcess) halt() {
+	close(cp.stopChan)
+	<-cp.doneChan
+	close(cp.errorChan)
 }
 
 type capturedRoute struct {
-	iface    networkInterface
-	stopChan chan struct{}
+	iface networkInterface
+	route *captureRoute
 }
 
 type capturedRouteTracker struct {
 	// Maps IP addresses to routes currently being captured.
 	routes       map[string]capturedRoute
-	startCapture func(u routeUpdate) (stopChan chan struct{}, err error)
+	startCapture func(u routeUpdate) (*captureRoute, error)
+	stopCapture  func(*captureRoute)
 }
 
 func (t *capturedRouteTracker) handleUpdate(u routeUpdate) error {
 	ipStr := u.ip.String()
+	if u.expired {
+		if r, ok := t.routes[ipStr]; ok {
+			t.stopCapture(r.route)
+			delete(t.routes, ipStr)
+		}
+		return nil
+	}
 	if r, ok := t.routes[ipStr]; ok && r.iface.name() == u.iface.name() {
 		return nil
 	}
 
-	stopChan, err := t.startCapture(u)
+	route, err := t.startCapture(u)
 	if err != nil {
 		return err
 	}
 	if r, ok := t.routes[ipStr]; ok {
-		close(r.stopChan)
+		t.stopCapture(r.route)
 		delete(t.routes, ipStr)
 	}
-	t.routes[ipStr] = capturedRoute{u.iface, stopChan}
+	t.routes[ipStr] = capturedRoute{u.iface, route}
 	return nil
 }
 
 func (t *capturedRouteTracker) close() {
-	for _, r := range t.routes {
-		close(r.stopChan)
+	for ipStr, r := range t.routes {
+		t.stopCapture(r.route)
+		delete(t.routes, ipStr)
 	}
 }
@@ -0,0 +1,186 @@
+package trafficlog
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// The amount of packet data collected in a block before the block is compressed. Larger blocks
+// compress better, but each read of a packet decompresses its entire block.
+const compressedBlockSize = 32 * 1024
+
+// blockRef locates an item's data within a packetBlock.
+type blockRef struct {
+	block          *packetBlock
+	offset, length int
+}
+
+func (ref blockRef) data() ([]byte, error) {
+	return ref.block.read(ref.offset, ref.length)
+}
+
+func (ref blockRef) len() int {
+	return ref.length
+}
+
+// Space in a block is reclaimed only once the whole block is released.
+func (ref blockRef) release() {}
+
+// blockStore holds the data of items in a sharedRingBuffer in compressed blocks. Data is collected
+// in an open block until the block is full, at which point the block is compressed and sealed.
+//
+// Items are charged their uncompressed size while their block is open. Once the block is sealed,
+// the live items in the block are charged their share of its compressed size. A sealed block is
+// released once all of its items have been evicted, so until then, evicted items continue to occupy
+// space not accounted for by the buffer. Blocks are small relative to the buffer, so this is not
+// expected to make a significant difference.
+//
+// A blockStore is used with its buffer locked, except for reads of packet data; see
+// packetBlock.read.
+type blockStore struct {
+	open *packetBlock
+	w    *flate.Writer
+	out  bytes.Buffer
+
+	// The most recently decompressed block. Packets are usually read in order, so this saves each
+	// block being decompressed for each of its packets.
+	cached struct {
+		block *packetBlock
+		data  []byte
+		sync.Mutex
+	}
+}
+
+func newBlockStore() *blockStore {
+	s := new(blockStore)
+	// Only an invalid compression level results in an error.
+	s.w, _ = flate.NewWriter(nil, flate.BestSpeed)
+	return s
+}
+
+// store the packet's data in the open block. If the open block is sealed to make room for the
+// packet, the entries in the sealed block are charged their share of the block's compressed size.
+func (s *blockStore) store(
+	buf *sharedRingBuffer, entry *sharedEntry, pkt capturedPacket, saved *packetIDSet) bool {
+
+	data, err := pkt.data()
+	if err != nil {
+		return false
+	}
+	if s.open != nil && len(s.open.data)+len(data) > compressedBlockSize && len(s.open.data) > 0 {
+		sealed := s.open
+		s.seal(sealed)
+		s.open = nil
+		sealed.charges(buf.recharge)
+	}
+	if s.open == nil {
+		capacity := compressedBlockSize
+		if len(data) > capacity {
+			capacity = len(data)
+		}
+		s.open = &packetBlock{store: s, data: make([]byte, 0, capacity)}
+	}
+	ref := blockRef{s.open, len(s.open.data), len(data)}
+	s.open.Lock()
+	s.open.data = append(s.open.data, data...)
+	s.open.Unlock()
+	s.open.entries = append(s.open.entries, blockEntry{entry, entry.seq, len(data)})
+	entry.item = bufferedPacket(pkt.storedAt(ref), saved)
+	return true
+}
+
+func (s *blockStore) seal(b *packetBlock) {
+	s.out.Reset()
+	s.w.Reset(&s.out)
+	// Writes to a bytes.Buffer do not fail.
+	s.w.Write(b.data)
+	s.w.Close()
+
+	b.Lock()
+	b.rawLen = len(b.data)
+	b.data = append([]byte{}, s.out.Bytes()...)
+	b.sealed = true
+	b.Unlock()
+}
+
+// packetBlock is a block of packet data, stored uncompressed while open and compressed once sealed.
+type packetBlock struct {
+	store *blockStore
+
+	// entries holds the buffer entries with data in the block, in order. This is used to charge the
+	// entries once the block is sealed.
+	entries []blockEntry
+
+	data   []byte
+	rawLen int
+	sealed bool
+
+	// Protects data and sealed from reads concurrent with sealing.
+	sync.Mutex
+}
+
+// charges calls the input function with each live entry with data in the block and the size the
+// entry should be charged, now that the block is sealed. The charges for the entries add up to the
+// compressed size of the block, less the share of any evicted entries. Should only be called once,
+// on a sealed block.
+func (b *packetBlock) charges(charge func(entry *sharedEntry, size int)) {
+	var rawOffset, charged int
+	for _, e := range b.entries {
+		rawOffset += e.length
+		// Charges are rounded so that their total does not drift from the compressed size.
+		size := rawOffset*len(b.data)/b.rawLen - charged
+		charged += size
+		if e.entry.live(e.seq) {
+			charge(e.entry, size+overheadPerPacket)
+		}
+	}
+	b.entries = nil
+}
+
+// blockEntry is a buffer entry with data in a packetBlock.
+type blockEntry struct {
+	entry  *sharedEntry
+	seq    uint32
+	length int
+}
+
+// read the data at the input offset and length in the block's uncompressed data. Sealed blocks are
+// decompressed as needed. The result should not be modified. This may be called concurrently with
+// other operations on the block store.
+//
+// An error is returned only if the block cannot be decompressed. We compressed the block ourselves,
+// so this would be a bug, but it is reported to the reader rather than taking down the process.
+func (b *packetBlock) read(offset, length int) ([]byte, error) {
+	b.Lock()
+	data, sealed := b.data, b.sealed
+	b.Unlock()
+	if !sealed {
+		return data[offset : offset+length : offset+length], nil
+	}
+
+	cached := &b.store.cached
+	cached.Lock()
+	defer cached.Unlock()
+	if cached.block != b {
+		// Earlier results may still be in use, so the decompressed data is not reused.
+		decompressed, err := decompress(data, b.rawLen)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress packet block: %w", err)
+		}
+		cached.block, cached.data = b, decompressed
+	}
+	return cached.data[offset : offset+length : offset+length], nil
+}
+
+func decompress(compressed []byte, rawLen int) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(compressed))
+	defer r.Close()
+	data := make([]byte, rawLen)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
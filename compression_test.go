@@ -0,0 +1,178 @@
+package trafficlog
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/oxtoacart/bpool"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestPacket(pool *bpool.BufferPool, id uint64, data []byte) capturedPacket {
+	buf := pool.Get()
+	buf.Write(data)
+	return capturedPacket{id, captureInfo{}, buf, pool, nil}
+}
+
+func TestBlockStore(t *testing.T) {
+	t.Parallel()
+
+	const packetLen = 1000
+
+	pool := bpool.NewBufferPool(dataPoolSize)
+	rb := newSharedRingBuffer(1024 * 1024)
+	rb.store = newBlockStore()
+	h1, h2 := rb.newHook(), rb.newHook()
+
+	// Enough packets to fill a few blocks. The packets are very compressible.
+	expected := [][]byte{}
+	for i := 0; i < 3*compressedBlockSize/packetLen; i++ {
+		data := bytes.Repeat([]byte{byte(i)}, packetLen)
+		rb.putShared(newTestPacket(pool, uint64(i), data), []*sharedBufferHook{h1, h2})
+		expected = append(expected, data)
+	}
+	for _, h := range []*sharedBufferHook{h1, h2} {
+		require.Equal(t, expected, hookContents(t, h))
+	}
+
+	// Entries in sealed blocks are charged for their share of the compressed data. The open block is
+	// charged in full.
+	open := len(rb.store.(*blockStore).open.entries)
+	sealed := len(expected) - open
+	openSize := open * (packetLen + overheadPerPacket)
+	require.Greater(t, rb.size, openSize+sealed*overheadPerPacket)
+	require.Less(t, rb.size, openSize+sealed*(overheadPerPacket+packetLen/10))
+	require.Equal(t, rb.size, h1.size)
+
+	// Entries evicted before their block is sealed are not charged.
+	rb.updateCap(rb.size)
+	rb.putShared(newTestPacket(pool, 1000, make([]byte, 10)), []*sharedBufferHook{h1})
+	sizes := 0
+	rb.masterQueue.forEach(func(entry *sharedEntry) {
+		if !entry.evicted {
+			sizes += int(entry.size)
+		}
+	})
+	require.Equal(t, rb.size, sizes)
+}
+
+func TestBlockStoreCorruptBlock(t *testing.T) {
+	t.Parallel()
+
+	const packetLen = 1000
+
+	pool := bpool.NewBufferPool(dataPoolSize)
+	rb := newSharedRingBuffer(1024 * 1024)
+	rb.store = newBlockStore()
+	h := rb.newHook()
+	for i := 0; i < 2*compressedBlockSize/packetLen; i++ {
+		h.put(newTestPacket(pool, uint64(i), bytes.Repeat([]byte{byte(i)}, packetLen)))
+	}
+
+	// The first block is sealed. Its compressed data is truncated, so it cannot be decompressed.
+	var block *packetBlock
+	h.forEach(func(item bufferItem) {
+		if block == nil {
+			block = item.(packetItem).captured().ref.(blockRef).block
+		}
+	})
+	require.True(t, block.sealed)
+	block.data = block.data[:len(block.data)/2]
+
+	// Reads from the corrupt block fail, but reads from other blocks succeed.
+	var failed, read int
+	h.forEach(func(item bufferItem) {
+		pkt := item.(packetItem).captured()
+		data, err := pkt.data()
+		if pkt.ref.(blockRef).block == block {
+			require.Error(t, err)
+			require.False(t, errors.Is(err, errEvicted))
+			failed++
+			return
+		}
+		require.NoError(t, err)
+		require.Equal(t, bytes.Repeat([]byte{byte(pkt.id)}, packetLen), data)
+		read++
+	})
+	require.Greater(t, failed, 0)
+	require.Greater(t, read, 0)
+}
+
+func TestCompressBuffers(t *testing.T) {
+	t.Parallel()
+
+	const (
+		client = "10.0.0.1:50000"
+		server = "10.0.0.2:443"
+	)
+
+	tl := New(1024*1024, 1024*1024, &Options{CompressBuffers: true})
+	defer tl.Close()
+
+	frames, payloads := []testFrame{}, []string{}
+	for i := 0; i < 1000; i++ {
+		payload := fmt.Sprintf("request %d", i)
+		frames = append(frames, testFrame{client, server, payload, time.Now()})
+		payloads = append(payloads, payload)
+	}
+	require.NoError(t, tl.Replay(bytes.NewReader(writePcapng(t, frames)), []string{server}, nil))
+	tl.SaveCaptures(server, time.Minute)
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, tl.WritePcapng(buf))
+	require.Equal(t, payloads, readPayloads(t, buf.Bytes()))
+}
+
+// BenchmarkCompressBuffers reports how many packets a 1 MB capture buffer holds, with and without
+// compression. The packets are from an actual capture, with or without their payloads stripped.
+func BenchmarkCompressBuffers(b *testing.B) {
+	const bufferSize = 1024 * 1024
+
+	pkts, err := readPacketsFile("internal/testdata/100.pkts")
+	if err != nil {
+		b.Fatal(err)
+	}
+	stripped := make([][]byte, len(pkts))
+	stripper := new(AppStripperFactory).MutatorFor(LinkTypeEthernet)
+	for i, pkt := range pkts {
+		buf := new(bytes.Buffer)
+		if err := stripper(pkt, buf); err != nil {
+			b.Fatal(err)
+		}
+		stripped[i] = buf.Bytes()
+	}
+
+	for _, pktsCase := range []struct {
+		name string
+		pkts [][]byte
+	}{{"full", pkts}, {"stripped", stripped}} {
+		for _, compress := range []bool{false, true} {
+			name := fmt.Sprintf("%s/compress=%t", pktsCase.name, compress)
+			pkts := pktsCase.pkts
+			compress := compress
+			b.Run(name, func(b *testing.B) {
+				pool := bpool.NewBufferPool(dataPoolSize)
+				rb := newSharedRingBuffer(bufferSize)
+				if compress {
+					rb.store = newBlockStore()
+				}
+				h := rb.newHook()
+
+				// Each packet costs at least overheadPerPacket, so this fills the buffer.
+				for i := 0; i < 2*bufferSize/overheadPerPacket; i++ {
+					h.put(newTestPacket(pool, uint64(i), pkts[i%len(pkts)]))
+				}
+				b.ResetTimer()
+
+				for i := 0; i < b.N; i++ {
+					h.put(newTestPacket(pool, uint64(i), pkts[i%len(pkts)]))
+				}
+				b.StopTimer()
+				b.ReportMetric(float64(rb.masterQueue.len()-rb.evicted), "pkts/MB")
+			})
+		}
+	}
+}
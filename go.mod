@@ -7,4 +7,5 @@ require (
 	github.com/montanaflynn/stats v0.6.3
 	github.com/oxtoacart/bpool v0.0.0-20190530202638-03653db5a59c
 	github.com/stretchr/testify v1.5.1
+	golang.org/x/net v0.0.0-20190404232315-eb5bcb51f2a3
 )
@@ -0,0 +1,731 @@
+package trafficlog
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/oxtoacart/bpool"
+)
+
+// A captureRoute is a route over which traffic for an address is captured: packets going to or
+// coming from an IP (or a network of IPs) on a range of ports. Packets on the route are stored
+// using the address' hook.
+//
+// A route with no network is an interface-wide route, capturing all packets on its interface which
+// match its filter expression. See TrafficLog.UpdateInterfaces.
+type captureRoute struct {
+	network *net.IPNet
+	proto   uint8 // zero for any protocol
+	ports   portRange
+	hook    *sharedBufferHook
+
+	// An optional BPF expression, ANDed with the filter generated for the route. This is compiled
+	// into userFilter by the captureManager.
+	filter     string
+	userFilter *userFilter
+
+	// related widens the route to include ICMP errors about packets on the route and IP fragments
+	// to and from the route's network. See Options.CaptureICMPAndFragments.
+	related bool
+
+	// The settings required of the packet source from which the route is captured.
+	settings CaptureSettings
+
+	// The pcap name of the interface on which the route is captured. Set by the captureManager.
+	iface string
+}
+
+// singleIP reports whether the route's network holds a single IP.
+func (r *captureRoute) singleIP() bool {
+	ones, bits := r.network.Mask.Size()
+	return ones == bits
+}
+
+// bpf returns the capture filter for this route. This is empty for interface-wide routes with no
+// filter expression.
+func (r *captureRoute) bpf() string {
+	if r.network == nil {
+		return r.filter
+	}
+	generated := r.generatedBPF()
+	if r.related {
+		generated = fmt.Sprintf("(%s) or (%s) or (%s)", generated, r.icmpErrorBPF(), r.fragmentBPF())
+	}
+	if r.filter == "" {
+		return generated
+	}
+	return fmt.Sprintf("(%s) and (%s)", generated, r.filter)
+}
+
+// icmpErrorBPF returns a filter for ICMP errors embedding a packet to or from the route's network.
+// Ports and protocols are not considered; these are checked when demultiplexing captured packets.
+func (r *captureRoute) icmpErrorBPF() string {
+	// Offsets of the source and destination IPs in the embedded packet.
+	const (
+		icmpEmbeddedSrc  = icmpHeaderLen + 12
+		icmpEmbeddedDst  = icmpHeaderLen + 16
+		icmp6EmbeddedSrc = ipv6HeaderLen + icmpHeaderLen + 8
+		icmp6EmbeddedDst = ipv6HeaderLen + icmpHeaderLen + 24
+	)
+	if r.network.IP.To4() != nil {
+		types := make([]string, len(icmpErrorTypes))
+		for i, t := range icmpErrorTypes {
+			types[i] = fmt.Sprintf("icmp[0] == %d", t)
+		}
+		return fmt.Sprintf(
+			"icmp and (%s) and ((%s) or (%s))", strings.Join(types, " or "),
+			r.networkAt("icmp", icmpEmbeddedSrc), r.networkAt("icmp", icmpEmbeddedDst),
+		)
+	}
+	// The pcap-filter language does not support indexing into ICMPv6 headers, so we index from the
+	// IPv6 header, assuming there are no extension headers.
+	return fmt.Sprintf(
+		"ip6[6] == %d and ip6[%d] >= 1 and ip6[%d] <= 4 and ((%s) or (%s))",
+		ipProtoICMPv6, ipv6HeaderLen, ipv6HeaderLen,
+		r.networkAt("ip6", icmp6EmbeddedSrc), r.networkAt("ip6", icmp6EmbeddedDst),
+	)
+}
+
+// fragmentBPF returns a filter for IP fragments to or from the route's network.
+func (r *captureRoute) fragmentBPF() string {
+	hostPrimitive := "ip host " + r.network.IP.String()
+	if !r.singleIP() {
+		hostPrimitive = "ip net " + r.network.String()
+	}
+	if r.network.IP.To4() != nil {
+		bpf := hostPrimitive + " and ip[6:2] & 0x3fff != 0"
+		if r.proto != 0 {
+			bpf += fmt.Sprintf(" and ip[9] == %d", r.proto)
+		}
+		return bpf
+	}
+	bpf := fmt.Sprintf("ip6%s and ip6[6] == %d", strings.TrimPrefix(hostPrimitive, "ip"), ipProtoIPv6Fragment)
+	if r.proto != 0 {
+		// The protocol of the fragmented packet is the next header field of the fragment header.
+		bpf += fmt.Sprintf(" and ip6[%d] == %d", ipv6HeaderLen, r.proto)
+	}
+	return bpf
+}
+
+// networkAt returns a filter matching an IP address in the route's network at the given offset into
+// the header of the input protocol.
+func (r *captureRoute) networkAt(proto string, offset int) string {
+	ip, mask := r.network.IP, r.network.Mask
+	if len(ip) != len(mask) {
+		ip = ip.To16()
+	}
+	clauses := []string{}
+	for i := 0; i < len(ip); i += 4 {
+		m := binary.BigEndian.Uint32(mask[i : i+4])
+		if m == 0 {
+			break
+		}
+		v := binary.BigEndian.Uint32(ip[i:i+4]) & m
+		if m == 0xffffffff {
+			clauses = append(clauses, fmt.Sprintf("%s[%d:4] == 0x%08x", proto, offset+i, v))
+		} else {
+			clauses = append(clauses, fmt.Sprintf("%s[%d:4] & 0x%08x == 0x%08x", proto, offset+i, m, v))
+		}
+	}
+	if len(clauses) == 0 {
+		// A zero-length prefix matches everything.
+		return "len >= 0"
+	}
+	return strings.Join(clauses, " and ")
+}
+
+// generatedBPF returns the capture filter for the route's network, protocol and ports.
+func (r *captureRoute) generatedBPF() string {
+	family := "ip"
+	if r.network.IP.To4() == nil {
+		family = "ip6"
+	}
+	hostPrimitive := func(dir string) string {
+		if !r.singleIP() {
+			return strings.Join(nonEmpty(family, dir, "net", r.network.String()), " ")
+		}
+		if dir == "" {
+			dir = "host"
+		}
+		return strings.Join([]string{family, dir, r.network.IP.String()}, " ")
+	}
+	proto := ""
+	switch r.proto {
+	case ipProtoTCP:
+		proto = "tcp"
+	case ipProtoUDP:
+		proto = "udp"
+	}
+
+	if r.ports == allPorts {
+		return strings.Join(nonEmpty(hostPrimitive(""), andIf(proto)), " ")
+	}
+	portPrimitive := func(dir string) string {
+		if r.ports.first == r.ports.last {
+			return strings.Join(nonEmpty(proto, dir, "port", strconv.Itoa(int(r.ports.first))), " ")
+		}
+		portRange := fmt.Sprintf("%d-%d", r.ports.first, r.ports.last)
+		return strings.Join(nonEmpty(proto, dir, "portrange", portRange), " ")
+	}
+	return fmt.Sprintf(
+		"(%s and %s) or (%s and %s)",
+		hostPrimitive("dst"), portPrimitive("dst"), hostPrimitive("src"), portPrimitive("src"),
+	)
+}
+
+// matchesPacket reports whether the packet matches this route's capture filter. The packet's
+// addresses are checked first; the route's filter expression is only evaluated if they match.
+func (r *captureRoute) matchesPacket(addrs packetAddrs, ci gopacket.CaptureInfo, data []byte) bool {
+	return (r.network == nil || r.matches(addrs)) && (r.userFilter == nil || r.userFilter.matches(ci, data))
+}
+
+// matches reports whether the packet's addresses match this route, ignoring any filter expression.
+func (r *captureRoute) matches(addrs packetAddrs) bool {
+	if r.matchesIP(addrs.ipAddrs) {
+		return true
+	}
+	if !r.related {
+		return false
+	}
+	if addrs.icmpError && r.matchesIP(addrs.embedded) {
+		return true
+	}
+	return addrs.fragment && (r.proto == 0 || addrs.proto == r.proto) &&
+		(r.network.Contains(addrs.dstIP) || r.network.Contains(addrs.srcIP))
+}
+
+func (r *captureRoute) matchesIP(addrs ipAddrs) bool {
+	if r.proto != 0 && addrs.proto != r.proto {
+		return false
+	}
+	if r.ports == allPorts {
+		return r.network.Contains(addrs.dstIP) || r.network.Contains(addrs.srcIP)
+	}
+	if !addrs.hasPorts {
+		return false
+	}
+	return (r.ports.contains(addrs.dstPort) && r.network.Contains(addrs.dstIP)) ||
+		(r.ports.contains(addrs.srcPort) && r.network.Contains(addrs.srcIP))
+}
+
+func nonEmpty(ss ...string) []string {
+	filtered := ss[:0]
+	for _, s := range ss {
+		if s != "" {
+			filtered = append(filtered, s)
+		}
+	}
+	return filtered
+}
+
+func andIf(expr string) string {
+	if expr == "" {
+		return ""
+	}
+	return "and " + expr
+}
+
+// routeTable indexes the routes captured on an interface, allowing captured packets to be
+// demultiplexed to the hooks of the addresses they belong to. A routeTable is never modified once
+// built, so it may be read without locking.
+type routeTable struct {
+	// Routes to single IPs are indexed by IP. Routes to networks are checked against every IP
+	// packet. Interface-wide routes are checked against every packet.
+	byIP          map[ipKey][]*captureRoute
+	networks      []*captureRoute
+	interfaceWide []*captureRoute
+}
+
+func newRouteTable(routes map[*captureRoute]bool) *routeTable {
+	t := routeTable{byIP: map[ipKey][]*captureRoute{}}
+	for r := range routes {
+		if r.network == nil {
+			t.interfaceWide = append(t.interfaceWide, r)
+			continue
+		}
+		if !r.singleIP() {
+			t.networks = append(t.networks, r)
+			continue
+		}
+		k := keyFor(r.network.IP)
+		t.byIP[k] = append(t.byIP[k], r)
+	}
+	return &t
+}
+
+// match appends to hooks the hook of each route matching the packet. Each hook is appended at most
+// once, so a packet matching several routes for one address is attributed to the address once. If
+// isIP is not set, the packet could not be decoded as an IP packet and only interface-wide routes
+// are considered.
+func (t *routeTable) match(
+	addrs packetAddrs, isIP bool, ci gopacket.CaptureInfo, data []byte,
+	hooks []*sharedBufferHook) []*sharedBufferHook {
+
+	appendMatches := func(candidates []*captureRoute) {
+	nextCandidate:
+		for _, r := range candidates {
+			if !r.matchesPacket(addrs, ci, data) {
+				continue
+			}
+			for _, hook := range hooks {
+				if hook == r.hook {
+					continue nextCandidate
+				}
+			}
+			hooks = append(hooks, r.hook)
+		}
+	}
+	if isIP {
+		appendMatches(t.byIP[keyFor(addrs.dstIP)])
+		appendMatches(t.byIP[keyFor(addrs.srcIP)])
+		if addrs.icmpError {
+			appendMatches(t.byIP[keyFor(addrs.embedded.dstIP)])
+			appendMatches(t.byIP[keyFor(addrs.embedded.srcIP)])
+		}
+		appendMatches(t.networks)
+	}
+	appendMatches(t.interfaceWide)
+	return hooks
+}
+
+// captureManager maintains a single capture per network interface. Each capture is shared by all
+// routes over the interface; its capture filter is the union of the filters for these routes.
+type captureManager struct {
+	// Accessed atomically. Declared first to ensure 64-bit alignment.
+	lastPacketID uint64
+
+	captures      map[string]*interfaceCapture // keyed by pcap interface name
+	dataPool      *bpool.BufferPool
+	f             MutatorFactory
+	sf            PacketSourceFactory
+	stats         *statsTracker
+	errorChan     chan<- error
+	statsInterval time.Duration
+
+	// captureRelated is applied to each route. See Options.CaptureICMPAndFragments.
+	captureRelated bool
+
+	// While batching, filters are not applied to running captures as routes are added and removed.
+	// Filters for the captures in dirty are instead applied once the batch ends.
+	batching bool
+	dirty    map[string]bool
+
+	sync.Mutex
+}
+
+func newCaptureManager(
+	dataPool *bpool.BufferPool, opts Options, stats *statsTracker, errorChan chan<- error) *captureManager {
+
+	return &captureManager{
+		captures:       map[string]*interfaceCapture{},
+		dataPool:       dataPool,
+		f:              opts.mutatorFactory(),
+		sf:             opts.sourceFactory(),
+		stats:          stats,
+		errorChan:      errorChan,
+		statsInterval:  opts.statsInterval() / procStatsPerLogStats,
+		captureRelated: opts.CaptureICMPAndFragments,
+		dirty:          map[string]bool{},
+	}
+}
+
+// addRoute begins capture for the route on the input interface. If there is no capture running
+// on the interface, one is started. If the running capture does not satisfy the route's settings,
+// the capture is restarted with settings satisfying all of its routes.
+func (m *captureManager) addRoute(iface networkInterface, r *captureRoute) error {
+	m.Lock()
+	defer m.Unlock()
+
+	settings := r.settings.resolve(iface)
+	ic, running := m.captures[iface.pcapName()]
+	switch {
+	case !running:
+		var err error
+		ic, err = m.startInterfaceCapture(iface, settings)
+		if err != nil {
+			return err
+		}
+		m.captures[iface.pcapName()] = ic
+	case ic.settings.merge(settings) != ic.settings:
+		var err error
+		ic, err = m.restartInterfaceCapture(ic, ic.settings.merge(settings))
+		if err != nil {
+			return err
+		}
+	}
+	if r.filter != "" {
+		// The expression was validated against Ethernet when parsed, but it may not be valid for
+		// the link type of this interface.
+		uf, err := newUserFilter(ic.iface.linkType, r.filter)
+		if err != nil {
+			if !running {
+				ic.stop()
+				delete(m.captures, iface.pcapName())
+			}
+			return ErrorMalformedAddress{err}
+		}
+		r.userFilter = uf
+	}
+	r.iface = iface.pcapName()
+	r.related = m.captureRelated
+	ic.routes[r] = true
+	ic.updateTable()
+
+	// A new capture has no filter at all, so we apply one immediately, even while batching.
+	if m.batching && running {
+		m.dirty[r.iface] = true
+		return nil
+	}
+	if err := ic.applyFilter(); err != nil {
+		delete(ic.routes, r)
+		ic.updateTable()
+		if !running {
+			ic.stop()
+			delete(m.captures, r.iface)
+		}
+		return err
+	}
+	return nil
+}
+
+// removeRoute stops capture for the route. If no routes remain on the route's interface, capture
+// stops on the interface.
+func (m *captureManager) removeRoute(r *captureRoute) {
+	m.Lock()
+	defer m.Unlock()
+
+	ic, ok := m.captures[r.iface]
+	if !ok || !ic.routes[r] {
+		return
+	}
+	delete(ic.routes, r)
+	ic.updateTable()
+	if m.batching {
+		m.dirty[r.iface] = true
+		return
+	}
+	if err := m.refresh(r.iface); err != nil {
+		m.logError(err)
+	}
+}
+
+// beginBatch defers the application of capture filters until endBatch is called. This ensures that
+// filters are recompiled once, rather than once per route, when many routes change together.
+func (m *captureManager) beginBatch() {
+	m.Lock()
+	m.batching = true
+	m.Unlock()
+}
+
+// endBatch applies the capture filters for all interfaces with routes added or removed since the
+// call to beginBatch.
+func (m *captureManager) endBatch() error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.batching = false
+	var lastErr error
+	for name := range m.dirty {
+		if err := m.refresh(name); err != nil {
+			lastErr = err
+		}
+		delete(m.dirty, name)
+	}
+	return lastErr
+}
+
+// refresh the capture on the named interface, applying the current filter or stopping the capture
+// if there are no longer any routes. Should be called with m locked.
+func (m *captureManager) refresh(name string) error {
+	ic, ok := m.captures[name]
+	if !ok {
+		return nil
+	}
+	if len(ic.routes) == 0 {
+		ic.stop()
+		delete(m.captures, name)
+		return nil
+	}
+	return ic.applyFilter()
+}
+
+// close stops all captures.
+func (m *captureManager) close() {
+	m.Lock()
+	defer m.Unlock()
+
+	for name, ic := range m.captures {
+		ic.stop()
+		delete(m.captures, name)
+	}
+}
+
+// nextPacketID returns a new ID for a captured packet.
+func (m *captureManager) nextPacketID() uint64 {
+	return atomic.AddUint64(&m.lastPacketID, 1)
+}
+
+func (m *captureManager) logError(err error) {
+	select {
+	case m.errorChan <- err:
+	default:
+	}
+}
+
+// Should be called with m locked.
+func (m *captureManager) startInterfaceCapture(
+	iface networkInterface, settings CaptureSettings) (*interfaceCapture, error) {
+
+	src, err := m.sf.SourceFor(SourceConfig{
+		Interface:            iface.pcapName(),
+		SnapLen:              settings.SnapLen,
+		ReadTimeout:          packetReadTimeout,
+		Promiscuous:          settings.Promiscuous,
+		ImmediateMode:        settings.ImmediateMode,
+		BufferSize:           settings.BufferSize,
+		NanosecondTimestamps: settings.NanosecondTimestamps,
+	})
+	if err != nil {
+		return nil, err
+	}
+	iface.snapLen, iface.nanoTimestamps = settings.SnapLen, settings.NanosecondTimestamps
+	if rs, ok := src.(TimestampResolutionSource); ok {
+		// Record the precision the source actually provides, which may be less than requested.
+		if res := rs.Resolution().ToDuration(); res > 0 {
+			iface.nanoTimestamps = iface.nanoTimestamps && res <= time.Nanosecond
+		}
+	}
+	// The link type depends on the interface and on the capture backend, so we take it from the
+	// opened source.
+	iface.linkType, err = sourceLinkType(src)
+	if err != nil {
+		src.Close()
+		return nil, err
+	}
+
+	ic := &interfaceCapture{
+		iface:     iface,
+		settings:  settings,
+		src:       src,
+		routes:    map[*captureRoute]bool{},
+		dataPool:  m.dataPool,
+		nextID:    m.nextPacketID,
+		logError:  m.logError,
+		statsChan: make(chan CaptureStats),
+		stopChan:  make(chan struct{}),
+		readDone:  make(chan struct{}),
+	}
+	ic.updateTable()
+	go m.stats.track(ic.statsChan)
+	go ic.readPackets(m.f.MutatorFor(iface.linkType), m.statsInterval)
+	return ic, nil
+}
+
+// restartInterfaceCapture replaces the input capture with a new capture using the input settings.
+// The routes are moved to the new capture. If an error is returned, the input capture continues.
+// Should be called with m locked.
+func (m *captureManager) restartInterfaceCapture(
+	old *interfaceCapture, settings CaptureSettings) (*interfaceCapture, error) {
+
+	ic, err := m.startInterfaceCapture(old.iface, settings)
+	if err != nil {
+		return nil, err
+	}
+	for r := range old.routes {
+		ic.routes[r] = true
+	}
+	ic.updateTable()
+	if err := ic.applyFilter(); err != nil {
+		ic.stop()
+		return nil, err
+	}
+	old.stop()
+	m.captures[ic.iface.pcapName()] = ic
+	return ic, nil
+}
+
+// interfaceCapture captures packets on a single network interface on behalf of all routes over the
+// interface.
+type interfaceCapture struct {
+	iface    networkInterface
+	settings CaptureSettings
+	src      PacketSource
+	dataPool *bpool.BufferPool
+	nextID   func() uint64
+	logError func(error)
+
+	// The routes captured on this interface and the filter currently applied for them. Guarded by
+	// the captureManager's lock.
+	routes map[*captureRoute]bool
+	filter string
+
+	// Holds a *routeTable built from the routes. Read for each captured packet.
+	table atomic.Value
+
+	statsChan chan CaptureStats
+	stopChan  chan struct{}
+	readDone  chan struct{}
+}
+
+func (ic *interfaceCapture) updateTable() {
+	ic.table.Store(newRouteTable(ic.routes))
+}
+
+// applyFilter sets the capture filter to the union of the filters for each route. Setting the
+// filter replaces the old filter in one step, so no packets are missed in the transition.
+func (ic *interfaceCapture) applyFilter() error {
+	clauses := map[string]bool{}
+	for r := range ic.routes {
+		clauses[r.bpf()] = true
+	}
+	// If any route is unfiltered, so is the capture.
+	filter := ""
+	if !clauses[""] {
+		sorted := make([]string, 0, len(clauses))
+		for clause := range clauses {
+			sorted = append(sorted, "("+clause+")")
+		}
+		sort.Strings(sorted)
+		filter = strings.Join(sorted, " or ")
+	}
+	if filter == ic.filter {
+		return nil
+	}
+	if err := ic.src.SetBPFFilter(filter); err != nil {
+		return fmt.Errorf("failed to set capture filter on %s: %w", ic.iface.name(), err)
+	}
+	ic.filter = filter
+	return nil
+}
+
+func (ic *interfaceCapture) readPackets(mutator PacketMutator, statsInterval time.Duration) {
+	defer close(ic.readDone)
+
+	var (
+		received, droppedByUs uint64
+		statsTimer            = time.NewTimer(statsInterval)
+		matched               []*sharedBufferHook
+	)
+	defer statsTimer.Stop()
+	for {
+		select {
+		case <-statsTimer.C:
+			ic.logStats(received, droppedByUs)
+			statsTimer.Reset(statsInterval)
+		case <-ic.stopChan:
+			ic.logStats(received, droppedByUs)
+			return
+		default:
+		}
+
+		data, ci, err := ic.src.ZeroCopyReadPacketData()
+		if err != nil && err == io.EOF {
+			return
+		}
+		if err != nil {
+			if !errors.Is(err, ErrReadTimeout) {
+				ic.logError(fmt.Errorf("failed to read packet from capture source: %w", err))
+				droppedByUs++
+			}
+			continue
+		}
+
+		if !ic.settings.NanosecondTimestamps {
+			ci.Timestamp = ci.Timestamp.Truncate(time.Microsecond)
+		}
+		addrs, isIP := decodeAddrs(ic.iface.linkType, data)
+		matched = ic.table.Load().(*routeTable).match(addrs, isIP, ci, data, matched[:0])
+		if len(matched) == 0 {
+			// This can happen briefly while the filter is updated.
+			continue
+		}
+
+		dataBuf := ic.dataPool.Get()
+		if err = mutator(data, dataBuf); err != nil {
+			ic.logError(fmt.Errorf("packet mutation error: %w", err))
+			ic.dataPool.Put(dataBuf)
+			droppedByUs++
+			continue
+		}
+		ci.CaptureLength = dataBuf.Len()
+		// The packet is stored once, regardless of how many addresses it matched.
+		pkt := capturedPacket{ic.nextID(), newCaptureInfo(ci, &ic.iface), dataBuf, ic.dataPool, nil}
+		matched[0].buf.putPacket(pkt, nil, matched)
+		received++
+	}
+}
+
+func (ic *interfaceCapture) logStats(received, droppedByUs uint64) {
+	// The "received" packets in the source stats may include all packets the source saw on the
+	// interface (pre-BPF). We ignore that, but the dropped statistics reflect packets we might have
+	// missed because we weren't keeping up with ingress.
+	stats, err := ic.src.Stats()
+	if err != nil {
+		ic.logError(fmt.Errorf("failed to read capture stats: %w", err))
+		return
+	}
+	cs := CaptureStats{received, stats.Dropped + droppedByUs}
+	select {
+	case ic.statsChan <- cs:
+	default:
+	}
+}
+
+// stop capture on the interface. Blocks until the final statistics have been reported and the
+// source has been closed.
+func (ic *interfaceCapture) stop() {
+	close(ic.stopChan)
+	<-ic.readDone
+	ic.src.Close()
+	close(ic.statsChan)
+}
+
+// interfaceWideCapture captures all packets matching a filter expression on one or more network
+// interfaces, regardless of address. See TrafficLog.UpdateInterfaces.
+type interfaceWideCapture struct {
+	buffer   *sharedBufferHook
+	captures *captureManager
+	routes   []*captureRoute
+}
+
+// startInterfaceWideCapture on the input interfaces, saving packets to the provided buffer. If an
+// error is returned, capture has been stopped on any interfaces for which it started, but the
+// buffer has not been closed.
+func startInterfaceWideCapture(
+	ifaces []networkInterface, filter string, settings CaptureSettings, buffer *sharedBufferHook,
+	captures *captureManager) (*interfaceWideCapture, error) {
+
+	c := interfaceWideCapture{buffer: buffer, captures: captures}
+	for _, iface := range ifaces {
+		r := &captureRoute{hook: buffer, filter: filter, settings: settings}
+		if err := captures.addRoute(iface, r); err != nil {
+			c.removeRoutes()
+			return nil, fmt.Errorf("failed to start capture on %s: %w", iface.name(), err)
+		}
+		c.routes = append(c.routes, r)
+	}
+	return &c, nil
+}
+
+func (c *interfaceWideCapture) removeRoutes() {
+	for _, r := range c.routes {
+		c.captures.removeRoute(r)
+	}
+	c.routes = nil
+}
+
+// stop capture on all interfaces. Once this returns, no more packets will be captured.
+func (c *interfaceWideCapture) stop() {
+	c.removeRoutes()
+	c.buffer.close()
+}
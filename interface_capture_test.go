@@ -0,0 +1,307 @@
+package trafficlog
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/getlantern/trafficlog/tltest"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcap"
+	"github.com/oxtoacart/bpool"
+	"github.com/stretchr/testify/require"
+)
+
+// injectFrames delivers each of the frames to the sources opened by the fake capture.
+func injectFrames(fc *tltest.FakeCapture, frames ...[]byte) {
+	for _, frame := range frames {
+		fc.InjectFrame(frame)
+	}
+}
+
+// testRoute returns a route for an address, which should use an IP or network for its host.
+func testRoute(t testing.TB, addr string, hook *sharedBufferHook) *captureRoute {
+	t.Helper()
+	spec, err := parseAddress(addr)
+	require.NoError(t, err)
+	return spec.routeFor(net.ParseIP(spec.host), hook)
+}
+
+func hookContents(t *testing.T, hook *sharedBufferHook) [][]byte {
+	t.Helper()
+	contents := [][]byte{}
+	hook.forEach(func(i bufferItem) {
+		data, err := i.(packetItem).captured().data()
+		require.NoError(t, err)
+		contents = append(contents, data)
+	})
+	return contents
+}
+
+// waitForHookContents waits for each hook to hold the expected packets, failing the test if this
+// takes too long.
+func waitForHookContents(t *testing.T, hooks []*sharedBufferHook, expected [][][]byte) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for i, hook := range hooks {
+		for len(hookContents(t, hook)) < len(expected[i]) && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		require.Equal(t, expected[i], hookContents(t, hook), "unexpected contents for hook %d", i)
+	}
+}
+
+func TestCaptureManager(t *testing.T) {
+	t.Parallel()
+
+	var (
+		sf           = newFakeSourceFactory()
+		buf          = newSharedRingBuffer(1024 * 1024)
+		hooks        = []*sharedBufferHook{buf.newHook(), buf.newHook(), buf.newHook()}
+		errorChan    = make(chan error, channelBufferSize)
+		statsTracker = newStatsTracker(time.Hour)
+		iface        = networkInterface{pcapInterface: pcap.Interface{Name: "test0"}}
+	)
+	defer statsTracker.close()
+	m := newCaptureManager(
+		bpool.NewBufferPool(dataPoolSize), Options{PacketSourceFactory: sf, StatsInterval: time.Hour},
+		statsTracker, errorChan)
+
+	// The first and third routes are identical, as with two addresses resolving to the same IP.
+	routes := []*captureRoute{
+		testRoute(t, "10.0.0.1:443", hooks[0]),
+		testRoute(t, "10.0.0.2:80", hooks[1]),
+		testRoute(t, "10.0.0.1:443", hooks[2]),
+	}
+	m.beginBatch()
+	for _, r := range routes {
+		require.NoError(t, m.addRoute(iface, r))
+	}
+	require.NoError(t, m.endBatch())
+
+	// All routes should share a single source, filtered to the union of the routes.
+	require.Len(t, sf.Sources(), 1)
+	src := sf.Sources()[0]
+	filter := src.Filter()
+	require.Equal(t,
+		"((ip dst 10.0.0.1 and dst port 443) or (ip src 10.0.0.1 and src port 443)) or "+
+			"((ip dst 10.0.0.2 and dst port 80) or (ip src 10.0.0.2 and src port 80))",
+		filter,
+	)
+
+	pkts := [][]byte{
+		testFrame{src: "192.168.0.2:5000", dst: "10.0.0.1:443"}.serialize(t),
+		testFrame{src: "10.0.0.2:80", dst: "192.168.0.2:5001"}.serialize(t),
+		testFrame{src: "10.0.0.2:443", dst: "192.168.0.2:5002"}.serialize(t),
+	}
+	injectFrames(sf.FakeCapture, pkts...)
+	waitForHookContents(t, hooks, [][][]byte{{pkts[0]}, {pkts[1]}, {pkts[0]}})
+
+	m.removeRoute(routes[1])
+	filter, closed := src.Filter(), src.Closed()
+	require.False(t, closed)
+	require.Equal(t, "((ip dst 10.0.0.1 and dst port 443) or (ip src 10.0.0.1 and src port 443))", filter)
+
+	// Capture should stop on the interface once the last route is removed.
+	m.removeRoute(routes[0])
+	m.removeRoute(routes[2])
+	closed = src.Closed()
+	require.True(t, closed)
+	require.Empty(t, m.captures)
+
+	select {
+	case err := <-errorChan:
+		t.Fatal(err)
+	default:
+	}
+}
+
+func TestCaptureManagerFilterExpressions(t *testing.T) {
+	t.Parallel()
+
+	var (
+		sf           = newFakeSourceFactory()
+		buf          = newSharedRingBuffer(1024 * 1024)
+		hooks        = []*sharedBufferHook{buf.newHook(), buf.newHook()}
+		statsTracker = newStatsTracker(time.Hour)
+		iface        = networkInterface{pcapInterface: pcap.Interface{Name: "test0"}}
+	)
+	defer statsTracker.close()
+	m := newCaptureManager(
+		bpool.NewBufferPool(dataPoolSize), Options{PacketSourceFactory: sf, StatsInterval: time.Hour},
+		statsTracker, make(chan error, channelBufferSize))
+	defer m.close()
+
+	// The second route only wants packets sent by the server. The capture is shared, so the filter
+	// for the first route admits packets in both directions; the second route's expression must be
+	// evaluated when demultiplexing.
+	require.NoError(t, m.addRoute(iface, testRoute(t, "10.0.0.1:443", hooks[0])))
+	require.NoError(t, m.addRoute(iface, testRoute(t, "10.0.0.1:443 and src host 10.0.0.1", hooks[1])))
+
+	pkts := [][]byte{
+		testFrame{src: "192.168.0.2:5000", dst: "10.0.0.1:443"}.serialize(t),
+		testFrame{src: "10.0.0.1:443", dst: "192.168.0.2:5000"}.serialize(t),
+	}
+	injectFrames(sf.FakeCapture, pkts...)
+	waitForHookContents(t, hooks, [][][]byte{pkts, pkts[1:]})
+}
+
+func TestCaptureManagerInterfaceWide(t *testing.T) {
+	t.Parallel()
+
+	var (
+		sf           = newFakeSourceFactory()
+		buf          = newSharedRingBuffer(1024 * 1024)
+		hooks        = []*sharedBufferHook{buf.newHook(), buf.newHook(), buf.newHook()}
+		statsTracker = newStatsTracker(time.Hour)
+		iface        = networkInterface{pcapInterface: pcap.Interface{Name: "test0"}}
+	)
+	defer statsTracker.close()
+	m := newCaptureManager(
+		bpool.NewBufferPool(dataPoolSize), Options{PacketSourceFactory: sf, StatsInterval: time.Hour},
+		statsTracker, make(chan error, channelBufferSize))
+	defer m.close()
+
+	var (
+		https = testFrame{src: "192.168.0.2:5000", dst: "10.0.0.1:443"}.serialize(t)
+		dns   = testFrame{src: "192.168.0.2:5001", dst: "192.168.0.3:53"}.serialize(t)
+		arp   = append(append(append([]byte{}, https[:12]...), 0x08, 0x06), make([]byte, 28)...)
+	)
+	filtered := &captureRoute{hook: hooks[1], filter: "port 53"}
+	require.NoError(t, m.addRoute(iface, testRoute(t, "10.0.0.1:443", hooks[0])))
+	require.NoError(t, m.addRoute(iface, filtered))
+	filter := sf.Sources()[0].Filter()
+	require.Equal(t, "((ip dst 10.0.0.1 and dst port 443) or (ip src 10.0.0.1 and src port 443)) or (port 53)", filter)
+
+	injectFrames(sf.FakeCapture, https, dns, arp)
+	waitForHookContents(t, hooks, [][][]byte{{https}, {dns}, {}})
+
+	// An unfiltered interface-wide route removes the capture filter, admitting non-IP packets too.
+	unfiltered := &captureRoute{hook: hooks[2]}
+	require.NoError(t, m.addRoute(iface, unfiltered))
+	filter = sf.Sources()[0].Filter()
+	require.Equal(t, "", filter)
+
+	injectFrames(sf.FakeCapture, https, dns, arp)
+	waitForHookContents(t, hooks, [][][]byte{{https, https}, {dns, dns}, {https, dns, arp}})
+
+	m.removeRoute(unfiltered)
+	m.removeRoute(filtered)
+	filter, closed := sf.Sources()[0].Filter(), sf.Sources()[0].Closed()
+	require.False(t, closed)
+	require.Equal(t, "((ip dst 10.0.0.1 and dst port 443) or (ip src 10.0.0.1 and src port 443))", filter)
+}
+
+func TestCaptureManagerSettings(t *testing.T) {
+	t.Parallel()
+
+	var (
+		sf           = newFakeSourceFactory()
+		buf          = newSharedRingBuffer(1024 * 1024)
+		hooks        = []*sharedBufferHook{buf.newHook(), buf.newHook(), buf.newHook()}
+		statsTracker = newStatsTracker(time.Hour)
+		iface        = networkInterface{
+			pcapInterface: pcap.Interface{Name: "test0"},
+			netInterface:  net.Interface{Name: "test0", MTU: 1500},
+		}
+	)
+	defer statsTracker.close()
+	m := newCaptureManager(
+		bpool.NewBufferPool(dataPoolSize), Options{PacketSourceFactory: sf, StatsInterval: time.Hour},
+		statsTracker, make(chan error, channelBufferSize))
+	defer m.close()
+
+	withSettings := func(r *captureRoute, s CaptureSettings) *captureRoute {
+		r.settings = s
+		return r
+	}
+
+	// The snap length defaults to the MTU.
+	first := withSettings(testRoute(t, "10.0.0.1:443", hooks[0]), CaptureSettings{ImmediateMode: true})
+	require.NoError(t, m.addRoute(iface, first))
+	require.Len(t, sf.openedConfigs(), 1)
+	require.Equal(t, 1500, sf.openedConfigs()[0].SnapLen)
+	require.True(t, sf.openedConfigs()[0].ImmediateMode)
+
+	// These settings are satisfied by the running capture.
+	second := withSettings(testRoute(t, "10.0.0.2:443", hooks[1]), CaptureSettings{SnapLen: 100})
+	require.NoError(t, m.addRoute(iface, second))
+	require.Len(t, sf.openedConfigs(), 1)
+
+	// These are not, so the capture is restarted with merged settings.
+	third := withSettings(testRoute(t, "10.0.0.3:443", hooks[2]), CaptureSettings{
+		SnapLen: 65535, Promiscuous: true, BufferSize: 1 << 20, NanosecondTimestamps: true,
+	})
+	require.NoError(t, m.addRoute(iface, third))
+	require.Len(t, sf.openedConfigs(), 2)
+	require.Equal(t, SourceConfig{
+		Interface:            "test0",
+		SnapLen:              65535,
+		ReadTimeout:          packetReadTimeout,
+		Promiscuous:          true,
+		ImmediateMode:        true,
+		BufferSize:           1 << 20,
+		NanosecondTimestamps: true,
+	}, sf.openedConfigs()[1])
+	closed := sf.Sources()[0].Closed()
+	require.True(t, closed)
+
+	// The new capture carries all routes.
+	filter := sf.Sources()[1].Filter()
+	for _, r := range []*captureRoute{first, second, third} {
+		require.Contains(t, filter, r.bpf())
+	}
+	pkt := testFrame{src: "192.168.0.2:5000", dst: "10.0.0.1:443"}.serialize(t)
+	injectFrames(sf.FakeCapture, pkt)
+	waitForHookContents(t, hooks[:1], [][][]byte{{pkt}})
+
+	// Settings are not relaxed as routes are removed.
+	m.removeRoute(third)
+	require.Len(t, sf.openedConfigs(), 2)
+	closed = sf.Sources()[1].Closed()
+	require.False(t, closed)
+}
+
+// microsecondSourceFactory opens fake sources which report microsecond timestamp resolution.
+type microsecondSourceFactory struct {
+	*fakeSourceFactory
+}
+
+func (f microsecondSourceFactory) SourceFor(cfg SourceConfig) (PacketSource, error) {
+	src, err := f.fakeSourceFactory.SourceFor(cfg)
+	return microsecondSource{src}, err
+}
+
+type microsecondSource struct {
+	PacketSource
+}
+
+func (microsecondSource) Resolution() gopacket.TimestampResolution {
+	return gopacket.TimestampResolutionMicrosecond
+}
+
+func TestCaptureManagerTimestampResolution(t *testing.T) {
+	t.Parallel()
+
+	statsTracker := newStatsTracker(time.Hour)
+	defer statsTracker.close()
+	nano := CaptureSettings{NanosecondTimestamps: true}
+
+	for name, tc := range map[string]struct {
+		sf       PacketSourceFactory
+		expected bool
+	}{
+		"unreported":  {newFakeSourceFactory(), true},
+		"microsecond": {microsecondSourceFactory{newFakeSourceFactory()}, false},
+	} {
+		m := newCaptureManager(
+			bpool.NewBufferPool(dataPoolSize), Options{PacketSourceFactory: tc.sf, StatsInterval: time.Hour},
+			statsTracker, make(chan error, channelBufferSize))
+		iface := networkInterface{pcapInterface: pcap.Interface{Name: "test0"}}
+		r := testRoute(t, "10.0.0.1:443", newSharedRingBuffer(1024).newHook())
+		r.settings = nano
+		require.NoError(t, m.addRoute(iface, r))
+		require.Equal(t, tc.expected, m.captures["test0"].iface.nanoTimestamps, name)
+		m.close()
+	}
+}
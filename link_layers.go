@@ -0,0 +1,135 @@
+package trafficlog
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// The gopacket package does not provide layers for raw IP (with the IP version determined by each
+// packet) or for Linux cooked capture v2, so we provide our own. Layer type numbers for these are
+// chosen to stay well clear of those used by the layers package.
+var (
+	layerTypeRawIP = gopacket.RegisterLayerType(12101, gopacket.LayerTypeMetadata{
+		Name: "RawIP", Decoder: gopacket.DecodeFunc(decodeRawIP),
+	})
+	layerTypeLinuxSLL2 = gopacket.RegisterLayerType(12102, gopacket.LayerTypeMetadata{
+		Name: "LinuxSLL2", Decoder: gopacket.DecodeFunc(decodeLinuxSLL2),
+	})
+)
+
+// Header lengths for Linux cooked captures.
+const (
+	sllHeaderLen  = 16
+	sll2HeaderLen = 20
+)
+
+// rawIP is a zero-length link layer preceding an IPv4 or IPv6 packet. This allows raw IP packets
+// to be decoded like any other link layer packet.
+type rawIP struct {
+	layers.BaseLayer
+	version uint8
+}
+
+func (r *rawIP) LayerType() gopacket.LayerType { return layerTypeRawIP }
+
+func (r *rawIP) CanDecode() gopacket.LayerClass { return layerTypeRawIP }
+
+func (r *rawIP) NextLayerType() gopacket.LayerType {
+	switch r.version {
+	case 4:
+		return layers.LayerTypeIPv4
+	case 6:
+		return layers.LayerTypeIPv6
+	default:
+		return gopacket.LayerTypeZero
+	}
+}
+
+func (r *rawIP) DecodeFromBytes(data []byte, _ gopacket.DecodeFeedback) error {
+	if len(data) == 0 {
+		return errors.New("empty raw IP packet")
+	}
+	r.version = data[0] >> 4
+	if r.version != 4 && r.version != 6 {
+		return fmt.Errorf("invalid IP version %d", r.version)
+	}
+	r.BaseLayer = layers.BaseLayer{Contents: data[:0], Payload: data}
+	return nil
+}
+
+func decodeRawIP(data []byte, p gopacket.PacketBuilder) error {
+	r := new(rawIP)
+	if err := r.DecodeFromBytes(data, p); err != nil {
+		return err
+	}
+	p.AddLayer(r)
+	return p.NextDecoder(r.NextLayerType())
+}
+
+// linuxSLL2 is the header used in Linux cooked captures, version 2. See
+// https://www.tcpdump.org/linktypes/LINKTYPE_LINUX_SLL2.html
+type linuxSLL2 struct {
+	layers.BaseLayer
+	ProtocolType   layers.EthernetType
+	InterfaceIndex uint32
+	AddrType       uint16
+	PacketType     layers.LinuxSLLPacketType
+	AddrLen        uint8
+	Addr           net.HardwareAddr
+}
+
+func (sll *linuxSLL2) LayerType() gopacket.LayerType { return layerTypeLinuxSLL2 }
+
+func (sll *linuxSLL2) CanDecode() gopacket.LayerClass { return layerTypeLinuxSLL2 }
+
+func (sll *linuxSLL2) NextLayerType() gopacket.LayerType {
+	return sll.ProtocolType.LayerType()
+}
+
+func (sll *linuxSLL2) DecodeFromBytes(data []byte, _ gopacket.DecodeFeedback) error {
+	if len(data) < sll2HeaderLen {
+		return errors.New("Linux SLL2 packet too small")
+	}
+	sll.ProtocolType = layers.EthernetType(binary.BigEndian.Uint16(data[0:2]))
+	sll.InterfaceIndex = binary.BigEndian.Uint32(data[4:8])
+	sll.AddrType = binary.BigEndian.Uint16(data[8:10])
+	sll.PacketType = layers.LinuxSLLPacketType(data[10])
+	sll.AddrLen = data[11]
+	addrLen := int(sll.AddrLen)
+	if addrLen > 8 {
+		addrLen = 8
+	}
+	sll.Addr = net.HardwareAddr(data[12 : 12+addrLen])
+	sll.BaseLayer = layers.BaseLayer{Contents: data[:sll2HeaderLen], Payload: data[sll2HeaderLen:]}
+	return nil
+}
+
+func decodeLinuxSLL2(data []byte, p gopacket.PacketBuilder) error {
+	sll := new(linuxSLL2)
+	if err := sll.DecodeFromBytes(data, p); err != nil {
+		return err
+	}
+	p.AddLayer(sll)
+	return p.NextDecoder(sll.ProtocolType)
+}
+
+// sll2ToSLL converts a Linux cooked capture v2 packet to a v1 packet. The v2 header carries the
+// same information as the v1 header, plus an interface index which is dropped in conversion.
+func sll2ToSLL(data []byte) ([]byte, error) {
+	if len(data) < sll2HeaderLen {
+		return nil, errors.New("Linux SLL2 packet too small")
+	}
+	converted := make([]byte, len(data)-sll2HeaderLen+sllHeaderLen)
+	binary.BigEndian.PutUint16(converted[0:2], uint16(data[10])) // packet type
+	copy(converted[2:4], data[8:10])                             // address type
+	binary.BigEndian.PutUint16(converted[4:6], uint16(data[11])) // address length
+	copy(converted[6:14], data[12:20])                           // address
+	copy(converted[14:16], data[0:2])                            // protocol type
+	copy(converted[sllHeaderLen:], data[sll2HeaderLen:])
+	return converted, nil
+}
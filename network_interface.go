@@ -1,9 +1,9 @@
 package trafficlog
 
 import (
+	"errors"
 	"fmt"
 	"net"
-	"runtime"
 	"strings"
 
 	"github.com/google/gopacket/pcap"
@@ -15,17 +15,18 @@ import (
 type networkInterface struct {
 	pcapInterface pcap.Interface
 	netInterface  net.Interface
-	linkType      LinkType
+	// The link type is only known once a capture source has been opened on the interface. Until
+	// then, this field should not be relied upon.
+	linkType LinkType
+
+	// Like the link type, these are set once a capture source has been opened. They describe the
+	// settings with which the source was opened.
+	snapLen        int
+	nanoTimestamps bool
 }
 
 // Returns the network interface used to connect to the host.
 func networkInterfaceFor(remoteIP net.IP) (*networkInterface, error) {
-	linkType := LinkTypeEthernet
-	if remoteIP.IsLoopback() && runtime.GOOS != "linux" {
-		// This is done to support testing.
-		linkType = LinkTypeLoopback
-	}
-
 	localIP, err := preferredOutboundIP(remoteIP)
 	if err != nil {
 		return nil, fmt.Errorf("failed to obtain outbound IP: %w", err)
@@ -72,13 +73,102 @@ func networkInterfaceFor(remoteIP net.IP) (*networkInterface, error) {
 				return nil, fmt.Errorf("failed to parse interface address %s as IP network: %w", addr.String(), err)
 			}
 			if ipNet.Contains(localIP) {
-				return &networkInterface{*pcapIface, iface, linkType}, nil
+				return &networkInterface{pcapInterface: *pcapIface, netInterface: iface}, nil
 			}
 		}
 	}
 	return nil, fmt.Errorf("should connect through %v, but could not find network interface", localIP)
 }
 
+// Returns the network interface with the input name, which may be the name reported by either the
+// pcap package or the net package. The interface must be up.
+func networkInterfaceNamed(name string) (*networkInterface, error) {
+	ifaces, err := allNetworkInterfaces()
+	if err != nil {
+		return nil, err
+	}
+	for _, iface := range ifaces {
+		if iface.pcapName() == name || iface.name() == name {
+			return &iface, nil
+		}
+	}
+	return nil, fmt.Errorf("no network interface named %s is up", name)
+}
+
+// Returns the network interfaces named by an entry passed to TrafficLog.UpdateInterfaces: either
+// the single interface with the input name or, for AllInterfaces, all interfaces which are up.
+func networkInterfacesFor(name string) ([]networkInterface, error) {
+	if name != AllInterfaces {
+		iface, err := networkInterfaceNamed(name)
+		if err != nil {
+			return nil, err
+		}
+		return []networkInterface{*iface}, nil
+	}
+	ifaces, err := allNetworkInterfaces()
+	if err != nil {
+		return nil, err
+	}
+	if len(ifaces) == 0 {
+		return nil, errors.New("no network interfaces are up")
+	}
+	return ifaces, nil
+}
+
+// Returns all network interfaces which are up. Pseudo-interfaces reported by the pcap package, like
+// the "any" interface on Linux, are not included.
+func allNetworkInterfaces() ([]networkInterface, error) {
+	pcapIfaces, err := pcap.FindAllDevs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to obtain system interfaces: %w", err)
+	}
+	netIfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("failed to obtain system interfaces: %w", err)
+	}
+
+	// The pcap and net packages may report different names for an interface. Failing a match by
+	// name, we match on the interface addresses.
+	netIfaceFor := func(pcapIface pcap.Interface) (*net.Interface, error) {
+		for _, iface := range netIfaces {
+			if iface.Name == pcapIface.Name {
+				return &iface, nil
+			}
+		}
+		for _, iface := range netIfaces {
+			addrs, err := iface.Addrs()
+			if err != nil {
+				return nil, fmt.Errorf("failed to obtain addresses for %s: %w", iface.Name, err)
+			}
+			for _, addr := range addrs {
+				ipNet, ok := addr.(*net.IPNet)
+				if !ok {
+					continue
+				}
+				for _, pcapAddr := range pcapIface.Addresses {
+					if ipNet.IP.Equal(pcapAddr.IP) {
+						return &iface, nil
+					}
+				}
+			}
+		}
+		return nil, nil
+	}
+
+	ifaces := []networkInterface{}
+	for _, pcapIface := range pcapIfaces {
+		netIface, err := netIfaceFor(pcapIface)
+		if err != nil {
+			return nil, err
+		}
+		if netIface == nil || netIface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		ifaces = append(ifaces, networkInterface{pcapInterface: pcapIface, netInterface: *netIface})
+	}
+	return ifaces, nil
+}
+
 // The pcap and net packages sometimes report different names for the interfaces. Functions in the
 // pcap package require the name reported by the pcap package.
 func (ni networkInterface) pcapName() string {
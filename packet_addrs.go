@@ -0,0 +1,196 @@
+package trafficlog
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// Protocol numbers, EtherTypes and header lengths used in decoding packet addresses.
+const (
+	ipProtoICMP         = 1
+	ipProtoTCP          = 6
+	ipProtoUDP          = 17
+	ipProtoIPv6Fragment = 44
+	ipProtoICMPv6       = 58
+
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86DD
+
+	ethernetHeaderLen     = 14
+	loopbackHeaderLen     = 4
+	ipv4MinHeaderLen      = 20
+	ipv6HeaderLen         = 40
+	ipv6FragmentHeaderLen = 8
+	icmpHeaderLen         = 8
+)
+
+// ipAddrs holds the IP addresses, protocol and transport-layer ports of an IP packet. The IPs
+// reference the packet data and are only valid as long as the data is.
+type ipAddrs struct {
+	srcIP, dstIP     net.IP
+	srcPort, dstPort uint16
+
+	// proto is the IP protocol number of the packet's payload. For IPv6 fragments, this is the
+	// protocol of the fragmented packet.
+	proto uint8
+
+	// hasPorts is set if the packet carries a TCP or UDP header.
+	hasPorts bool
+}
+
+// packetAddrs holds the addresses of a captured packet.
+type packetAddrs struct {
+	ipAddrs
+
+	// fragment is set if the packet is an IP fragment. Only the initial fragment carries ports.
+	fragment bool
+
+	// icmpError is set if the packet is an ICMP or ICMPv6 error message. These messages embed the
+	// start of the packet which caused the error; the addresses of this packet are held in embedded.
+	icmpError bool
+	embedded  ipAddrs
+}
+
+// decodeAddrs decodes the addresses of a packet with the given link type. This is called for every
+// captured packet, so we decode by hand rather than using the gopacket package, which would
+// allocate. Returns false if the packet is not an IP packet or is too short to decode.
+func decodeAddrs(lt LinkType, data []byte) (packetAddrs, bool) {
+	isIP := func(etherType uint16) bool {
+		return etherType == etherTypeIPv4 || etherType == etherTypeIPv6
+	}
+
+	var ip []byte
+	switch lt {
+	case LinkTypeEthernet:
+		if len(data) < ethernetHeaderLen || !isIP(binary.BigEndian.Uint16(data[12:14])) {
+			return packetAddrs{}, false
+		}
+		ip = data[ethernetHeaderLen:]
+	case LinkTypeLoopback:
+		// The header holds an address family, the value of which varies by platform. We rely on
+		// the IP version instead.
+		if len(data) < loopbackHeaderLen {
+			return packetAddrs{}, false
+		}
+		ip = data[loopbackHeaderLen:]
+	case LinkTypeRaw, LinkTypeIPv4, LinkTypeIPv6:
+		ip = data
+	case LinkTypeLinuxSLL:
+		if len(data) < sllHeaderLen || !isIP(binary.BigEndian.Uint16(data[14:16])) {
+			return packetAddrs{}, false
+		}
+		ip = data[sllHeaderLen:]
+	case LinkTypeLinuxSLL2:
+		if len(data) < sll2HeaderLen || !isIP(binary.BigEndian.Uint16(data[0:2])) {
+			return packetAddrs{}, false
+		}
+		ip = data[sll2HeaderLen:]
+	default:
+		return packetAddrs{}, false
+	}
+	return decodeIPAddrs(ip)
+}
+
+func decodeIPAddrs(data []byte) (packetAddrs, bool) {
+	var addrs packetAddrs
+	transport, fragment, ok := decodeIPHeader(data, &addrs.ipAddrs)
+	if !ok {
+		return addrs, false
+	}
+	addrs.fragment = fragment
+	if isICMPError(addrs.proto, transport) {
+		_, _, addrs.icmpError = decodeIPHeader(transport[icmpHeaderLen:], &addrs.embedded)
+	}
+	return addrs, true
+}
+
+// decodeIPHeader decodes the addresses of an IP packet into addrs. The transport-layer data is
+// returned, unless this is a non-initial fragment.
+func decodeIPHeader(data []byte, addrs *ipAddrs) (transport []byte, fragment, ok bool) {
+	if len(data) == 0 {
+		return nil, false, false
+	}
+	switch data[0] >> 4 {
+	case 4:
+		if len(data) < ipv4MinHeaderLen {
+			return nil, false, false
+		}
+		headerLen := int(data[0]&0x0f) * 4
+		if headerLen < ipv4MinHeaderLen || len(data) < headerLen {
+			return nil, false, false
+		}
+		addrs.srcIP, addrs.dstIP = net.IP(data[12:16]), net.IP(data[16:20])
+		addrs.proto = data[9]
+		// The more-fragments flag and the fragment offset.
+		fragmentInfo := binary.BigEndian.Uint16(data[6:8]) & 0x3fff
+		fragment = fragmentInfo != 0
+		if fragmentInfo&0x1fff == 0 {
+			transport = data[headerLen:]
+		}
+	case 6:
+		// Like the port primitives in the pcap-filter language, we only look for transport headers
+		// immediately following the fixed IPv6 header. The exception is the fragment header, which
+		// we must understand to identify fragments.
+		if len(data) < ipv6HeaderLen {
+			return nil, false, false
+		}
+		addrs.srcIP, addrs.dstIP = net.IP(data[8:24]), net.IP(data[24:40])
+		addrs.proto, transport = data[6], data[ipv6HeaderLen:]
+		if addrs.proto == ipProtoIPv6Fragment && len(transport) >= ipv6FragmentHeaderLen {
+			fragment = true
+			addrs.proto = transport[0]
+			if binary.BigEndian.Uint16(transport[2:4])&0xfff8 == 0 {
+				transport = transport[ipv6FragmentHeaderLen:]
+			} else {
+				transport = nil
+			}
+		}
+	default:
+		return nil, false, false
+	}
+	if (addrs.proto == ipProtoTCP || addrs.proto == ipProtoUDP) && len(transport) >= 4 {
+		addrs.srcPort = binary.BigEndian.Uint16(transport[0:2])
+		addrs.dstPort = binary.BigEndian.Uint16(transport[2:4])
+		addrs.hasPorts = true
+	}
+	return transport, fragment, true
+}
+
+// isICMPError reports whether the transport-layer data is an ICMP or ICMPv6 error message.
+func isICMPError(proto uint8, transport []byte) bool {
+	if len(transport) < icmpHeaderLen {
+		return false
+	}
+	switch proto {
+	case ipProtoICMP:
+		for _, errType := range icmpErrorTypes {
+			if transport[0] == errType {
+				return true
+			}
+		}
+	case ipProtoICMPv6:
+		// ICMPv6 error messages have types 0-127. Only types 1-4 are defined.
+		return transport[0] >= 1 && transport[0] <= 4
+	}
+	return false
+}
+
+// ICMP error message types: destination unreachable, source quench, redirect, time exceeded and
+// parameter problem.
+var icmpErrorTypes = []uint8{3, 4, 5, 11, 12}
+
+// ipKey is a comparable form of an IP address, suitable for use as a map key.
+type ipKey [net.IPv6len]byte
+
+// keyFor returns the key for an IP. IPv4 addresses are mapped into the IPv6 space, as in net.IP.
+// Unlike net.IP.To16, this does not allocate.
+func keyFor(ip net.IP) ipKey {
+	var k ipKey
+	if len(ip) == net.IPv4len {
+		k[10], k[11] = 0xff, 0xff
+		copy(k[12:], ip)
+	} else {
+		copy(k[:], ip)
+	}
+	return k
+}
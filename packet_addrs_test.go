@@ -0,0 +1,81 @@
+package trafficlog
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeAddrs(t *testing.T) {
+	t.Parallel()
+
+	frame := testFrame{src: "10.0.0.1:1234", dst: "10.0.0.2:443"}.serialize(t)
+	ipPacket := frame[ethernetHeaderLen:]
+
+	sll2 := make([]byte, sll2HeaderLen, sll2HeaderLen+len(ipPacket))
+	sll2[0], sll2[1] = 0x08, 0x00
+	sll2 = append(sll2, ipPacket...)
+
+	fragment := append([]byte{}, ipPacket...)
+	fragment[6], fragment[7] = 0x00, 0x10 // non-zero fragment offset
+
+	// An ICMP error from a router, embedding a packet sent to 10.0.0.2.
+	icmpError := testICMPError("10.0.0.1", "10.0.0.2", testFrame{src: "10.0.0.1:1234", dst: "10.0.0.2:443"}.serialize(t))
+
+	for _, tc := range []struct {
+		name      string
+		lt        LinkType
+		data      []byte
+		ok        bool
+		hasPorts  bool
+		fragment  bool
+		icmpError bool
+	}{
+		{"ethernet", LinkTypeEthernet, frame, true, true, false, false},
+		{"raw", LinkTypeRaw, ipPacket, true, true, false, false},
+		{"loopback", LinkTypeLoopback, append([]byte{2, 0, 0, 0}, ipPacket...), true, true, false, false},
+		{"SLL2", LinkTypeLinuxSLL2, sll2, true, true, false, false},
+		{"fragment", LinkTypeRaw, fragment, true, false, true, false},
+		{"ICMP error", LinkTypeRaw, icmpError, true, false, false, true},
+		{"truncated ICMP error", LinkTypeRaw, icmpError[:ipv4MinHeaderLen+icmpHeaderLen+10], true, false, false, false},
+		{"truncated", LinkTypeRaw, ipPacket[:10], false, false, false, false},
+		{"non-IP", LinkTypeEthernet, append(append([]byte{}, frame[:12]...), 0x08, 0x06), false, false, false, false},
+	} {
+		addrs, ok := decodeAddrs(tc.lt, tc.data)
+		require.Equal(t, tc.ok, ok, tc.name)
+		if !ok {
+			continue
+		}
+		require.True(t, net.ParseIP("10.0.0.1").Equal(addrs.srcIP), tc.name)
+		require.True(t, net.ParseIP("10.0.0.2").Equal(addrs.dstIP), tc.name)
+		require.Equal(t, tc.hasPorts, addrs.hasPorts, tc.name)
+		require.Equal(t, tc.fragment, addrs.fragment, tc.name)
+		require.Equal(t, tc.icmpError, addrs.icmpError, tc.name)
+		if tc.hasPorts {
+			require.Equal(t, uint16(1234), addrs.srcPort, tc.name)
+			require.Equal(t, uint16(443), addrs.dstPort, tc.name)
+		}
+		if tc.icmpError {
+			require.True(t, net.ParseIP("10.0.0.1").Equal(addrs.embedded.srcIP), tc.name)
+			require.True(t, net.ParseIP("10.0.0.2").Equal(addrs.embedded.dstIP), tc.name)
+			require.Equal(t, uint16(1234), addrs.embedded.srcPort, tc.name)
+			require.Equal(t, uint16(443), addrs.embedded.dstPort, tc.name)
+		}
+	}
+}
+
+// testICMPError returns an IPv4 packet carrying an ICMP destination unreachable message. The
+// message embeds the IP header and first 8 bytes of the payload of the input Ethernet frame.
+func testICMPError(src, dst string, frame []byte) []byte {
+	embedded := frame[ethernetHeaderLen:]
+	embedded = embedded[:int(embedded[0]&0x0f)*4+8]
+	pkt := []byte{0x45, 0, 0, 0, 0, 0, 0, 0, 64, ipProtoICMP, 0, 0}
+	pkt = append(pkt, net.ParseIP(src).To4()...)
+	pkt = append(pkt, net.ParseIP(dst).To4()...)
+	pkt = append(pkt, 3, 1, 0, 0, 0, 0, 0, 0)
+	pkt = append(pkt, embedded...)
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+	return pkt
+}
@@ -3,6 +3,7 @@ package trafficlog
 import (
 	"fmt"
 	"io"
+	"runtime"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
@@ -15,16 +16,80 @@ type LinkType int
 const (
 	LinkTypeEthernet LinkType = iota
 	LinkTypeLoopback LinkType = iota
+
+	// LinkTypeRaw denotes raw IP packets with no link layer header, as captured on tun devices like
+	// those used by WireGuard and OpenVPN. Packets may be IPv4 or IPv6.
+	LinkTypeRaw LinkType = iota
+
+	// LinkTypeIPv4 and LinkTypeIPv6 denote raw IP packets of a single IP version.
+	LinkTypeIPv4 LinkType = iota
+	LinkTypeIPv6 LinkType = iota
+
+	// LinkTypeLinuxSLL and LinkTypeLinuxSLL2 denote Linux "cooked" captures, as seen when capturing
+	// on the Linux "any" device.
+	LinkTypeLinuxSLL  LinkType = iota
+	LinkTypeLinuxSLL2 LinkType = iota
 )
 
-func linkTypeFrom(lt layers.LinkType) LinkType {
+// Data link type values which are not defined by the layers package or which vary by platform.
+const (
+	// DLT_RAW is 12 on most platforms, but 14 on OpenBSD. LINKTYPE_RAW (layers.LinkTypeRaw) is
+	// used in files and by some capture backends.
+	dltRaw        = layers.LinkType(12)
+	dltRawOpenBSD = layers.LinkType(14)
+
+	// DLT_LOOP is 12 on OpenBSD. Elsewhere, it is layers.LinkTypeLoop.
+	dltLoopOpenBSD = layers.LinkType(12)
+
+	// LINKTYPE_LINUX_SLL2 is 276, but gopacket represents link types as 8-bit values. Wherever
+	// gopacket reports a link type (e.g. pcap handles and pcapgo readers), SLL2 shows up truncated.
+	// The truncated value collides with DLT 20, so a source genuinely reporting link type 20 would
+	// be mistaken for SLL2. Where the untruncated value is available, linkTypeFromDLT should be used
+	// instead of linkTypeFrom.
+	dltLinuxSLL2      = layers.LinkType(linktypeLinuxSLL2 & 0xff)
+	linktypeLinuxSLL2 = 276
+)
+
+// linkTypeFromDLT is like linkTypeFrom, but for a data link type which has not been truncated to 8
+// bits. Link type 20 is therefore not treated as LINKTYPE_LINUX_SLL2.
+func linkTypeFromDLT(dlt int) (LinkType, error) {
+	switch {
+	case dlt == linktypeLinuxSLL2:
+		return LinkTypeLinuxSLL2, nil
+	case dlt == int(dltLinuxSLL2) || dlt < 0 || dlt > 0xff:
+		return 0, fmt.Errorf("unsupported link type %d", dlt)
+	}
+	return linkTypeFrom(layers.LinkType(dlt))
+}
+
+// linkTypeFrom maps a link type reported by the gopacket package. As these may be truncated, link
+// type 20 is taken to be LINKTYPE_LINUX_SLL2 (see dltLinuxSLL2).
+func linkTypeFrom(lt layers.LinkType) (LinkType, error) {
+	if runtime.GOOS == "openbsd" {
+		switch lt {
+		case dltLoopOpenBSD:
+			return LinkTypeLoopback, nil
+		case dltRawOpenBSD:
+			return LinkTypeRaw, nil
+		}
+	}
 	switch lt {
 	case layers.LinkTypeEthernet:
-		return LinkTypeEthernet
+		return LinkTypeEthernet, nil
 	case layers.LinkTypeLoop, layers.LinkTypeNull:
-		return LinkTypeLoopback
+		return LinkTypeLoopback, nil
+	case layers.LinkTypeRaw, dltRaw:
+		return LinkTypeRaw, nil
+	case layers.LinkTypeIPv4:
+		return LinkTypeIPv4, nil
+	case layers.LinkTypeIPv6:
+		return LinkTypeIPv6, nil
+	case layers.LinkTypeLinuxSLL:
+		return LinkTypeLinuxSLL, nil
+	case dltLinuxSLL2:
+		return LinkTypeLinuxSLL2, nil
 	default:
-		panic(fmt.Sprint("unsupported link type ", lt))
+		return 0, fmt.Errorf("unsupported link type %v", lt)
 	}
 }
 
@@ -34,17 +99,34 @@ func (lt LinkType) gopacketLayerType() gopacket.LayerType {
 		return layers.LayerTypeEthernet
 	case LinkTypeLoopback:
 		return layers.LayerTypeLoopback
+	case LinkTypeRaw, LinkTypeIPv4, LinkTypeIPv6:
+		return layerTypeRawIP
+	case LinkTypeLinuxSLL:
+		return layers.LayerTypeLinuxSLL
+	case LinkTypeLinuxSLL2:
+		return layerTypeLinuxSLL2
 	default:
 		panic("unknown link type")
 	}
 }
 
+// The link type used when writing packets of this type to a file. Note that this cannot express
+// LINKTYPE_LINUX_SLL2 (see dltLinuxSLL2), so SLL2 packets must be converted using sll2ToSLL before
+// they are written.
 func (lt LinkType) gopacketLinkType() layers.LinkType {
 	switch lt {
 	case LinkTypeEthernet:
 		return layers.LinkTypeEthernet
 	case LinkTypeLoopback:
 		return layers.LinkTypeNull
+	case LinkTypeRaw:
+		return layers.LinkTypeRaw
+	case LinkTypeIPv4:
+		return layers.LinkTypeIPv4
+	case LinkTypeIPv6:
+		return layers.LinkTypeIPv6
+	case LinkTypeLinuxSLL, LinkTypeLinuxSLL2:
+		return layers.LinkTypeLinuxSLL
 	default:
 		panic("unknown link type")
 	}
@@ -80,6 +162,9 @@ func (f AppStripperFactory) MutatorFor(linkType LinkType) PacketMutator {
 	var (
 		eth     layers.Ethernet
 		lb      layers.Loopback
+		raw     rawIP
+		sll     layers.LinuxSLL
+		sll2    linuxSLL2
 		ip4     layers.IPv4
 		ip6     layers.IPv6
 		tcp     layers.TCP
@@ -88,7 +173,8 @@ func (f AppStripperFactory) MutatorFor(linkType LinkType) PacketMutator {
 
 		decoded = make([]gopacket.LayerType, 4)
 		parser  = gopacket.NewDecodingLayerParser(
-			linkType.gopacketLayerType(), &eth, &lb, &ip4, &ip6, &tcp, &udp, &payload,
+			linkType.gopacketLayerType(),
+			&eth, &lb, &raw, &sll, &sll2, &ip4, &ip6, &tcp, &udp, &payload,
 		)
 	)
 	return func(linkPkt []byte, w io.Writer) error {
@@ -100,6 +186,12 @@ func (f AppStripperFactory) MutatorFor(linkType LinkType) PacketMutator {
 				link = &eth
 			case layers.LayerTypeLoopback:
 				link = &lb
+			case layerTypeRawIP:
+				link = &raw
+			case layers.LayerTypeLinuxSLL:
+				link = &sll
+			case layerTypeLinuxSLL2:
+				link = &sll2
 			case layers.LayerTypeIPv4:
 				network = &ip4
 			case layers.LayerTypeIPv6:
@@ -5,6 +5,7 @@ import (
 	"encoding/gob"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"testing"
 
@@ -44,6 +45,96 @@ func TestAppStripper(t *testing.T) {
 	}
 }
 
+func TestAppStripperLinkTypes(t *testing.T) {
+	t.Parallel()
+
+	const payload = "application data"
+
+	ip := layers.IPv4{
+		Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP,
+		SrcIP: net.IP{10, 0, 0, 1}, DstIP: net.IP{10, 0, 0, 2},
+	}
+	tcp := layers.TCP{SrcPort: 50000, DstPort: 443, PSH: true, ACK: true, Window: 1024}
+	require.NoError(t, tcp.SetNetworkLayerForChecksum(&ip))
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	require.NoError(t, gopacket.SerializeLayers(buf, opts, &ip, &tcp, gopacket.Payload(payload)))
+	ipPkt := buf.Bytes()
+
+	sllHeader := []byte{
+		0, 4, // packet type: outgoing
+		0, 1, // address type: ethernet
+		0, 6, // address length
+		1, 2, 3, 4, 5, 6, 0, 0, // address
+		0x08, 0x00, // protocol: IPv4
+	}
+	sll2Header := []byte{
+		0x08, 0x00, // protocol: IPv4
+		0, 0, // reserved
+		0, 0, 0, 3, // interface index
+		0, 1, // address type: ethernet
+		4,                      // packet type: outgoing
+		6,                      // address length
+		1, 2, 3, 4, 5, 6, 0, 0, // address
+	}
+
+	for _, tc := range []struct {
+		name     string
+		linkType LinkType
+		header   []byte
+	}{
+		{"raw", LinkTypeRaw, nil},
+		{"ipv4", LinkTypeIPv4, nil},
+		{"sll", LinkTypeLinuxSLL, sllHeader},
+		{"sll2", LinkTypeLinuxSLL2, sll2Header},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			pkt := append(append([]byte{}, tc.header...), ipPkt...)
+			stripped := new(bytes.Buffer)
+			require.NoError(t, new(AppStripperFactory).MutatorFor(tc.linkType)(pkt, stripped))
+			require.Equal(t, pkt[:len(pkt)-len(payload)], stripped.Bytes())
+		})
+	}
+
+	converted, err := sll2ToSLL(append(append([]byte{}, sll2Header...), ipPkt...))
+	require.NoError(t, err)
+	require.Equal(t, append(append([]byte{}, sllHeader...), ipPkt...), converted)
+}
+
+func TestLinkTypeFrom(t *testing.T) {
+	t.Parallel()
+
+	for gopacketLT, expected := range map[layers.LinkType]LinkType{
+		layers.LinkTypeEthernet: LinkTypeEthernet,
+		layers.LinkTypeNull:     LinkTypeLoopback,
+		layers.LinkTypeRaw:      LinkTypeRaw,
+		layers.LinkTypeIPv6:     LinkTypeIPv6,
+		layers.LinkTypeLinuxSLL: LinkTypeLinuxSLL,
+		dltLinuxSLL2:            LinkTypeLinuxSLL2,
+	} {
+		lt, err := linkTypeFrom(gopacketLT)
+		require.NoError(t, err)
+		require.Equal(t, expected, lt)
+	}
+	_, err := linkTypeFrom(layers.LinkTypeFDDI)
+	require.Error(t, err)
+
+	// Untruncated link types are not ambiguous.
+	lt, err := linkTypeFromDLT(linktypeLinuxSLL2)
+	require.NoError(t, err)
+	require.Equal(t, LinkTypeLinuxSLL2, lt)
+	lt, err = linkTypeFromDLT(int(layers.LinkTypeEthernet))
+	require.NoError(t, err)
+	require.Equal(t, LinkTypeEthernet, lt)
+	for _, dlt := range []int{int(dltLinuxSLL2), linktypeLinuxSLL2 + 1} {
+		_, err = linkTypeFromDLT(dlt)
+		require.Error(t, err, "link type %d", dlt)
+	}
+}
+
 func BenchmarkAppStripper(b *testing.B) {
 	// This file has 100 packets with a mean packet size close to what we see empirically (~750
 	// bytes). The packets are from an actual capture and reflect variance we see in practice.
@@ -0,0 +1,184 @@
+package trafficlog
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// ErrReadTimeout may be returned by PacketSource.ZeroCopyReadPacketData to indicate that no packet
+// arrived before the source's read timeout expired. This is not treated as a capture error.
+var ErrReadTimeout = errors.New("read timeout expired")
+
+// SourceConfig describes a packet source requested by a traffic log.
+type SourceConfig struct {
+	// Interface is the name of the network interface on which to capture. This is the name
+	// reported by the pcap package, which may differ from that reported by the net package.
+	Interface string
+
+	// SnapLen is the maximum number of bytes to capture from each packet.
+	SnapLen int
+
+	// ReadTimeout is the maximum amount of time a call to ZeroCopyReadPacketData should block.
+	ReadTimeout time.Duration
+
+	// Promiscuous requests that the interface be put into promiscuous mode.
+	Promiscuous bool
+
+	// ImmediateMode requests that packets be delivered as soon as they arrive, rather than being
+	// buffered by the kernel.
+	ImmediateMode bool
+
+	// BufferSize is the size in bytes of the kernel buffer holding packets until they are read. If
+	// zero, the source's default is used.
+	BufferSize int
+
+	// NanosecondTimestamps indicates that timestamps will be kept with nanosecond precision. Sources
+	// should provide this precision if they are able. Sources which cannot should implement
+	// TimestampResolutionSource, so that the precision is recorded accurately.
+	NanosecondTimestamps bool
+}
+
+// PacketSource is a source of link-layer packets.
+type PacketSource interface {
+	// ZeroCopyReadPacketData reads the next packet from the source. The returned data is only valid
+	// until the next call to ZeroCopyReadPacketData.
+	//
+	// Implementations should not block indefinitely. If no packet arrives within the configured
+	// read timeout, ErrReadTimeout should be returned. Once the source is closed or exhausted,
+	// io.EOF should be returned.
+	ZeroCopyReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error)
+
+	// LinkType is the link type of the packets read from this source.
+	LinkType() layers.LinkType
+
+	// SetBPFFilter restricts the packets read from this source to those matching the input
+	// expression. The expression uses the syntax described in the pcap-filter man page.
+	SetBPFFilter(expr string) error
+
+	// Stats returns cumulative statistics for this source. Only the Dropped field is used by the
+	// traffic log; this should reflect packets dropped before they could be read.
+	Stats() (CaptureStats, error)
+
+	// Close the source and release its resources. Close may be called concurrently with
+	// ZeroCopyReadPacketData. Data returned by ZeroCopyReadPacketData may be invalidated by Close.
+	Close()
+}
+
+// TimestampResolutionSource may be implemented by a PacketSource to report the resolution of the
+// timestamps it captures. For sources which do not implement this interface, timestamps are assumed
+// to have the precision requested in the SourceConfig.
+type TimestampResolutionSource interface {
+	PacketSource
+
+	// Resolution of the timestamps read from this source.
+	Resolution() gopacket.TimestampResolution
+}
+
+// dataLinkSource is implemented by packet sources able to report their data link type without the
+// truncation to 8 bits imposed by layers.LinkType (see dltLinuxSLL2). If ok is false, the link type
+// could not be determined and the one reported by LinkType should be used.
+type dataLinkSource interface {
+	dataLinkType() (dlt int, ok bool)
+}
+
+// sourceLinkType returns the link type of packets read from the source, preferring the untruncated
+// data link type where the source provides it.
+func sourceLinkType(src PacketSource) (LinkType, error) {
+	if dls, ok := src.(dataLinkSource); ok {
+		if dlt, ok := dls.dataLinkType(); ok {
+			return linkTypeFromDLT(dlt)
+		}
+	}
+	return linkTypeFrom(src.LinkType())
+}
+
+// A PacketSourceFactory is used to open packet sources for capture.
+type PacketSourceFactory interface {
+	SourceFor(SourceConfig) (PacketSource, error)
+}
+
+// PcapSourceFactory implements PacketSourceFactory, producing packet sources backed by live
+// libpcap handles.
+type PcapSourceFactory struct{}
+
+// SourceFor implements the PacketSourceFactory interface, opening a live libpcap handle.
+//
+// The gopacket package requests nanosecond timestamps from libpcap when activating the handle,
+// regardless of cfg.NanosecondTimestamps. The precision actually obtained depends on libpcap and
+// the platform, and is reported by the source, which implements TimestampResolutionSource.
+func (f PcapSourceFactory) SourceFor(cfg SourceConfig) (PacketSource, error) {
+	inactive, err := pcap.NewInactiveHandle(cfg.Interface)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create capture handle: %w", err)
+	}
+	defer inactive.CleanUp()
+
+	if err := inactive.SetSnapLen(cfg.SnapLen); err != nil {
+		return nil, fmt.Errorf("failed to set snap length: %w", err)
+	}
+	if err := inactive.SetPromisc(cfg.Promiscuous); err != nil {
+		return nil, fmt.Errorf("failed to set promiscuous mode: %w", err)
+	}
+	if err := inactive.SetTimeout(cfg.ReadTimeout); err != nil {
+		return nil, fmt.Errorf("failed to set read timeout: %w", err)
+	}
+	if cfg.ImmediateMode {
+		if err := inactive.SetImmediateMode(true); err != nil {
+			return nil, fmt.Errorf("failed to set immediate mode: %w", err)
+		}
+	}
+	if cfg.BufferSize > 0 {
+		if err := inactive.SetBufferSize(cfg.BufferSize); err != nil {
+			return nil, fmt.Errorf("failed to set buffer size: %w", err)
+		}
+	}
+	handle, err := inactive.Activate()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open capture handle: %w", err)
+	}
+	return pcapSource{handle}, nil
+}
+
+type pcapSource struct {
+	*pcap.Handle
+}
+
+func (s pcapSource) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	data, ci, err := s.Handle.ZeroCopyReadPacketData()
+	if nextErr, ok := err.(pcap.NextError); ok && nextErr == pcap.NextErrorTimeoutExpired {
+		return nil, ci, ErrReadTimeout
+	}
+	return data, ci, err
+}
+
+// dataLinkType implements dataLinkSource. The gopacket package truncates the link type of the
+// handle, so link type 20 is disambiguated using the names of the data links the handle supports.
+func (s pcapSource) dataLinkType() (int, bool) {
+	lt := s.Handle.LinkType()
+	if lt != dltLinuxSLL2 {
+		return int(lt), true
+	}
+	links, err := s.ListDataLinks()
+	if err != nil {
+		return 0, false
+	}
+	for _, link := range links {
+		if link.Name == "LINUX_SLL2" {
+			return linktypeLinuxSLL2, true
+		}
+	}
+	return int(lt), true
+}
+
+func (s pcapSource) Stats() (CaptureStats, error) {
+	stats, err := s.Handle.Stats()
+	if err != nil {
+		return CaptureStats{}, err
+	}
+	return CaptureStats{uint64(stats.PacketsReceived), uint64(stats.PacketsDropped)}, nil
+}
@@ -0,0 +1,201 @@
+package trafficlog
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/afpacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"golang.org/x/net/bpf"
+)
+
+// Defaults for AFPacketSourceFactory. The ring for each source occupies BlockSize * NumBlocks bytes.
+const (
+	DefaultAFPacketBlockSize = 1024 * 1024
+	DefaultAFPacketNumBlocks = 8
+)
+
+// Device types as reported in /sys/class/net/<interface>/type. See linux/if_arp.h.
+const (
+	arphrdEther    = 1
+	arphrdLoopback = 772
+	arphrdNone     = 65534
+)
+
+// AFPacketSourceFactory implements PacketSourceFactory, producing packet sources backed by Linux
+// AF_PACKET sockets. Packets are read from a memory-mapped TPACKET_V3 ring shared with the kernel.
+// This avoids a copy and a system call per packet and tends to drop fewer packets than libpcap on
+// busy hosts.
+//
+// Opening an AF_PACKET socket requires the CAP_NET_RAW capability. Promiscuous mode is not
+// supported; requesting it results in an error.
+type AFPacketSourceFactory struct {
+	// BlockSize is the size of each block in the ring. Must be a multiple of the page size.
+	//
+	// Defaults to DefaultAFPacketBlockSize.
+	BlockSize int
+
+	// NumBlocks is the number of blocks in the ring. If a source is requested with a buffer size,
+	// the number of blocks is instead chosen to provide at least that size.
+	//
+	// Defaults to DefaultAFPacketNumBlocks.
+	NumBlocks int
+}
+
+// The timeout after which the kernel hands a partially-filled block to readers, when immediate
+// mode is requested. This is the minimum supported by the kernel.
+const afpacketImmediateBlockTimeout = time.Millisecond
+
+// SourceFor implements the PacketSourceFactory interface, opening an AF_PACKET socket.
+func (f AFPacketSourceFactory) SourceFor(cfg SourceConfig) (PacketSource, error) {
+	if cfg.Promiscuous {
+		return nil, errors.New("promiscuous mode is not supported for AF_PACKET sources")
+	}
+	linkType, err := afpacketLinkType(cfg.Interface)
+	if err != nil {
+		return nil, err
+	}
+	blockSize, numBlocks := f.BlockSize, f.NumBlocks
+	if blockSize <= 0 {
+		blockSize = DefaultAFPacketBlockSize
+	}
+	if numBlocks <= 0 {
+		numBlocks = DefaultAFPacketNumBlocks
+	}
+	if cfg.BufferSize > 0 {
+		numBlocks = (cfg.BufferSize + blockSize - 1) / blockSize
+	}
+	opts := []interface{}{
+		afpacket.OptInterface(cfg.Interface),
+		afpacket.OptTPacketVersion(afpacket.TPacketVersion3),
+		afpacket.OptBlockSize(blockSize),
+		afpacket.OptNumBlocks(numBlocks),
+		afpacket.OptPollTimeout(cfg.ReadTimeout),
+	}
+	if cfg.ImmediateMode {
+		opts = append(opts, afpacket.OptBlockTimeout(afpacketImmediateBlockTimeout))
+	}
+	tp, err := afpacket.NewTPacket(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open AF_PACKET socket: %w", err)
+	}
+	return &afpacketSource{tp: tp, linkType: linkType, snapLen: cfg.SnapLen}, nil
+}
+
+// tpacket is the subset of *afpacket.TPacket used by afpacketSource.
+type tpacket interface {
+	ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+	SetBPF([]bpf.RawInstruction) error
+	SocketStats() (afpacket.SocketStats, afpacket.SocketStatsV3, error)
+	Close()
+}
+
+type afpacketSource struct {
+	tp       tpacket
+	linkType layers.LinkType
+	snapLen  int
+
+	// mu is held for the duration of each read, so Close waits for any read in progress before
+	// releasing the ring.
+	closed bool
+	mu     sync.Mutex
+}
+
+func (s *afpacketSource) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+	data, ci, err := s.tp.ZeroCopyReadPacketData()
+	if err == afpacket.ErrTimeout {
+		return nil, ci, ErrReadTimeout
+	}
+	// The ring holds entire packets, so the snap length is applied here.
+	if err == nil && s.snapLen > 0 && len(data) > s.snapLen {
+		data = data[:s.snapLen]
+		ci.CaptureLength = s.snapLen
+	}
+	return data, ci, err
+}
+
+func (s *afpacketSource) LinkType() layers.LinkType {
+	return s.linkType
+}
+
+func (s *afpacketSource) SetBPFFilter(expr string) error {
+	pcapInstructions, err := pcap.CompileBPFFilter(s.linkType, s.snapLen, expr)
+	if err != nil {
+		return fmt.Errorf("failed to compile filter: %w", err)
+	}
+	instructions := make([]bpf.RawInstruction, len(pcapInstructions))
+	for i, pi := range pcapInstructions {
+		instructions[i] = bpf.RawInstruction{Op: pi.Code, Jt: pi.Jt, Jf: pi.Jf, K: pi.K}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return io.EOF
+	}
+	return s.tp.SetBPF(instructions)
+}
+
+func (s *afpacketSource) Stats() (CaptureStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return CaptureStats{}, io.EOF
+	}
+	// The kernel resets its counters each time they are read. The afpacket package accumulates
+	// them, so these are totals since the socket was opened.
+	_, stats, err := s.tp.SocketStats()
+	if err != nil {
+		return CaptureStats{}, fmt.Errorf("failed to read socket stats: %w", err)
+	}
+	return CaptureStats{uint64(stats.Packets()), uint64(stats.Drops())}, nil
+}
+
+// Close waits for any read in progress, then closes the socket and unmaps the ring. Data returned
+// by the last read is invalid once Close returns.
+func (s *afpacketSource) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.closed {
+		s.tp.Close()
+		s.closed = true
+	}
+}
+
+// AF_PACKET sockets of type SOCK_RAW deliver packets with the link-layer header of the device.
+func afpacketLinkType(iface string) (layers.LinkType, error) {
+	typeFile := filepath.Join("/sys/class/net", iface, "type")
+	b, err := ioutil.ReadFile(typeFile)
+	if err != nil {
+		return 0, fmt.Errorf("failed to determine device type: %w", err)
+	}
+	devType, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse device type from %s: %w", typeFile, err)
+	}
+	switch devType {
+	case arphrdEther, arphrdLoopback:
+		return layers.LinkTypeEthernet, nil
+	case arphrdNone:
+		return layers.LinkTypeRaw, nil
+	default:
+		return 0, fmt.Errorf("unsupported device type %d for %s", devType, iface)
+	}
+}
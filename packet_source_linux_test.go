@@ -0,0 +1,168 @@
+package trafficlog
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getlantern/trafficlog/tltest"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/afpacket"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/bpf"
+)
+
+// testTPacket implements tpacket. Each read blocks until released.
+type testTPacket struct {
+	readStarted, releaseRead chan struct{}
+
+	closes int
+	sync.Mutex
+}
+
+func (tp *testTPacket) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	tp.readStarted <- struct{}{}
+	<-tp.releaseRead
+	return []byte{1, 2, 3}, gopacket.CaptureInfo{CaptureLength: 3, Length: 3}, nil
+}
+
+func (tp *testTPacket) SetBPF([]bpf.RawInstruction) error { return nil }
+
+func (tp *testTPacket) SocketStats() (afpacket.SocketStats, afpacket.SocketStatsV3, error) {
+	return afpacket.SocketStats{}, afpacket.SocketStatsV3{}, nil
+}
+
+func (tp *testTPacket) Close() {
+	tp.Lock()
+	tp.closes++
+	tp.Unlock()
+}
+
+func (tp *testTPacket) closeCount() int {
+	tp.Lock()
+	defer tp.Unlock()
+	return tp.closes
+}
+
+func TestAFPacketSourceClose(t *testing.T) {
+	t.Parallel()
+
+	tp := &testTPacket{readStarted: make(chan struct{}), releaseRead: make(chan struct{})}
+	src := &afpacketSource{tp: tp, linkType: layers.LinkTypeEthernet}
+
+	readDone := make(chan error)
+	go func() {
+		_, _, err := src.ZeroCopyReadPacketData()
+		readDone <- err
+	}()
+	<-tp.readStarted
+
+	// Close should wait for the read in progress before releasing the ring.
+	closeDone := make(chan struct{})
+	go func() {
+		src.Close()
+		close(closeDone)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	require.Zero(t, tp.closeCount())
+	close(tp.releaseRead)
+	require.NoError(t, <-readDone)
+	<-closeDone
+	require.Equal(t, 1, tp.closeCount())
+
+	// The ring is released once, with no further reads required.
+	_, _, err := src.ZeroCopyReadPacketData()
+	require.Equal(t, io.EOF, err)
+	src.Close()
+	require.Equal(t, 1, tp.closeCount())
+}
+
+// BenchmarkPacketSources compares the libpcap and AF_PACKET backends. Packets are sent over the
+// loopback interface as quickly as possible while the source reads them. The drop rate reported
+// reflects the source's ability to keep up with ingress.
+//
+// Requires elevated permissions.
+func BenchmarkPacketSources(b *testing.B) {
+	if !tltest.RunElevated {
+		b.SkipNow()
+	}
+
+	for _, bm := range []struct {
+		name    string
+		factory PacketSourceFactory
+	}{
+		{"pcap", PcapSourceFactory{}},
+		{"afpacket", AFPacketSourceFactory{}},
+	} {
+		bm := bm
+		b.Run(bm.name, func(b *testing.B) {
+			benchmarkPacketSource(b, bm.factory)
+		})
+	}
+}
+
+func benchmarkPacketSource(b *testing.B, f PacketSourceFactory) {
+	const payloadSize = 512
+
+	// Port 9 is the discard port. It does not matter whether anything is listening.
+	conn, err := net.Dial("udp4", "127.0.0.1:9")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	iface, err := networkInterfaceFor(net.ParseIP("127.0.0.1"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	src, err := f.SourceFor(SourceConfig{
+		Interface: iface.pcapName(), SnapLen: iface.mtu(), ReadTimeout: packetReadTimeout,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer src.Close()
+	localPort := conn.LocalAddr().(*net.UDPAddr).Port
+	if err := src.SetBPFFilter(fmt.Sprintf("udp and src port %d", localPort)); err != nil {
+		b.Fatal(err)
+	}
+
+	stopSending := make(chan struct{})
+	sendGroup := new(sync.WaitGroup)
+	sendGroup.Add(1)
+	go func() {
+		defer sendGroup.Done()
+		payload := make([]byte, payloadSize)
+		for {
+			select {
+			case <-stopSending:
+				return
+			default:
+				// Errors are expected (e.g. ECONNREFUSED) and do not matter here.
+				conn.Write(payload)
+			}
+		}
+	}()
+
+	b.SetBytes(payloadSize)
+	b.ResetTimer()
+	deadline := time.Now().Add(time.Minute)
+	for read := 0; read < b.N && time.Now().Before(deadline); {
+		if _, _, err := src.ZeroCopyReadPacketData(); err == nil {
+			read++
+		}
+	}
+	b.StopTimer()
+	close(stopSending)
+	sendGroup.Wait()
+
+	stats, err := src.Stats()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportMetric(float64(stats.Dropped)/float64(b.N), "drops/op")
+}
@@ -0,0 +1,337 @@
+package trafficlog
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// The snap length used for replayed interfaces when the file does not specify one. This is the
+// maximum snap length used by libpcap.
+const maxReplaySnapLen = 262144
+
+// The first four bytes of a pcapng file (the block type of the section header block).
+var pcapngMagic = []byte{0x0A, 0x0D, 0x0D, 0x0A}
+
+// ReplayOptions configures a call to TrafficLog.Replay.
+type ReplayOptions struct {
+	// Paced causes packets to be fed into the traffic log with the same spacing as their capture
+	// timestamps. By default, packets are fed in as quickly as possible.
+	Paced bool
+
+	// KeepTimestamps preserves the capture timestamps recorded in the file. By default, timestamps
+	// are shifted such that the first packet in the file appears to have been captured at the time
+	// Replay was called. Note that SaveCaptures selects packets by age, so packets with their
+	// original timestamps may be too old to be saved.
+	KeepTimestamps bool
+}
+
+// Replay reads packets from a pcap or pcapng file and feeds them through the traffic log as though
+// they had been captured live. Packets going to or coming from any of the input addresses are
+// mutated and stored in the capture buffer, just as captured packets would be. These packets can
+// then be saved using SaveCaptures and written out using WritePcapng. Other packets in the file
+// are ignored.
+//
+// Addresses need not be part of a call to UpdateAddresses. If an address is currently being
+// captured, the replayed packets are stored alongside the live captures for that address.
+//
+// Replay blocks until the entire file has been read. Replay does not require elevated permissions.
+func (tl *TrafficLog) Replay(r io.Reader, addresses []string, opts *ReplayOptions) error {
+	if opts == nil {
+		opts = &ReplayOptions{}
+	}
+
+	matchers := make([]replayMatcher, len(addresses))
+	for i, addr := range addresses {
+		m, err := newReplayMatcher(addr, tl.resolver, tl.captures.captureRelated)
+		if err != nil {
+			return fmt.Errorf("failed to resolve %s: %w", addr, err)
+		}
+		matchers[i] = *m
+	}
+
+	tl.captureProcsLock.Lock()
+	hooks := make([]*sharedBufferHook, len(addresses))
+	for i, addr := range addresses {
+		hooks[i] = tl.replayHookFor(addr)
+	}
+	tl.captureProcsLock.Unlock()
+
+	f, err := openReplayFile(r, tl.nextReplayIndex)
+	if err != nil {
+		return err
+	}
+
+	var (
+		mutators  = map[LinkType]PacketMutator{}
+		start     = time.Now()
+		firstTS   time.Time
+		matchedBy = make([]*sharedBufferHook, 0, len(hooks))
+	)
+	for i := 0; ; i++ {
+		data, ci, iface, err := f.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read packet %d: %w", i, err)
+		}
+		if i == 0 {
+			firstTS = ci.Timestamp
+		}
+		if opts.Paced {
+			time.Sleep(time.Until(start.Add(ci.Timestamp.Sub(firstTS))))
+		}
+		if !opts.KeepTimestamps {
+			ci.Timestamp = start.Add(ci.Timestamp.Sub(firstTS))
+		}
+
+		addrs, ok := decodeAddrs(iface.linkType, data)
+		if !ok {
+			continue
+		}
+		matchedBy = matchedBy[:0]
+		for j, m := range matchers {
+			matched, err := m.matches(addrs, iface.linkType, ci, data)
+			if err != nil {
+				return fmt.Errorf("failed to match packet %d: %w", i, err)
+			}
+			if matched {
+				matchedBy = append(matchedBy, hooks[j])
+			}
+		}
+		if len(matchedBy) == 0 {
+			continue
+		}
+
+		mutator, ok := mutators[iface.linkType]
+		if !ok {
+			mutator = tl.mutatorFactory.MutatorFor(iface.linkType)
+			mutators[iface.linkType] = mutator
+		}
+		dataBuf := tl.capturePool.Get()
+		if err := mutator(data, dataBuf); err != nil {
+			tl.capturePool.Put(dataBuf)
+			return fmt.Errorf("packet mutation error for packet %d: %w", i, err)
+		}
+		ci.CaptureLength = dataBuf.Len()
+		captured := capturedPacket{
+			tl.captures.nextPacketID(), newCaptureInfo(ci, iface), dataBuf, tl.capturePool, nil,
+		}
+		tl.captureBuffer.putPacket(captured, nil, matchedBy)
+	}
+}
+
+// Returns the hook used to store packets for the input address. If the address is currently being
+// captured, this is the capture process' hook. Otherwise, a hook specifically for replayed packets
+// is used. This hook will be handed over to the capture process if capture starts for the address.
+//
+// Should be called with tl.captureProcsLock held.
+func (tl *TrafficLog) replayHookFor(addr string) *sharedBufferHook {
+	if proc, ok := tl.captureProcs[addr]; ok {
+		return proc.buffer
+	}
+	hook, ok := tl.replayHooks[addr]
+	if !ok {
+		hook = tl.captureBuffer.newHookFor(addr)
+		tl.replayHooks[addr] = hook
+	}
+	return hook
+}
+
+// Replayed packets are attributed to synthetic network interfaces. These are given negative
+// indices to avoid collisions with the system's network interfaces.
+func (tl *TrafficLog) nextReplayIndex() int {
+	return int(atomic.AddInt32(&tl.lastReplayIndex, -1))
+}
+
+// replayMatcher matches packets to an address in the same manner as the capture filters used for
+// live capture.
+type replayMatcher struct {
+	routes []*captureRoute
+
+	// Compiled forms of the address' filter expression, if it has one. Packets in a file may have
+	// different link types, so the expression is compiled for each as needed.
+	filter      string
+	userFilters map[LinkType]*userFilter
+}
+
+// newReplayMatcher returns a matcher for the address. If related is set, the matcher includes
+// related ICMP errors and fragments, as described in Options.CaptureICMPAndFragments.
+func newReplayMatcher(addr string, r Resolver, related bool) (*replayMatcher, error) {
+	spec, err := parseAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+	m := replayMatcher{nil, spec.filter, map[LinkType]*userFilter{}}
+	if spec.network != nil {
+		route := spec.routeFor(nil, nil)
+		route.related = related
+		m.routes = []*captureRoute{route}
+		return &m, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	ips, _, err := r.LookupIP(ctx, spec.host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find IP for host: %w", err)
+	}
+	for _, ip := range ips {
+		m.routes = append(m.routes, spec.routeFor(ip, nil))
+	}
+	for _, route := range m.routes {
+		route.related = related
+	}
+	return &m, nil
+}
+
+func (m replayMatcher) matches(addrs packetAddrs, lt LinkType, ci gopacket.CaptureInfo, data []byte) (bool, error) {
+	matched := false
+	for _, r := range m.routes {
+		if r.matches(addrs) {
+			matched = true
+			break
+		}
+	}
+	if !matched || m.filter == "" {
+		return matched, nil
+	}
+	uf, ok := m.userFilters[lt]
+	if !ok {
+		var err error
+		if uf, err = newUserFilter(lt, m.filter); err != nil {
+			return false, err
+		}
+		m.userFilters[lt] = uf
+	}
+	return uf.matches(ci, data), nil
+}
+
+// replayFile reads packets from a pcap or pcapng file.
+type replayFile struct {
+	pcapR *pcapgo.Reader
+	ngR   *pcapgo.NgReader
+
+	// The data link type in the header of a pcap file. Unlike the link type reported by pcapR, this
+	// is not truncated (see dltLinuxSLL2).
+	pcapDataLink int
+
+	// Maps interface IDs in the file to synthetic network interfaces.
+	ifaces         map[int]*networkInterface
+	nextIfaceIndex func() int
+}
+
+func openReplayFile(r io.Reader, nextIfaceIndex func() int) (*replayFile, error) {
+	bufR := bufio.NewReader(r)
+	magic, err := bufR.Peek(len(pcapngMagic))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file header: %w", err)
+	}
+	f := replayFile{ifaces: map[int]*networkInterface{}, nextIfaceIndex: nextIfaceIndex}
+	if bytes.Equal(magic, pcapngMagic) {
+		f.ngR, err = pcapgo.NewNgReader(bufR, pcapgo.NgReaderOptions{WantMixedLinkType: true})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read pcapng file: %w", err)
+		}
+		return &f, nil
+	}
+	header, err := bufR.Peek(pcapHeaderLen)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file header: %w", err)
+	}
+	f.pcapR, err = pcapgo.NewReader(bufR)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pcap file: %w", err)
+	}
+	f.pcapDataLink = pcapDataLink(header)
+	return &f, nil
+}
+
+// The length of a pcap file header.
+const pcapHeaderLen = 24
+
+// pcapDataLink returns the data link type recorded in a pcap file header, which has been validated
+// by the pcapgo package. The byte order of the file is determined from its magic number.
+func pcapDataLink(header []byte) int {
+	var order binary.ByteOrder = binary.BigEndian
+	switch binary.LittleEndian.Uint32(header) {
+	case 0xa1b2c3d4, 0xa1b23c4d:
+		order = binary.LittleEndian
+	}
+	// The upper bits of the field may hold FCS information.
+	return int(order.Uint32(header[20:]) & 0xffff)
+}
+
+// next returns the next packet in the file. Returns io.EOF when the file has been read.
+func (f *replayFile) next() ([]byte, gopacket.CaptureInfo, *networkInterface, error) {
+	if f.pcapR != nil {
+		data, ci, err := f.pcapR.ReadPacketData()
+		if err != nil {
+			return nil, ci, nil, err
+		}
+		iface, err := f.interfaceFor(0, func() (pcapgo.NgInterface, error) {
+			return pcapgo.NgInterface{SnapLength: f.pcapR.Snaplen()}, nil
+		})
+		return data, ci, iface, err
+	}
+
+	data, ci, err := f.ngR.ReadPacketData()
+	if err != nil {
+		return nil, ci, nil, err
+	}
+	iface, err := f.interfaceFor(ci.InterfaceIndex, func() (pcapgo.NgInterface, error) {
+		return f.ngR.Interface(ci.InterfaceIndex)
+	})
+	return data, ci, iface, err
+}
+
+func (f *replayFile) interfaceFor(id int, describe func() (pcapgo.NgInterface, error)) (*networkInterface, error) {
+	if iface, ok := f.ifaces[id]; ok {
+		return iface, nil
+	}
+	ngIface, err := describe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read interface description: %w", err)
+	}
+	// The pcapgo package truncates the link type of pcapng interfaces, so SLL2 can only be recognized
+	// by its truncated value there.
+	var linkType LinkType
+	if f.pcapR != nil {
+		linkType, err = linkTypeFromDLT(f.pcapDataLink)
+	} else {
+		linkType, err = linkTypeFrom(ngIface.LinkType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	name := ngIface.Name
+	if name == "" {
+		name = "replay" + strconv.Itoa(id)
+	}
+	snapLen := int(ngIface.SnapLength)
+	if snapLen == 0 || snapLen > maxReplaySnapLen {
+		snapLen = maxReplaySnapLen
+	}
+	iface := &networkInterface{
+		pcapInterface: pcap.Interface{Name: name, Description: ngIface.Description},
+		netInterface:  net.Interface{Index: f.nextIfaceIndex(), MTU: snapLen, Name: name},
+		linkType:      linkType,
+		snapLen:       snapLen,
+
+		// Timestamps are kept with the precision used in the file.
+		nanoTimestamps: true,
+	}
+	f.ifaces[id] = iface
+	return iface, nil
+}
@@ -0,0 +1,324 @@
+package trafficlog
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/stretchr/testify/require"
+)
+
+// testFrame describes a TCP segment in an ethernet frame.
+type testFrame struct {
+	src, dst string // host:port
+	payload  string
+	ts       time.Time
+}
+
+func (f testFrame) serialize(t testing.TB) []byte {
+	t.Helper()
+
+	splitAddr := func(addr string) (net.IP, layers.TCPPort) {
+		host, portStr, err := net.SplitHostPort(addr)
+		require.NoError(t, err)
+		var port int
+		_, err = fmt.Sscan(portStr, &port)
+		require.NoError(t, err)
+		return net.ParseIP(host).To4(), layers.TCPPort(port)
+	}
+	srcIP, srcPort := splitAddr(f.src)
+	dstIP, dstPort := splitAddr(f.dst)
+
+	eth := layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{0, 0, 0, 0, 0, 2},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: srcIP, DstIP: dstIP}
+	tcp := layers.TCP{SrcPort: srcPort, DstPort: dstPort, PSH: true, ACK: true, Window: 1024}
+	require.NoError(t, tcp.SetNetworkLayerForChecksum(&ip))
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	require.NoError(t, gopacket.SerializeLayers(buf, opts, &eth, &ip, &tcp, gopacket.Payload(f.payload)))
+	return buf.Bytes()
+}
+
+func writePcap(t *testing.T, frames []testFrame) []byte {
+	t.Helper()
+
+	buf := new(bytes.Buffer)
+	w := pcapgo.NewWriter(buf)
+	require.NoError(t, w.WriteFileHeader(65536, layers.LinkTypeEthernet))
+	for _, f := range frames {
+		data := f.serialize(t)
+		ci := gopacket.CaptureInfo{Timestamp: f.ts, CaptureLength: len(data), Length: len(data)}
+		require.NoError(t, w.WritePacket(ci, data))
+	}
+	return buf.Bytes()
+}
+
+func writePcapng(t *testing.T, frames []testFrame) []byte {
+	t.Helper()
+
+	buf := new(bytes.Buffer)
+	w, err := pcapgo.NewNgWriter(buf, layers.LinkTypeEthernet)
+	require.NoError(t, err)
+	for _, f := range frames {
+		data := f.serialize(t)
+		ci := gopacket.CaptureInfo{Timestamp: f.ts, CaptureLength: len(data), Length: len(data)}
+		require.NoError(t, w.WritePacket(ci, data))
+	}
+	require.NoError(t, w.Flush())
+	return buf.Bytes()
+}
+
+// Reads the payloads of the TCP segments in a pcapng file.
+func readPayloads(t *testing.T, pcapng []byte) []string {
+	t.Helper()
+
+	r, err := pcapgo.NewNgReader(bytes.NewReader(pcapng), pcapgo.NgReaderOptions{WantMixedLinkType: true})
+	require.NoError(t, err)
+	payloads := []string{}
+	for {
+		data, _, err := r.ReadPacketData()
+		if err == io.EOF {
+			return payloads
+		}
+		require.NoError(t, err)
+		pkt := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+		require.NotNil(t, pkt.TransportLayer())
+		payloads = append(payloads, string(pkt.TransportLayer().LayerPayload()))
+	}
+}
+
+func TestReplay(t *testing.T) {
+	t.Parallel()
+
+	const (
+		client  = "10.0.0.1:50000"
+		serverA = "10.0.0.2:443"
+		serverB = "10.0.0.3:443"
+		other   = "10.0.0.4:80"
+	)
+
+	start := time.Now().Add(-24 * time.Hour)
+	frames := []testFrame{
+		{client, serverA, "A request", start},
+		{serverA, client, "A response", start.Add(time.Millisecond)},
+		{client, other, "unwatched", start.Add(2 * time.Millisecond)},
+		{client, serverB, "B request", start.Add(3 * time.Millisecond)},
+		{serverB, client, "B response", start.Add(4 * time.Millisecond)},
+	}
+
+	for name, file := range map[string][]byte{
+		"pcap":   writePcap(t, frames),
+		"pcapng": writePcapng(t, frames),
+	} {
+		file := file
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			tl := New(1024*1024, 1024*1024, nil)
+			defer tl.Close()
+
+			require.NoError(t, tl.Replay(bytes.NewReader(file), []string{serverA, serverB}, nil))
+			tl.SaveCaptures(serverA, time.Minute)
+
+			buf := new(bytes.Buffer)
+			require.NoError(t, tl.WritePcapng(buf))
+			require.Equal(t, []string{"A request", "A response"}, readPayloads(t, buf.Bytes()))
+
+			tl.SaveCaptures(serverB, time.Minute)
+			buf.Reset()
+			require.NoError(t, tl.WritePcapng(buf))
+			require.Equal(
+				t, []string{"A request", "A response", "B request", "B response"},
+				readPayloads(t, buf.Bytes()))
+		})
+	}
+}
+
+func TestReplaySharedIP(t *testing.T) {
+	t.Parallel()
+
+	const (
+		client = "10.0.0.1:50000"
+		server = "10.0.0.2:443"
+	)
+
+	// Both addresses resolve to the server's IP.
+	r := new(testResolver)
+	r.setIPs("10.0.0.2")
+	tl := New(1024*1024, 1024*1024, &Options{Resolver: r})
+	defer tl.Close()
+
+	frames := []testFrame{
+		{client, server, "request", time.Now()},
+		{server, client, "response", time.Now()},
+	}
+	addresses := []string{server, "cdn.example.com:443"}
+	require.NoError(t, tl.Replay(bytes.NewReader(writePcapng(t, frames)), addresses, nil))
+
+	// Each packet should be visible to both addresses, but stored once.
+	var sizes int
+	for _, addr := range addresses {
+		sizes = 0
+		tl.replayHooks[addr].forEach(func(item bufferItem) {
+			sizes += item.size()
+		})
+		require.NotZero(t, sizes)
+	}
+	require.Equal(t, sizes, tl.captureBuffer.size)
+
+	for _, addr := range addresses {
+		tl.SaveCaptures(addr, time.Minute)
+	}
+	buf := new(bytes.Buffer)
+	require.NoError(t, tl.WritePcapng(buf))
+	require.Equal(t, []string{"request", "response"}, readPayloads(t, buf.Bytes()))
+}
+
+// literalResolver resolves only IP literals. Other hosts fail to resolve.
+type literalResolver struct{}
+
+func (literalResolver) LookupIP(_ context.Context, host string) ([]net.IP, time.Duration, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, 0, nil
+	}
+	return nil, 0, errors.New("no such host")
+}
+
+func TestReplayFailedUpdateAddresses(t *testing.T) {
+	t.Parallel()
+
+	const (
+		client = "127.0.0.1:50000"
+		server = "127.0.0.1:443"
+	)
+
+	opts := &Options{PacketSourceFactory: newFakeSourceFactory(), Resolver: literalResolver{}}
+	tl := New(1024*1024, 1024*1024, opts)
+	defer tl.Close()
+
+	replay := func(payload string) {
+		t.Helper()
+		frames := []testFrame{{client, server, payload, time.Now()}}
+		require.NoError(t, tl.Replay(bytes.NewReader(writePcapng(t, frames)), []string{server}, nil))
+	}
+
+	// A failed update should leave the replay hook open and registered for the address.
+	replay("before")
+	require.Error(t, tl.UpdateAddresses([]string{server, "unresolvable.example.com:443"}))
+	replay("after")
+	require.NoError(t, tl.UpdateAddresses([]string{server}))
+	require.False(t, tl.captureProcs[server].buffer.closed)
+
+	tl.SaveCaptures(server, time.Minute)
+	buf := new(bytes.Buffer)
+	require.NoError(t, tl.WritePcapng(buf))
+	require.Equal(t, []string{"before", "after"}, readPayloads(t, buf.Bytes()))
+}
+
+func TestReplayPcapDataLink(t *testing.T) {
+	t.Parallel()
+
+	file := writePcap(t, []testFrame{{"10.0.0.1:50000", "10.0.0.2:443", "request", time.Now()}})
+	require.Equal(t, int(layers.LinkTypeEthernet), pcapDataLink(file))
+
+	bigEndian := make([]byte, pcapHeaderLen)
+	binary.BigEndian.PutUint32(bigEndian, 0xa1b2c3d4)
+	binary.BigEndian.PutUint32(bigEndian[20:], linktypeLinuxSLL2)
+	require.Equal(t, linktypeLinuxSLL2, pcapDataLink(bigEndian))
+
+	// Link type 20 is not mistaken for a truncated LINKTYPE_LINUX_SLL2.
+	binary.LittleEndian.PutUint32(file[20:], uint32(dltLinuxSLL2))
+	tl := New(1024*1024, 1024*1024, nil)
+	defer tl.Close()
+	err := tl.Replay(bytes.NewReader(file), []string{"10.0.0.2:443"}, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unsupported link type 20")
+}
+
+func TestReplayOptions(t *testing.T) {
+	t.Parallel()
+
+	const (
+		client  = "10.0.0.1:50000"
+		server  = "10.0.0.2:443"
+		spacing = 50 * time.Millisecond
+	)
+
+	origStart := time.Now().Add(-24 * time.Hour)
+	frames := []testFrame{
+		{client, server, "first", origStart},
+		{server, client, "second", origStart.Add(spacing)},
+		{client, server, "third", origStart.Add(2 * spacing)},
+	}
+	file := writePcapng(t, frames)
+
+	t.Run("paced", func(t *testing.T) {
+		t.Parallel()
+
+		tl := New(1024*1024, 1024*1024, nil)
+		defer tl.Close()
+
+		replayStart := time.Now()
+		require.NoError(t, tl.Replay(bytes.NewReader(file), []string{server}, &ReplayOptions{Paced: true}))
+		require.GreaterOrEqual(t, int64(time.Since(replayStart)), int64(2*spacing))
+
+		timestamps := []int64{}
+		tl.captureProcsLock.Lock()
+		hook := tl.replayHooks[server]
+		tl.captureProcsLock.Unlock()
+		hook.forEach(func(item bufferItem) {
+			timestamps = append(timestamps, item.(packetItem).captured().info.unixNano)
+		})
+		require.Len(t, timestamps, len(frames))
+		for i, ts := range timestamps {
+			expected := replayStart.Add(time.Duration(i) * spacing).UnixNano()
+			require.InDelta(t, expected, ts, float64(spacing/2))
+		}
+	})
+
+	t.Run("original timestamps", func(t *testing.T) {
+		t.Parallel()
+
+		tl := New(1024*1024, 1024*1024, nil)
+		defer tl.Close()
+
+		opts := &ReplayOptions{KeepTimestamps: true}
+		require.NoError(t, tl.Replay(bytes.NewReader(file), []string{server}, opts))
+
+		// The packets are too old to be saved with a short window.
+		tl.SaveCaptures(server, time.Hour)
+		buf := new(bytes.Buffer)
+		require.NoError(t, tl.WritePcapng(buf))
+		require.Empty(t, readPayloads(t, buf.Bytes()))
+
+		tl.SaveCaptures(server, 48*time.Hour)
+		buf.Reset()
+		require.NoError(t, tl.WritePcapng(buf))
+		require.Equal(t, []string{"first", "second", "third"}, readPayloads(t, buf.Bytes()))
+	})
+
+	t.Run("malformed address", func(t *testing.T) {
+		t.Parallel()
+
+		tl := New(1024*1024, 1024*1024, nil)
+		defer tl.Close()
+
+		// A bare host is valid, but a bad port is not.
+		err := tl.Replay(bytes.NewReader(file), []string{"10.0.0.2:http"}, nil)
+		require.True(t, errors.As(err, new(ErrorMalformedAddress)), "unexpected error: %v", err)
+	})
+}
@@ -0,0 +1,258 @@
+package trafficlog
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DefaultNetResolverTTL is the default TTL assumed by NetResolver.
+const DefaultNetResolverTTL = 30 * time.Second
+
+// DefaultDNSTimeout is the default timeout for queries made by DNSResolver.
+const DefaultDNSTimeout = 5 * time.Second
+
+// Maximum size of a DNS message over UDP, absent EDNS.
+const maxUDPMessageSize = 512
+
+// A Resolver resolves hostnames to IP addresses.
+type Resolver interface {
+	// LookupIP returns the IP addresses for the input host, along with the amount of time for
+	// which these results may be considered valid. This is typically the smallest TTL of the DNS
+	// records used in resolution.
+	LookupIP(ctx context.Context, host string) (ips []net.IP, ttl time.Duration, err error)
+}
+
+// NetResolver implements Resolver using a *net.Resolver. The net package does not expose the TTLs
+// of DNS records, so all results are assumed to be valid for a fixed duration.
+type NetResolver struct {
+	// Resolver is used to resolve hosts.
+	//
+	// Defaults to net.DefaultResolver.
+	Resolver *net.Resolver
+
+	// TTL is the amount of time for which results are assumed to be valid.
+	//
+	// Defaults to DefaultNetResolverTTL.
+	TTL time.Duration
+}
+
+// LookupIP implements the Resolver interface.
+func (r NetResolver) LookupIP(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	resolver, ttl := r.Resolver, r.TTL
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	if ttl <= 0 {
+		ttl = DefaultNetResolverTTL
+	}
+	addrs, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, 0, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	return ips, ttl, nil
+}
+
+// DNSResolver implements Resolver by querying DNS servers directly for A and AAAA records. Unlike
+// NetResolver, DNSResolver honors the TTLs of the records it receives.
+//
+// The net package does not expose record TTLs, so this is a minimal DNS client. Queries are sent
+// over UDP and retried over TCP if the response is truncated. Each query carries a random ID and
+// responses are only accepted if they match both the ID and the question asked; other responses
+// received over UDP are discarded, making spoofed responses harder to inject.
+type DNSResolver struct {
+	// Servers holds the addresses (host:port) of the DNS servers to query, in order of preference.
+	// Servers are expected to support recursion.
+	Servers []string
+
+	// Timeout is the timeout applied to each query.
+	//
+	// Defaults to DefaultDNSTimeout.
+	Timeout time.Duration
+}
+
+// LookupIP implements the Resolver interface.
+func (r DNSResolver) LookupIP(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, 0, nil
+	}
+	if len(r.Servers) == 0 {
+		return nil, 0, errors.New("no DNS servers configured")
+	}
+	name, err := dnsmessage.NewName(strings.TrimSuffix(host, ".") + ".")
+	if err != nil {
+		return nil, 0, fmt.Errorf("bad host name: %w", err)
+	}
+
+	var lastErr error
+	for _, server := range r.Servers {
+		ips, ttl, err := r.lookupFrom(ctx, server, name)
+		if err != nil {
+			lastErr = fmt.Errorf("lookup using %s failed: %w", server, err)
+			continue
+		}
+		if len(ips) == 0 {
+			return nil, 0, fmt.Errorf("no addresses found for %s", host)
+		}
+		return ips, ttl, nil
+	}
+	return nil, 0, lastErr
+}
+
+// lookupFrom queries a single server for A and AAAA records. The TTL returned is the smallest of
+// the two queries.
+func (r DNSResolver) lookupFrom(ctx context.Context, server string, name dnsmessage.Name) ([]net.IP, time.Duration, error) {
+	var (
+		ips    []net.IP
+		minTTL time.Duration
+	)
+	for _, qType := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		qIPs, ttl, err := r.query(ctx, server, name, qType)
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(qIPs) > 0 && (len(ips) == 0 || ttl < minTTL) {
+			minTTL = ttl
+		}
+		ips = append(ips, qIPs...)
+	}
+	return ips, minTTL, nil
+}
+
+func (r DNSResolver) query(
+	ctx context.Context, server string, name dnsmessage.Name, qType dnsmessage.Type) ([]net.IP, time.Duration, error) {
+
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = DefaultDNSTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	idBytes := make([]byte, 2)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, 0, fmt.Errorf("failed to generate query ID: %w", err)
+	}
+	req := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: binary.BigEndian.Uint16(idBytes), RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: qType, Class: dnsmessage.ClassINET}},
+	}
+
+	resp, err := exchange(ctx, "udp", server, req)
+	if err == nil && resp.Header.Truncated {
+		resp, err = exchange(ctx, "tcp", server, req)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	switch resp.Header.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, 0, fmt.Errorf("no such host %s", strings.TrimSuffix(name.String(), "."))
+	default:
+		return nil, 0, fmt.Errorf("server responded with %v", resp.Header.RCode)
+	}
+
+	var (
+		ips    []net.IP
+		minTTL time.Duration
+	)
+	for i, answer := range resp.Answers {
+		ttl := time.Duration(answer.Header.TTL) * time.Second
+		if i == 0 || ttl < minTTL {
+			// This includes the TTLs of any CNAME records in the chain.
+			minTTL = ttl
+		}
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, net.IP(body.A[:]))
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, net.IP(body.AAAA[:]))
+		}
+	}
+	return ips, minTTL, nil
+}
+
+// exchange sends the query to the server and returns the response. Over UDP, responses which do
+// not match the query are discarded until a matching response arrives or the context expires.
+func exchange(
+	ctx context.Context, network, server string, query dnsmessage.Message) (*dnsmessage.Message, error) {
+
+	req, err := query.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("failed to pack query: %w", err)
+	}
+	conn, err := new(net.Dialer).DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	var respBuf []byte
+	if network == "tcp" {
+		// Messages over TCP are prefixed with their length.
+		prefixed := make([]byte, 2+len(req))
+		binary.BigEndian.PutUint16(prefixed, uint16(len(req)))
+		copy(prefixed[2:], req)
+		if _, err := conn.Write(prefixed); err != nil {
+			return nil, fmt.Errorf("failed to write query: %w", err)
+		}
+		lenBuf := make([]byte, 2)
+		if _, err := io.ReadFull(conn, lenBuf); err != nil {
+			return nil, fmt.Errorf("failed to read response: %w", err)
+		}
+		respBuf = make([]byte, binary.BigEndian.Uint16(lenBuf))
+		if _, err := io.ReadFull(conn, respBuf); err != nil {
+			return nil, fmt.Errorf("failed to read response: %w", err)
+		}
+		resp := new(dnsmessage.Message)
+		if err := resp.Unpack(respBuf); err != nil {
+			return nil, fmt.Errorf("failed to parse response: %w", err)
+		}
+		if !isResponseTo(query, *resp) {
+			return nil, errors.New("response does not match query")
+		}
+		return resp, nil
+	}
+
+	if _, err := conn.Write(req); err != nil {
+		return nil, fmt.Errorf("failed to write query: %w", err)
+	}
+	respBuf = make([]byte, maxUDPMessageSize)
+	for {
+		n, err := conn.Read(respBuf)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read response: %w", err)
+		}
+		resp := new(dnsmessage.Message)
+		if err := resp.Unpack(respBuf[:n]); err != nil || !isResponseTo(query, *resp) {
+			continue
+		}
+		return resp, nil
+	}
+}
+
+// isResponseTo reports whether resp is a response to query, carrying the same ID and question.
+func isResponseTo(query, resp dnsmessage.Message) bool {
+	if !resp.Header.Response || resp.Header.ID != query.Header.ID || len(resp.Questions) != 1 {
+		return false
+	}
+	q, rq := query.Questions[0], resp.Questions[0]
+	return rq.Type == q.Type && rq.Class == q.Class &&
+		strings.EqualFold(rq.Name.String(), q.Name.String())
+}
@@ -0,0 +1,233 @@
+package trafficlog
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsHandler answers a query received over the input network ("udp" or "tcp"). Each returned
+// message is sent in turn.
+type dnsHandler func(network string, req dnsmessage.Message) []dnsmessage.Message
+
+// serveDNS runs a DNS server which answers A and AAAA queries using the input records. Returns the
+// address of the server.
+func serveDNS(t *testing.T, a, aaaa []dnsmessage.Resource) string {
+	t.Helper()
+
+	return serveDNSWith(t, func(_ string, req dnsmessage.Message) []dnsmessage.Message {
+		return []dnsmessage.Message{answer(req, a, aaaa)}
+	})
+}
+
+// answer returns a response to req using the input records.
+func answer(req dnsmessage.Message, a, aaaa []dnsmessage.Resource) dnsmessage.Message {
+	resp := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: req.Header.ID, Response: true, RecursionAvailable: true},
+		Questions: req.Questions,
+	}
+	switch req.Questions[0].Type {
+	case dnsmessage.TypeA:
+		resp.Answers = append(resp.Answers, a...)
+	case dnsmessage.TypeAAAA:
+		resp.Answers = append(resp.Answers, aaaa...)
+	}
+	for i := range resp.Answers {
+		resp.Answers[i].Header.Name = req.Questions[0].Name
+		resp.Answers[i].Header.Class = dnsmessage.ClassINET
+	}
+	return resp
+}
+
+// serveDNSWith runs a DNS server on the same port over UDP and TCP, answering queries using the
+// handler. Returns the address of the server.
+func serveDNSWith(t *testing.T, h dnsHandler) string {
+	t.Helper()
+
+	var (
+		conn net.PacketConn
+		l    net.Listener
+		err  error
+	)
+	for attempt := 0; ; attempt++ {
+		conn, err = net.ListenPacket("udp", "127.0.0.1:0")
+		require.NoError(t, err)
+		if l, err = net.Listen("tcp", conn.LocalAddr().String()); err == nil {
+			break
+		}
+		conn.Close()
+		require.Less(t, attempt, 10, "failed to listen on the same port for UDP and TCP: %v", err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		l.Close()
+	})
+
+	go func() {
+		buf := make([]byte, maxUDPMessageSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var req dnsmessage.Message
+			if err := req.Unpack(buf[:n]); err != nil || len(req.Questions) != 1 {
+				continue
+			}
+			for _, resp := range h("udp", req) {
+				if packed, err := resp.Pack(); err == nil {
+					conn.WriteTo(packed, addr)
+				}
+			}
+		}
+	}()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				lenBuf := make([]byte, 2)
+				if _, err := io.ReadFull(c, lenBuf); err != nil {
+					return
+				}
+				reqBuf := make([]byte, binary.BigEndian.Uint16(lenBuf))
+				if _, err := io.ReadFull(c, reqBuf); err != nil {
+					return
+				}
+				var req dnsmessage.Message
+				if err := req.Unpack(reqBuf); err != nil || len(req.Questions) != 1 {
+					return
+				}
+				for _, resp := range h("tcp", req) {
+					packed, err := resp.Pack()
+					if err != nil {
+						return
+					}
+					binary.BigEndian.PutUint16(lenBuf, uint16(len(packed)))
+					c.Write(append(lenBuf, packed...))
+				}
+			}()
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func ipStrings(ips []net.IP) []string {
+	strs := []string{}
+	for _, ip := range ips {
+		strs = append(strs, ip.String())
+	}
+	return strs
+}
+
+func TestDNSResolver(t *testing.T) {
+	t.Parallel()
+
+	server := serveDNS(t,
+		[]dnsmessage.Resource{
+			{Header: dnsmessage.ResourceHeader{Type: dnsmessage.TypeA, TTL: 300}, Body: &dnsmessage.AResource{A: [4]byte{10, 0, 0, 1}}},
+			{Header: dnsmessage.ResourceHeader{Type: dnsmessage.TypeA, TTL: 60}, Body: &dnsmessage.AResource{A: [4]byte{10, 0, 0, 2}}},
+		},
+		[]dnsmessage.Resource{
+			{Header: dnsmessage.ResourceHeader{Type: dnsmessage.TypeAAAA, TTL: 120}, Body: &dnsmessage.AAAAResource{AAAA: [16]byte{0xfd, 15: 1}}},
+		},
+	)
+
+	r := DNSResolver{Servers: []string{server}, Timeout: time.Second}
+	ips, ttl, err := r.LookupIP(context.Background(), "example.com")
+	require.NoError(t, err)
+	require.Equal(t, 60*time.Second, ttl)
+	require.Equal(t, []string{"10.0.0.1", "10.0.0.2", "fd00::1"}, ipStrings(ips))
+
+	emptyServer := serveDNS(t, nil, nil)
+	r = DNSResolver{Servers: []string{emptyServer}, Timeout: time.Second}
+	_, _, err = r.LookupIP(context.Background(), "example.com")
+	require.Error(t, err)
+}
+
+func TestDNSResolverTruncated(t *testing.T) {
+	t.Parallel()
+
+	a := []dnsmessage.Resource{
+		{Header: dnsmessage.ResourceHeader{Type: dnsmessage.TypeA, TTL: 60}, Body: &dnsmessage.AResource{A: [4]byte{10, 0, 0, 1}}},
+	}
+	server := serveDNSWith(t, func(network string, req dnsmessage.Message) []dnsmessage.Message {
+		if network == "udp" {
+			resp := answer(req, nil, nil)
+			resp.Header.Truncated = true
+			return []dnsmessage.Message{resp}
+		}
+		return []dnsmessage.Message{answer(req, a, nil)}
+	})
+
+	r := DNSResolver{Servers: []string{server}, Timeout: time.Second}
+	ips, _, err := r.LookupIP(context.Background(), "example.com")
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.0.0.1"}, ipStrings(ips))
+}
+
+func TestDNSResolverMismatchedResponse(t *testing.T) {
+	t.Parallel()
+
+	var (
+		a = []dnsmessage.Resource{
+			{Header: dnsmessage.ResourceHeader{Type: dnsmessage.TypeA, TTL: 60}, Body: &dnsmessage.AResource{A: [4]byte{10, 0, 0, 1}}},
+		}
+		spoofedA = []dnsmessage.Resource{
+			{Header: dnsmessage.ResourceHeader{Type: dnsmessage.TypeA, TTL: 60}, Body: &dnsmessage.AResource{A: [4]byte{10, 6, 6, 6}}},
+		}
+		otherName = dnsmessage.MustNewName("other.example.com.")
+	)
+
+	// Responses with the wrong ID or question are sent ahead of the genuine response.
+	spoofed := func(req dnsmessage.Message) []dnsmessage.Message {
+		wrongID := answer(req, spoofedA, nil)
+		wrongID.Header.ID++
+		wrongName := answer(req, spoofedA, nil)
+		wrongName.Questions = []dnsmessage.Question{req.Questions[0]}
+		wrongName.Questions[0].Name = otherName
+		wrongType := answer(req, spoofedA, nil)
+		wrongType.Questions = []dnsmessage.Question{req.Questions[0]}
+		wrongType.Questions[0].Type = dnsmessage.TypeMX
+		return []dnsmessage.Message{wrongID, wrongName, wrongType}
+	}
+
+	server := serveDNSWith(t, func(_ string, req dnsmessage.Message) []dnsmessage.Message {
+		return append(spoofed(req), answer(req, a, nil))
+	})
+	r := DNSResolver{Servers: []string{server}, Timeout: time.Second}
+	ips, _, err := r.LookupIP(context.Background(), "example.com")
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.0.0.1"}, ipStrings(ips))
+
+	// Without a genuine response, the query times out.
+	server = serveDNSWith(t, func(_ string, req dnsmessage.Message) []dnsmessage.Message {
+		return spoofed(req)
+	})
+	r = DNSResolver{Servers: []string{server}, Timeout: 100 * time.Millisecond}
+	_, _, err = r.LookupIP(context.Background(), "example.com")
+	require.Error(t, err)
+
+	// Over TCP, a mismatched response is an error.
+	server = serveDNSWith(t, func(network string, req dnsmessage.Message) []dnsmessage.Message {
+		if network == "udp" {
+			resp := answer(req, nil, nil)
+			resp.Header.Truncated = true
+			return []dnsmessage.Message{resp}
+		}
+		return spoofed(req)[1:2]
+	})
+	r = DNSResolver{Servers: []string{server}, Timeout: time.Second}
+	_, _, err = r.LookupIP(context.Background(), "example.com")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "does not match")
+}
@@ -1,53 +1,112 @@
 package trafficlog
 
 import (
+	"errors"
+	"math"
+	"sort"
 	"sync"
+	"time"
 )
 
-type queueNode struct {
-	next  *queueNode
-	value interface{}
+// The initial capacity of an entryQueue.
+const minQueueCap = 16
+
+// The number of free entries a sharedRingBuffer keeps for reuse. Entries are usually freed one at a
+// time, as they are evicted from the front of the buffer's queues, so few are needed.
+const maxFreeEntries = 1024
+
+// entryQueue is a FIFO queue of *sharedEntrys. Entries are held in a circular slice, which grows by
+// doubling when full, so that entries may be enqueued without allocating once the queue has grown
+// to its working size. The zero value is an empty, ready-to-use queue.
+type entryQueue struct {
+	// The capacity of entries is always a power of two, or zero.
+	entries []*sharedEntry
+	head, n int
 }
 
-// A queue with FIFO semantics. The zero value is an empty, ready-to-use queue.
-type queue struct {
-	first, last *queueNode
+func (q *entryQueue) enqueue(e *sharedEntry) {
+	if q.n == len(q.entries) {
+		q.resize(2 * len(q.entries))
+	}
+	q.entries[(q.head+q.n)&(len(q.entries)-1)] = e
+	q.n++
 }
 
-func (q *queue) enqueue(i interface{}) {
-	if q.first == nil {
-		q.first = &queueNode{nil, i}
-		q.last = q.first
-		return
+// Returns nil if the queue is empty.
+func (q *entryQueue) dequeue() *sharedEntry {
+	if q.n == 0 {
+		return nil
 	}
-	prevLast := q.last
-	q.last = &queueNode{nil, i}
-	prevLast.next = q.last
+	e := q.entries[q.head]
+	q.entries[q.head] = nil
+	q.head = (q.head + 1) & (len(q.entries) - 1)
+	q.n--
+	return e
 }
 
 // Returns nil if the queue is empty.
-func (q *queue) dequeue() interface{} {
-	if q.first == nil {
+func (q *entryQueue) peek() *sharedEntry {
+	if q.n == 0 {
 		return nil
 	}
-	dequeued := q.first
-	q.first = dequeued.next
-	if q.first == nil {
-		q.last = nil
+	return q.entries[q.head]
+}
+
+// at returns the entry at the input index, counting from the front of the queue. The index must be
+// less than the length of the queue.
+func (q *entryQueue) at(i int) *sharedEntry {
+	return q.entries[(q.head+i)&(len(q.entries)-1)]
+}
+
+func (q *entryQueue) forEach(f func(*sharedEntry)) {
+	for i := 0; i < q.n; i++ {
+		f(q.entries[(q.head+i)&(len(q.entries)-1)])
+	}
+}
+
+// filter removes all entries for which keep returns false. If the queue is then mostly empty, its
+// capacity is reduced.
+func (q *entryQueue) filter(keep func(*sharedEntry) bool) {
+	kept := 0
+	for i := 0; i < q.n; i++ {
+		e := q.entries[(q.head+i)&(len(q.entries)-1)]
+		if keep(e) {
+			q.entries[(q.head+kept)&(len(q.entries)-1)] = e
+			kept++
+		}
+	}
+	for i := kept; i < q.n; i++ {
+		q.entries[(q.head+i)&(len(q.entries)-1)] = nil
+	}
+	q.n = kept
+	capacity := len(q.entries)
+	for q.n < capacity/4 && capacity > minQueueCap {
+		capacity /= 2
+	}
+	if capacity < len(q.entries) {
+		q.resize(capacity)
 	}
-	return dequeued.value
 }
 
-func (q *queue) forEach(f func(interface{})) {
-	current := q.first
-	for current != nil {
-		f(current.value)
-		current = current.next
+// resize the queue's circular slice to the input capacity, which must be a power of two and at
+// least the length of the queue. A capacity under minQueueCap is raised to minQueueCap.
+func (q *entryQueue) resize(capacity int) {
+	if capacity < minQueueCap {
+		capacity = minQueueCap
+	}
+	entries := make([]*sharedEntry, capacity)
+	for i := 0; i < q.n; i++ {
+		entries[i] = q.entries[(q.head+i)&(len(q.entries)-1)]
 	}
+	q.entries, q.head = entries, 0
+}
+
+func (q *entryQueue) len() int {
+	return q.n
 }
 
-func (q *queue) empty() bool {
-	return q.first == nil
+func (q *entryQueue) empty() bool {
+	return q.n == 0
 }
 
 type bufferItem interface {
@@ -60,155 +119,891 @@ type bufferItem interface {
 	onEvict()
 }
 
-type ringBuffer struct {
-	size, cap int
-	q         queue
+// packetItem is implemented by buffer items holding packets.
+type packetItem interface {
+	bufferItem
 
-	sync.Mutex
+	// captured returns the packet held by the item.
+	captured() capturedPacket
+}
+
+// timestamped is implemented by buffer items with a timestamp, such as the capture time of a
+// packet. Items without a timestamp are treated as having the latest possible timestamp.
+type timestamped interface {
+	// timestamp in nanoseconds since the Unix epoch.
+	timestamp() int64
+}
+
+// dataRef locates an item's data in an itemStore.
+type dataRef interface {
+	data() ([]byte, error)
+	len() int
+
+	// release is called once the item holding the reference has been evicted.
+	release()
+}
+
+// errEvicted is returned by dataRef.data when an evicted item's data has been overwritten. This may
+// happen to items held by readers (see sharedBufferHook.forEach).
+var errEvicted = errors.New("item evicted")
+
+// itemStore holds the data of packets put into a sharedRingBuffer, in place of the packets
+// themselves. A store is used with its buffer locked.
+type itemStore interface {
+	// store the packet's data and set the entry to hold the packet: either by setting the entry's
+	// item to a packet locating the data in the store, or by setting the entry's slab record. If
+	// saved is non-nil, the packet is held as a savedPacket would be. The store may evict or
+	// recharge other entries in the buffer to make room for the data. Returns false if the data
+	// cannot be stored, in which case the entry is left alone.
+	store(buf *sharedRingBuffer, entry *sharedEntry, pkt capturedPacket, saved *packetIDSet) bool
+}
+
+// ringBuffer is a sharedRingBuffer into which all items are put through a single hook.
+type ringBuffer struct {
+	*sharedRingBuffer
+	hook *sharedBufferHook
 }
 
 func newRingBuffer(cap int) *ringBuffer {
-	return &ringBuffer{0, cap, queue{}, sync.Mutex{}}
+	return newRingBufferWithLimits(cap, BufferLimits{})
+}
+
+func newRingBufferWithLimits(cap int, limits BufferLimits) *ringBuffer {
+	buf := newSharedRingBuffer(cap)
+	buf.limits = limits
+	return &ringBuffer{buf, buf.newHook()}
 }
 
 // put an item. As a special case, if the item size exceeds the buffer capacity, the buffer will be
 // cleared out and the new item will be the only item in the buffer.
 func (buf *ringBuffer) put(item bufferItem) {
-	buf.Lock()
-	defer buf.Unlock()
+	buf.hook.put(item)
+}
 
-	itemSize := item.size()
-	if itemSize > buf.cap {
-		for !buf.q.empty() {
-			buf.q.dequeue().(bufferItem).onEvict()
+// putPacket puts a packet as put does, held as a savedPacket if saved is non-nil. Unlike put, the
+// packet is not boxed as a bufferItem; see sharedRingBuffer.putPacket.
+func (buf *ringBuffer) putPacket(pkt capturedPacket, saved *packetIDSet) {
+	buf.hook.buf.putPacket(pkt, saved, *buf.hook.self)
+}
+
+// forEach applies the input function to each element currently in the buffer. The function is
+// applied to elements in order of insertion. As with sharedBufferHook.forEach, the buffer is not
+// locked while the function runs.
+func (buf *ringBuffer) forEach(do func(bufferItem)) {
+	buf.hook.forEach(do)
+}
+
+// sharedBufferHook is a handle on a sharedRingBuffer. Items put into the buffer using a hook are
+// visible only through that hook (and any other hooks they are shared with, see putShared).
+type sharedBufferHook struct {
+	buf *sharedRingBuffer
+
+	// The address or interface-wide capture entry for which items are put through the hook, if any.
+	// This is recorded with items held in a buffer file.
+	address string
+
+	// The set holding only this hook, shared by the entries put through the hook alone.
+	self *hookSet
+
+	// Entries evicted from the middle of q are left in place and skipped; see sharedRingBuffer.
+	q entryQueue
+
+	// size is the total size of the live items in q. Shared items count fully toward the size of
+	// each hook they are shared with.
+	size int
+
+	// The number of evicted entries remaining in q.
+	evicted int
+
+	closed bool
+}
+
+// put an item. As a special case, if the item size exceeds the buffer capacity, the buffer will be
+// cleared out and the new item will be the only item in the buffer.
+func (h *sharedBufferHook) put(item bufferItem) {
+	h.buf.putShared(item, *h.self)
+}
+
+// forEach applies a function to each existing item entered into the buffer using this hook. Items
+// are provided to the function in insertion order.
+//
+// The items are taken from a snapshot of the hook's queue, so the buffer is locked only while the
+// snapshot is taken. Items may be put into and evicted from the buffer while the function runs.
+// Items evicted in this time are released (see bufferItem.onEvict) only once forEach returns.
+func (h *sharedBufferHook) forEach(do func(bufferItem)) {
+	h.forEachSince(math.MinInt64, do)
+}
+
+// forEachSince is like forEach, but skips the items at the front of the hook's queue which, along
+// with every item put before them, have timestamps at or before since (see timestamped). The
+// skipped items are found by binary search, so the cost of forEachSince is proportional to the
+// number of items provided.
+//
+// Items are usually put in timestamp order, but this is not guaranteed, so items at or before
+// since may still be provided. The function should check the timestamps of the items it is given.
+func (h *sharedBufferHook) forEachSince(since int64, do func(bufferItem)) {
+	items, epoch := h.snapshot(since)
+	defer h.buf.endRead(epoch)
+	for _, item := range items {
+		do(item)
+	}
+}
+
+// snapshot returns the live items in the hook's queue, skipping items as described for
+// forEachSince. The caller must call endRead with the returned epoch once finished with the items.
+func (h *sharedBufferHook) snapshot(since int64) (items []bufferItem, epoch uint64) {
+	h.buf.Lock()
+	defer h.buf.Unlock()
+
+	first := sort.Search(h.q.len(), func(i int) bool { return h.q.at(i).latest > since })
+	items = make([]bufferItem, 0, h.q.len()-first)
+	for i := first; i < h.q.len(); i++ {
+		if entry := h.q.at(i); !entry.evicted {
+			items = append(items, entry.held())
 		}
-		buf.q.enqueue(item)
-		buf.size = itemSize
-		return
 	}
+	return items, h.buf.beginRead()
+}
+
+// close the hook, signaling that it will no longer be used.
+func (h *sharedBufferHook) close() {
+	h.buf.Lock()
+	h.closed = true
+	h.buf.track(h)
+	h.buf.Unlock()
+}
 
-	for buf.size+itemSize > buf.cap {
-		evicted := buf.q.dequeue().(bufferItem)
-		buf.size -= evicted.size()
-		evicted.onEvict()
+// Returns the oldest live entry in the hook's queue, or nil if there is none. Evicted entries at
+// the front of the queue are discarded. Should be called with the buffer locked.
+func (h *sharedBufferHook) oldest() *sharedEntry {
+	for !h.q.empty() {
+		entry := h.q.peek()
+		if !entry.evicted {
+			return entry
+		}
+		h.q.dequeue()
+		h.evicted--
+		h.buf.unref(entry)
 	}
-	buf.q.enqueue(item)
-	buf.size += item.size()
+	return nil
 }
 
-// forEach applies the input function to each element currently in the buffer. The function is
-// applied to elements in order of insertion. All other operations on this buffer will be blocked
-// while forEach is running.
-func (buf *ringBuffer) forEach(do func(bufferItem)) {
-	buf.Lock()
-	defer buf.Unlock()
+// Returns the space reserved for the hook. Closed hooks have no reservation. Should be called with
+// the buffer locked.
+func (h *sharedBufferHook) reserved() int {
+	if h.closed {
+		return 0
+	}
+	return h.buf.reserved
+}
 
-	buf.q.forEach(func(i interface{}) {
-		do(i.(bufferItem))
-	})
+// sharedEntry is an entry in a sharedRingBuffer's masterQueue. An item may be shared by several
+// hooks, in which case it appears in the queue of each, but is stored (and accounted for) once.
+//
+// There is an entry for each packet held in a buffer, so entries are kept small. Fields are ordered
+// to pack the entry into 64 bytes.
+type sharedEntry struct {
+	// The item held by the entry. For packets held in slab records (see slabStore), item is nil and
+	// the record is located by slab and offset instead, as boxing a locator for each packet would
+	// cost an allocation; see held.
+	item  bufferItem
+	hooks *hookSet
+	slab  *slab
+
+	// added is the time at which the entry was inserted, relative to the buffer's start time.
+	added time.Duration
+
+	// latest is the latest timestamp of the entry's item and of all items put into the buffer before
+	// it; see timestamped. This never decreases along a queue, so queues may be searched by time.
+	latest int64
+
+	// seq orders entries by insertion. Sequence numbers wrap around; see putBefore.
+	seq uint32
+
+	// size is the space charged for the entry. This is the size of the item, unless the item's data
+	// is held in a blockStore.
+	size   int32
+	offset int32
+
+	// refs counts the queues holding the entry. Once the entry has been evicted and removed from
+	// each of these queues, it may be reused for another item; see unref. An item is put through far
+	// fewer hooks than would overflow refs.
+	refs    int16
+	evicted bool
 }
 
-// This does not have an immediate effect on the size of the buffer. The buffer will grow or shrink
-// appropriately on the next put.
-func (buf *ringBuffer) updateCap(cap int) {
-	buf.Lock()
-	buf.cap = cap
-	buf.Unlock()
+// held returns the item held by the entry. Packets held in slab records are returned as
+// slabPackets. Should be called with the buffer locked.
+func (e *sharedEntry) held() bufferItem {
+	if e.slab != nil {
+		return e.slab.packet(int(e.offset))
+	}
+	return e.item
 }
 
-type sharedBufferHook struct {
-	// put an item. As a special case, if the item size exceeds the buffer capacity, the buffer will
-	// be cleared out and the new item will be the only item in the buffer.
-	put func(bufferItem)
+// live reports whether the entry is live and is still the entry with the input seq. Stores holding
+// entries past their eviction should check this, as evicted entries are reused.
+func (e *sharedEntry) live(seq uint32) bool {
+	return !e.evicted && e.seq == seq
+}
 
-	// forEach applies a function to each existing item entered into the buffer using this hook.
-	// Items are provided to the function in insertion order. This call blocks all calls on this and
-	// other hooks into the buffer.
-	forEach func(do func(bufferItem))
+// putBefore reports whether the entry was put into the buffer before the other entry. The entries
+// live in a buffer at any one time span far fewer than 2^31 puts, so this is unaffected by the
+// wrapping of sequence numbers.
+func (e *sharedEntry) putBefore(other *sharedEntry) bool {
+	return int32(e.seq-other.seq) < 0
+}
 
-	// close the hook, signaling that it will no longer be used.
-	close func()
+// Reports whether the entry may be evicted to make room for other hooks' items without taking space
+// reserved for any of the hooks holding it.
+func (e *sharedEntry) unreserved() bool {
+	for _, h := range *e.hooks {
+		if h.size <= h.reserved() {
+			return false
+		}
+	}
+	return true
 }
 
 type sharedRingBuffer struct {
 	size, cap int
-
-	// masterQueue is a queue of *queues. Entries point to queues tied to hooks. When an item is
-	// put into the ring using a hook, a pointer to that hook's queue is added to masterQueue. Thus,
-	// if the first entry in masterQueue points to someQueue, then someQueue holds the oldest item
-	// in the ring.
-	masterQueue *queue
+	quotas    BufferQuotas
+	limits    BufferLimits
+
+	// If non-nil, the data of packets put into the buffer is held in the store. This is a slabStore by
+	// default.
+	store itemStore
+
+	// The space reserved for each open hook, computed from quotas and cap.
+	reserved int
+
+	// masterQueue is a queue of *sharedEntrys, in insertion order. When an item is put into the
+	// ring, it is added to the queue of each hook it is put through, and a single entry pointing to
+	// these hooks is added to masterQueue. Each hook queue is thus a subsequence of masterQueue.
+	//
+	// Entries are usually evicted from the front of masterQueue. However, to keep within the
+	// buffer's quotas, an entry may be evicted from elsewhere. Such entries are marked as evicted
+	// and skipped until they reach the front of their queues. If evicted entries come to dominate a
+	// queue, the queue is compacted.
+	masterQueue entryQueue
+	evicted     int
+	nextSeq     uint32
+
+	// The set of hooks through which an item was last shared, which is likely to be shared again;
+	// see hookSetFor.
+	lastShared *hookSet
+
+	// free holds entries no longer held by any queue, for reuse. With entries and queues reused, a
+	// put into a buffer at its working size does not allocate.
+	free []*sharedEntry
+
+	// The latest timestamp of the items put into the buffer; see sharedEntry.latest.
+	latest int64
+
+	// hooks holds each hook with items in the buffer, along with each open hook. over holds the
+	// subset of these hooks holding more than their reservations; see track.
+	hooks, over map[*sharedBufferHook]bool
+
+	// Readers iterate over snapshots of the buffer without holding its lock (see
+	// sharedBufferHook.forEach). Each reader begins in a new epoch; readers counts the active
+	// readers by epoch. Items evicted while readers are active are queued in unreleased, along with
+	// the epoch at the time of eviction, until the readers which may hold them have finished.
+	epoch      uint64
+	readers    map[uint64]int
+	unreleased []unreleasedItem
+
+	// Entry ages are measured against the monotonic clock reading in start. now may be replaced in
+	// tests.
+	start time.Time
+	now   func() time.Time
 
 	sync.Mutex
 }
 
 func newSharedRingBuffer(cap int) *sharedRingBuffer {
-	return &sharedRingBuffer{0, cap, new(queue), sync.Mutex{}}
+	return newSharedRingBufferWithQuotas(cap, BufferQuotas{})
+}
+
+func newSharedRingBufferWithQuotas(cap int, quotas BufferQuotas) *sharedRingBuffer {
+	return &sharedRingBuffer{
+		cap:      cap,
+		quotas:   quotas,
+		reserved: quotas.Reserved.of(cap),
+		store:    newSlabStore(),
+		hooks:    map[*sharedBufferHook]bool{},
+		over:     map[*sharedBufferHook]bool{},
+		readers:  map[uint64]int{},
+		start:    time.Now(),
+		now:      time.Now,
+	}
 }
 
-// This does not have an immediate effect on the size of the buffer. The buffer will grow or shrink
-// appropriately on the next put.
-func (buf *sharedRingBuffer) updateCap(cap int) {
+// If the buffer shrinks, entries are evicted immediately to bring the buffer within its new
+// capacity, and within the maximum share of each hook. Returns the number of entries evicted and
+// the space they were charged.
+func (buf *sharedRingBuffer) updateCap(cap int) (evicted, evictedSize int) {
 	buf.Lock()
+	defer buf.Unlock()
+
 	buf.cap = cap
+	buf.updateReserved()
+	evict := func(entry *sharedEntry) {
+		evicted++
+		evictedSize += int(entry.size)
+		buf.evict(entry)
+	}
+	if maxShare := buf.quotas.MaxShare.of(buf.cap); maxShare > 0 {
+		for h := range buf.hooks {
+			for h.size > maxShare {
+				evict(h.oldest())
+			}
+		}
+	}
+	for buf.size > buf.cap {
+		evict(buf.victim())
+	}
+	if evicted > 0 {
+		// Evicted entries left in the queues are dropped, allowing the queues to shrink.
+		buf.evicted = 0
+		buf.masterQueue.filter(buf.keepLive)
+		for h := range buf.hooks {
+			h.evicted = 0
+			h.q.filter(buf.keepLive)
+		}
+	}
+	return evicted, evictedSize
+}
+
+// Unlike updateCap, this does not have an immediate effect. Quotas are enforced on subsequent puts.
+func (buf *sharedRingBuffer) updateQuotas(quotas BufferQuotas) {
+	buf.Lock()
+	buf.quotas = quotas
+	buf.updateReserved()
+	buf.Unlock()
+}
+
+// Limits on the age of entries are enforced immediately. Other limits are enforced on subsequent
+// puts.
+func (buf *sharedRingBuffer) updateLimits(limits BufferLimits) {
+	buf.Lock()
+	buf.limits = limits
+	buf.expire(buf.now())
 	buf.Unlock()
 }
 
+// Should be called with buf locked after a change to cap or quotas.
+func (buf *sharedRingBuffer) updateReserved() {
+	buf.reserved = buf.quotas.Reserved.of(buf.cap)
+	for h := range buf.hooks {
+		buf.track(h)
+	}
+}
+
 func (buf *sharedRingBuffer) newHook() *sharedBufferHook {
+	return buf.newHookFor("")
+}
+
+// newHookFor returns a new hook through which items are put for the input address.
+func (buf *sharedRingBuffer) newHookFor(address string) *sharedBufferHook {
+	h := &sharedBufferHook{buf: buf, address: address}
+	h.self = &hookSet{h}
+	buf.Lock()
+	buf.hooks[h] = true
+	buf.track(h)
+	buf.Unlock()
+	return h
+}
+
+// putShared puts a single item into the buffer using each of the input hooks, all of which must be
+// hooks into this buffer. The item is visible through each hook, but occupies space in the buffer
+// only once and is evicted only once. Closed hooks are ignored; if all hooks are closed, the item
+// is not put. As with put, if the item size exceeds the buffer capacity, the buffer will be
+// cleared out and the new item will be the only item in the buffer.
+//
+// Items are evicted according to the buffer's quotas. If putting the item would take one of its
+// hooks over its maximum share, the hook's oldest items are evicted first. If the buffer is then
+// still too full, the oldest items not within a hook's reservation are evicted. Only if all items
+// are within reservations are reserved items evicted, again oldest first.
+func (buf *sharedRingBuffer) putShared(item bufferItem, hooks []*sharedBufferHook) {
+	switch pkt := item.(type) {
+	case capturedPacket:
+		buf.putPacket(pkt, nil, hooks)
+		return
+	case savedPacket:
+		buf.putPacket(pkt.capturedPacket, pkt.saved, hooks)
+		return
+	}
+
 	buf.Lock()
 	defer buf.Unlock()
 
-	q := new(queue)
-	closed := false
+	latest := int64(math.MaxInt64)
+	if t, ok := item.(timestamped); ok {
+		latest = t.timestamp()
+	}
+	entry := buf.newEntryFor(hooks, latest)
+	if entry == nil {
+		return
+	}
+	entry.item, entry.size = item, int32(item.size())
+	buf.insert(entry)
+}
 
-	return &sharedBufferHook{
-		put: func(item bufferItem) {
-			buf.Lock()
-			defer buf.Unlock()
+// putPacket puts a packet into the buffer as putShared does. If saved is non-nil, the packet is
+// held as a savedPacket. If the buffer has a store, the packet's data is held by the store and the
+// packet's data buffer is returned to its pool.
+//
+// Packets should be put using putPacket rather than putShared, which boxes the packet as a
+// bufferItem. Putting a packet into a buffer with a slabStore does not then allocate, unless a new
+// slab is needed.
+func (buf *sharedRingBuffer) putPacket(
+	pkt capturedPacket, saved *packetIDSet, hooks []*sharedBufferHook) {
 
-			if closed {
-				return
-			}
+	buf.Lock()
+	defer buf.Unlock()
 
-			itemSize := item.size()
-			if itemSize > buf.cap {
-				for !buf.masterQueue.empty() {
-					evictingFrom := buf.masterQueue.dequeue().(*queue)
-					evictingFrom.dequeue().(bufferItem).onEvict()
+	entry := buf.newEntryFor(hooks, pkt.info.unixNano)
+	if entry == nil {
+		return
+	}
+	entry.size = int32(pkt.size())
+	if buf.store != nil && buf.store.store(buf, entry, pkt, saved) {
+		if pkt.dataBuf != nil {
+			pkt.dataPool.Put(pkt.dataBuf)
+		}
+	} else {
+		entry.item = bufferedPacket(pkt, saved)
+	}
+	buf.insert(entry)
+}
+
+// newEntryFor returns an entry for an item put through the input hooks, with the item's timestamp,
+// or math.MaxInt64 if the item is not timestamped. Returns nil if all of the hooks are closed.
+// Entries past the buffer's maximum age are evicted before the entry is returned. Should be called
+// with buf locked.
+func (buf *sharedRingBuffer) newEntryFor(hooks []*sharedBufferHook, timestamp int64) *sharedEntry {
+	set := buf.hookSetFor(hooks)
+	if set == nil {
+		return nil
+	}
+	now := buf.now()
+	entry := buf.newEntry()
+	entry.hooks, entry.seq, entry.added, entry.evicted = set, buf.nextSeq, now.Sub(buf.start), false
+	entry.latest = timestamp
+	if entry.latest < buf.latest {
+		entry.latest = buf.latest
+	}
+	buf.latest = entry.latest
+	entry.refs = int16(len(*set) + 1)
+	buf.nextSeq++
+
+	// Note: calling the eviction function in a new goroutine would avoid the possibility of blocking
+	// the put function. However, the overhead of spawning new goroutines proved too much to keep up
+	// with packet ingress.
+	buf.expire(now)
+	return entry
+}
+
+// insert a new entry, holding its item, into the queues of the buffer and of the entry's hooks.
+// Entries are evicted to make room for the new entry as described for putShared. Should be called
+// with buf locked.
+func (buf *sharedRingBuffer) insert(entry *sharedEntry) {
+	itemSize := int(entry.size)
+	if itemSize > buf.cap {
+		for entry := buf.oldest(); entry != nil; entry = buf.oldest() {
+			buf.evict(entry)
+		}
+	} else {
+		if maxShare := buf.quotas.MaxShare.of(buf.cap); maxShare > 0 {
+			for _, h := range *entry.hooks {
+				for h.size > 0 && h.size+itemSize > maxShare {
+					buf.evict(h.oldest())
 				}
-				q.enqueue(item)
-				buf.masterQueue.enqueue(q)
-				buf.size = itemSize
-				return
 			}
+		}
+		for buf.size+itemSize > buf.cap {
+			buf.evict(buf.victim())
+		}
+		if maxPackets := buf.limits.MaxPackets; maxPackets > 0 {
+			for buf.masterQueue.len()-buf.evicted >= maxPackets {
+				buf.evict(buf.victim())
+			}
+		}
+	}
+	for _, h := range *entry.hooks {
+		h.q.enqueue(entry)
+		h.size += itemSize
+		buf.track(h)
+	}
+	buf.masterQueue.enqueue(entry)
+	buf.size += itemSize
+}
+
+// hookSet is a set of hooks through which an item is put. Entries share hook sets, which are not
+// modified once made.
+type hookSet []*sharedBufferHook
+
+// hookSetFor returns the set of the open hooks among those input, or nil if all are closed. Each
+// hook holds the set of itself alone. Items are usually put through the same hooks as the last
+// item, so the last set made for several hooks is reused when it matches. Should be called with buf
+// locked.
+func (buf *sharedRingBuffer) hookSetFor(hooks []*sharedBufferHook) *hookSet {
+	var open []*sharedBufferHook
+	for i, h := range hooks {
+		if h.closed && open == nil {
+			open = append(make([]*sharedBufferHook, 0, len(hooks)), hooks[:i]...)
+		} else if !h.closed && open != nil {
+			open = append(open, h)
+		}
+	}
+	if open == nil {
+		open = hooks
+	}
+	switch {
+	case len(open) == 0:
+		return nil
+	case len(open) == 1:
+		return open[0].self
+	case buf.lastShared != nil && buf.lastShared.is(open):
+		return buf.lastShared
+	}
+	set := append(hookSet{}, open...)
+	buf.lastShared = &set
+	return &set
+}
+
+// is reports whether the set holds exactly the input hooks, in order.
+func (s hookSet) is(hooks []*sharedBufferHook) bool {
+	if len(s) != len(hooks) {
+		return false
+	}
+	for i := range s {
+		if s[i] != hooks[i] {
+			return false
+		}
+	}
+	return true
+}
 
-			for buf.size+itemSize > buf.cap {
-				// Note: calling the eviction function in a new goroutine would avoid the
-				// possibility of blocking the put function. However, the overhead of spawning new
-				// goroutines proved too much to keep up with packet ingress.
-				evictingFrom := buf.masterQueue.dequeue().(*queue)
-				evicted := evictingFrom.dequeue().(bufferItem)
-				buf.size -= evicted.size()
-				evicted.onEvict()
+// sweep evicts entries older than the buffer's maximum age. Returns the time at which sweep should
+// next be called, or the zero time if the buffer imposes no maximum age.
+func (buf *sharedRingBuffer) sweep() time.Time {
+	buf.Lock()
+	defer buf.Unlock()
+	return buf.expire(buf.now())
+}
+
+// Evicts entries older than the buffer's maximum age. Returns the time at which the oldest remaining
+// entry expires, or the time at which an entry inserted now would expire if the buffer is empty.
+// Returns the zero time if the buffer imposes no maximum age. Should be called with buf locked.
+func (buf *sharedRingBuffer) expire(now time.Time) time.Time {
+	maxAge := buf.limits.MaxAge
+	if maxAge <= 0 {
+		return time.Time{}
+	}
+	age := now.Sub(buf.start)
+	for entry := buf.oldest(); entry != nil; entry = buf.oldest() {
+		if age-entry.added < maxAge {
+			return buf.start.Add(entry.added + maxAge)
+		}
+		buf.evict(entry)
+	}
+	return now.Add(maxAge)
+}
+
+// Returns the oldest live entry in the buffer, or nil if there is none. Evicted entries at the
+// front of masterQueue are discarded. Should be called with buf locked.
+func (buf *sharedRingBuffer) oldest() *sharedEntry {
+	for !buf.masterQueue.empty() {
+		entry := buf.masterQueue.peek()
+		if !entry.evicted {
+			return entry
+		}
+		buf.masterQueue.dequeue()
+		buf.evicted--
+		buf.unref(entry)
+	}
+	return nil
+}
+
+// Chooses the next entry to evict to make room in the buffer. Should be called with buf locked and
+// only when the buffer holds live entries.
+func (buf *sharedRingBuffer) victim() *sharedEntry {
+	oldest := buf.oldest()
+	if oldest.unreserved() {
+		return oldest
+	}
+
+	// Any unreserved entry is at the front of the queue of each of its hooks, unless preceded there
+	// by a reserved entry. We look only at the fronts of the queues of hooks over their
+	// reservations. This may miss unreserved entries shared with hooks holding older, reserved
+	// entries, but costs time proportional only to the number of hooks over their reservations.
+	var candidate *sharedEntry
+	for h := range buf.over {
+		entry := h.oldest()
+		if entry.unreserved() && (candidate == nil || entry.putBefore(candidate)) {
+			candidate = entry
+		}
+	}
+	if candidate == nil {
+		// Reservations exceed the buffer's capacity.
+		return oldest
+	}
+	return candidate
+}
+
+// newEntry returns an entry for a new item, reusing a free entry if possible. Should be called with
+// buf locked.
+func (buf *sharedRingBuffer) newEntry() *sharedEntry {
+	n := len(buf.free)
+	if n == 0 {
+		return new(sharedEntry)
+	}
+	entry := buf.free[n-1]
+	buf.free[n-1] = nil
+	buf.free = buf.free[:n-1]
+	return entry
+}
+
+// unref drops a queue's reference to an evicted entry, freeing the entry for reuse once no queue
+// holds it. Should be called with buf locked.
+func (buf *sharedRingBuffer) unref(entry *sharedEntry) {
+	if entry.refs--; entry.refs > 0 || len(buf.free) >= maxFreeEntries {
+		return
+	}
+	entry.item, entry.hooks, entry.slab = nil, nil, nil
+	buf.free = append(buf.free, entry)
+}
+
+// keepLive reports whether an entry is live. It is used to filter evicted entries out of queues, so
+// the queue's reference to each evicted entry is dropped.
+func (buf *sharedRingBuffer) keepLive(entry *sharedEntry) bool {
+	if entry.evicted {
+		buf.unref(entry)
+		return false
+	}
+	return true
+}
+
+// Should be called with buf locked.
+func (buf *sharedRingBuffer) evict(entry *sharedEntry) {
+	// The entry may be freed once removed from its queues below.
+	item, sl, offset := entry.item, entry.slab, entry.offset
+	entry.evicted = true
+	itemSize := int(entry.size)
+	for _, h := range *entry.hooks {
+		h.size -= itemSize
+		h.evicted++
+		h.oldest()
+		if h.evicted > h.q.len()/2 {
+			h.evicted = 0
+			h.q.filter(buf.keepLive)
+		}
+		buf.track(h)
+	}
+	buf.size -= itemSize
+	buf.evicted++
+	buf.oldest()
+	if buf.evicted > buf.masterQueue.len()/2 {
+		buf.evicted = 0
+		buf.masterQueue.filter(buf.keepLive)
+	}
+	buf.release(item, sl, int(offset))
+}
+
+// unreleasedItem is an evicted item which may still be held by a reader.
+type unreleasedItem struct {
+	item  bufferItem
+	epoch uint64
+}
+
+// release an evicted item, unless it may be held by an active reader. In that case, the item is
+// released once the reader finishes. Packets held in slab records are located by sl and offset in
+// place of item. Should be called with buf locked.
+func (buf *sharedRingBuffer) release(item bufferItem, sl *slab, offset int) {
+	if len(buf.readers) == 0 {
+		if sl != nil {
+			sl.release(offset)
+			return
+		}
+		item.onEvict()
+		return
+	}
+	if sl != nil {
+		item = sl.packet(offset)
+	}
+	buf.unreleased = append(buf.unreleased, unreleasedItem{item, buf.epoch})
+}
+
+// beginRead registers a reader and returns the reader's epoch. Items evicted from this point are
+// not released until the reader calls endRead. Should be called with buf locked.
+func (buf *sharedRingBuffer) beginRead() uint64 {
+	buf.epoch++
+	buf.readers[buf.epoch]++
+	return buf.epoch
+}
+
+// endRead unregisters a reader and releases the evicted items no longer held by any reader.
+func (buf *sharedRingBuffer) endRead(epoch uint64) {
+	buf.Lock()
+	defer buf.Unlock()
+
+	if buf.readers[epoch]--; buf.readers[epoch] == 0 {
+		delete(buf.readers, epoch)
+	}
+	// Items evicted before the oldest active reader began are held by no reader.
+	oldest := buf.epoch + 1
+	for e := range buf.readers {
+		if e < oldest {
+			oldest = e
+		}
+	}
+	released := 0
+	for ; released < len(buf.unreleased) && buf.unreleased[released].epoch < oldest; released++ {
+		buf.unreleased[released].item.onEvict()
+	}
+	n := copy(buf.unreleased, buf.unreleased[released:])
+	for i := n; i < len(buf.unreleased); i++ {
+		buf.unreleased[i] = unreleasedItem{}
+	}
+	buf.unreleased = buf.unreleased[:n]
+}
+
+// recharge changes the space charged for a live entry. Should be called with buf locked.
+func (buf *sharedRingBuffer) recharge(entry *sharedEntry, size int) {
+	delta := size - int(entry.size)
+	entry.size = int32(size)
+	for _, h := range *entry.hooks {
+		h.size += delta
+		buf.track(h)
+	}
+	buf.size += delta
+}
+
+// status reports the live items in the buffer and, for each address with a hook into the buffer,
+// the live items put through the address's hooks.
+func (buf *sharedRingBuffer) status() BufferUsage {
+	buf.Lock()
+	defer buf.Unlock()
+
+	status := BufferUsage{
+		PacketUsage: queueUsage(&buf.masterQueue, buf.size, buf.evicted),
+		Cap:         buf.cap,
+	}
+	for h := range buf.hooks {
+		if h.address == "" {
+			continue
+		}
+		if status.Addresses == nil {
+			status.Addresses = map[string]PacketUsage{}
+		}
+		status.Addresses[h.address] = status.Addresses[h.address].add(
+			queueUsage(&h.q, h.size, h.evicted))
+	}
+	return status
+}
+
+// queueUsage reports the live entries in q, given their total size and the number of evicted
+// entries left in q. Should be called with the buffer locked.
+func queueUsage(q *entryQueue, size, evicted int) PacketUsage {
+	usage := PacketUsage{Packets: q.len() - evicted, Bytes: size}
+	if usage.Packets == 0 {
+		return usage
+	}
+	for i := 0; i < q.len(); i++ {
+		if e := q.at(i); !e.evicted {
+			usage.Oldest = timestampOf(e.held())
+			break
+		}
+	}
+	for i := q.len() - 1; i >= 0; i-- {
+		if e := q.at(i); !e.evicted {
+			usage.Newest = timestampOf(e.held())
+			break
+		}
+	}
+	return usage
+}
+
+// Returns the zero time for items which are not timestamped.
+func timestampOf(item bufferItem) time.Time {
+	if t, ok := item.(timestamped); ok {
+		return time.Unix(0, t.timestamp())
+	}
+	return time.Time{}
+}
+
+// track updates the buffer's indexes of its hooks. This should be called whenever the hook's size
+// or reservation changes. Should be called with buf locked.
+func (buf *sharedRingBuffer) track(h *sharedBufferHook) {
+	if h.size > h.reserved() {
+		buf.over[h] = true
+	} else {
+		delete(buf.over, h)
+	}
+	if h.closed && h.size == 0 {
+		delete(buf.hooks, h)
+	}
+}
+
+// bufferSweeper sweeps buffers as their entries expire, evicting entries older than the buffers'
+// maximum ages even when nothing is put into the buffers.
+type bufferSweeper struct {
+	bufs []*sharedRingBuffer
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+func startBufferSweeper(bufs ...*sharedRingBuffer) *bufferSweeper {
+	s := &bufferSweeper{bufs, make(chan struct{}, 1), make(chan struct{}), make(chan struct{})}
+	go s.run()
+	return s
+}
+
+func (s *bufferSweeper) run() {
+	defer close(s.done)
+	for {
+		var next time.Time
+		for _, buf := range s.bufs {
+			if t := buf.sweep(); !t.IsZero() && (next.IsZero() || t.Before(next)) {
+				next = t
 			}
-			q.enqueue(item)
-			buf.masterQueue.enqueue(q)
-			buf.size += itemSize
-		},
-
-		forEach: func(do func(bufferItem)) {
-			buf.Lock()
-			defer buf.Unlock()
-
-			q.forEach(func(i interface{}) {
-				do(i.(bufferItem))
-			})
-		},
-
-		close: func() {
-			buf.Lock()
-			closed = true
-			buf.Unlock()
-		},
+		}
+		// With no maximum age on any buffer, there is nothing to do until the limits change.
+		var (
+			timer   *time.Timer
+			expired <-chan time.Time
+		)
+		if !next.IsZero() {
+			timer = time.NewTimer(time.Until(next))
+			expired = timer.C
+		}
+		stopped := false
+		select {
+		case <-expired:
+		case <-s.wake:
+		case <-s.stop:
+			stopped = true
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if stopped {
+			return
+		}
 	}
 }
+
+// limitsChanged causes the buffers to be swept and the time of the next sweep to be recalculated.
+func (s *bufferSweeper) limitsChanged() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *bufferSweeper) close() {
+	close(s.stop)
+	<-s.done
+}
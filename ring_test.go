@@ -3,7 +3,9 @@ package trafficlog
 import (
 	"bytes"
 	"fmt"
+	"math"
 	"testing"
+	"time"
 
 	"github.com/oxtoacart/bpool"
 	"github.com/stretchr/testify/require"
@@ -37,6 +39,71 @@ func (ti *testItem) String() string {
 	return fmt.Sprintf("{value: %v, size: %d}", ti.value, ti.size())
 }
 
+func TestEntryQueue(t *testing.T) {
+	t.Parallel()
+
+	var (
+		q        entryQueue
+		expected []*sharedEntry
+	)
+	contents := func() []*sharedEntry {
+		entries := []*sharedEntry{}
+		q.forEach(func(e *sharedEntry) { entries = append(entries, e) })
+		return entries
+	}
+
+	// Entries wrap around the end of the queue's slice before it grows.
+	for i := 0; i < minQueueCap; i++ {
+		e := &sharedEntry{seq: uint32(i)}
+		q.enqueue(e)
+		expected = append(expected, e)
+	}
+	for i := 0; i < minQueueCap/2; i++ {
+		require.Equal(t, expected[0], q.dequeue())
+		expected = expected[1:]
+	}
+	for i := minQueueCap; i < 4*minQueueCap; i++ {
+		e := &sharedEntry{seq: uint32(i)}
+		q.enqueue(e)
+		expected = append(expected, e)
+	}
+	require.Equal(t, expected, contents())
+	require.Equal(t, expected[0], q.peek())
+	require.Equal(t, len(expected), q.len())
+
+	// The queue shrinks once mostly filtered out.
+	q.filter(func(e *sharedEntry) bool { return e.seq%8 == 0 })
+	kept := []*sharedEntry{}
+	for _, e := range expected {
+		if e.seq%8 == 0 {
+			kept = append(kept, e)
+		}
+	}
+	require.Equal(t, kept, contents())
+	require.Less(t, len(q.entries), 4*minQueueCap)
+
+	for range kept {
+		q.dequeue()
+	}
+	require.True(t, q.empty())
+	require.Nil(t, q.dequeue())
+	require.Nil(t, q.peek())
+}
+
+func TestSharedEntryPutBefore(t *testing.T) {
+	t.Parallel()
+
+	first, second := &sharedEntry{seq: 1}, &sharedEntry{seq: 2}
+	require.True(t, first.putBefore(second))
+	require.False(t, second.putBefore(first))
+	require.False(t, first.putBefore(first))
+
+	// Sequence numbers wrap around.
+	first.seq, second.seq = math.MaxUint32, 0
+	require.True(t, first.putBefore(second))
+	require.False(t, second.putBefore(first))
+}
+
 func TestSharedRingBufferPutAndEviction(t *testing.T) {
 	t.Parallel()
 
@@ -139,7 +206,15 @@ func TestSharedRingBufferResizing(t *testing.T) {
 		h.put(items[i])
 	}
 
-	rb.updateCap(5)
+	// Shrinking the buffer evicts items right away.
+	evicted, evictedSize := rb.updateCap(5)
+	require.Equal(t, 5, evicted)
+	require.Equal(t, 5, evictedSize)
+	for i := 0; i < 5; i++ {
+		require.True(t, *items[i].evicted)
+	}
+	requireHookEquals(t, items[5:], h)
+
 	newItem := newTestItem(10, 1)
 	items = append(items, newItem)
 	h.put(newItem)
@@ -160,6 +235,338 @@ func TestSharedRingBufferResizing(t *testing.T) {
 	requireHookEquals(t, newItems, h)
 }
 
+func TestSharedRingBufferPutShared(t *testing.T) {
+	t.Parallel()
+
+	rb := newSharedRingBuffer(3)
+	h1, h2, h3 := rb.newHook(), rb.newHook(), rb.newHook()
+	shared := newTestItem(1, 2)
+	rb.putShared(shared, []*sharedBufferHook{h1, h2})
+	requireHookEquals(t, []*testItem{shared}, h1)
+	requireHookEquals(t, []*testItem{shared}, h2)
+	requireHookEquals(t, []*testItem{}, h3)
+	require.Equal(t, 2, rb.size)
+
+	// The shared item is evicted once, from both hooks.
+	i3 := newTestItem(3, 2)
+	h3.put(i3)
+	require.True(t, *shared.evicted)
+	requireHookEquals(t, []*testItem{}, h1)
+	requireHookEquals(t, []*testItem{}, h2)
+	requireHookEquals(t, []*testItem{i3}, h3)
+	require.Equal(t, 2, rb.size)
+
+	// Closed hooks are ignored.
+	h1.close()
+	i4 := newTestItem(4, 1)
+	rb.putShared(i4, []*sharedBufferHook{h1, h2})
+	requireHookEquals(t, []*testItem{}, h1)
+	requireHookEquals(t, []*testItem{i4}, h2)
+	rb.putShared(newTestItem(5, 1), []*sharedBufferHook{h1})
+	require.Equal(t, 3, rb.size)
+}
+
+func TestSharedRingBufferReservations(t *testing.T) {
+	t.Parallel()
+
+	rb := newSharedRingBufferWithQuotas(10, BufferQuotas{Reserved: BufferQuota{Bytes: 3}})
+	quiet, chatty := rb.newHook(), rb.newHook()
+	quietItems := []*testItem{newTestItem(0, 1), newTestItem(1, 1), newTestItem(2, 1)}
+	for _, item := range quietItems {
+		quiet.put(item)
+	}
+	chattyItems := []*testItem{}
+	for i := 0; i < 100; i++ {
+		item := newTestItem(i, 1)
+		chatty.put(item)
+		chattyItems = append(chattyItems, item)
+	}
+	requireHookEquals(t, quietItems, quiet)
+	requireHookEquals(t, chattyItems[93:], chatty)
+	for _, item := range chattyItems[:93] {
+		require.True(t, *item.evicted)
+	}
+	require.Equal(t, 10, rb.size)
+	require.Equal(t, map[*sharedBufferHook]bool{chatty: true}, rb.over)
+
+	// Evicted entries skipped over in the master queue do not accumulate.
+	require.LessOrEqual(t, rb.masterQueue.len(), 2*rb.size)
+
+	// Items held beyond a reservation are evicted as usual.
+	quiet.put(newTestItem(3, 1))
+	requireHookEquals(t, append(quietItems, newTestItem(3, 1)), quiet)
+	quiet.put(newTestItem(4, 1))
+	requireHookEquals(t, []*testItem{
+		newTestItem(1, 1), newTestItem(2, 1), newTestItem(3, 1), newTestItem(4, 1),
+	}, quiet)
+	requireHookEquals(t, chattyItems[94:], chatty)
+
+	// Closed hooks lose their reservations.
+	quiet.close()
+	for i := 100; i < 110; i++ {
+		chatty.put(newTestItem(i, 1))
+	}
+	requireHookEquals(t, []*testItem{}, quiet)
+	require.True(t, *quietItems[1].evicted)
+	require.Equal(t, 10, rb.size)
+	require.Equal(t, map[*sharedBufferHook]bool{chatty: true}, rb.hooks)
+	require.Equal(t, map[*sharedBufferHook]bool{chatty: true}, rb.over)
+
+	// When reservations exceed the buffer's capacity, the oldest item is evicted.
+	rb.updateQuotas(BufferQuotas{Reserved: BufferQuota{Fraction: 1}})
+	require.Empty(t, rb.over)
+	other := rb.newHook()
+	other.put(newTestItem(200, 1))
+	requireHookEquals(t, []*testItem{newTestItem(200, 1)}, other)
+	requireHookEquals(t, []*testItem{
+		newTestItem(101, 1), newTestItem(102, 1), newTestItem(103, 1), newTestItem(104, 1),
+		newTestItem(105, 1), newTestItem(106, 1), newTestItem(107, 1), newTestItem(108, 1),
+		newTestItem(109, 1),
+	}, chatty)
+}
+
+func TestSharedRingBufferMaxShare(t *testing.T) {
+	t.Parallel()
+
+	rb := newSharedRingBufferWithQuotas(10, BufferQuotas{MaxShare: BufferQuota{Fraction: 0.4}})
+	h1, h2 := rb.newHook(), rb.newHook()
+	i1 := []*testItem{}
+	for i := 0; i < 10; i++ {
+		i1 = append(i1, newTestItem(i, 1))
+		h1.put(i1[i])
+	}
+	requireHookEquals(t, i1[6:], h1)
+	require.Equal(t, 4, rb.size)
+
+	// A shared item counts toward the share of each hook.
+	shared := newTestItem(10, 2)
+	rb.putShared(shared, []*sharedBufferHook{h1, h2})
+	requireHookEquals(t, []*testItem{i1[8], i1[9], shared}, h1)
+	requireHookEquals(t, []*testItem{shared}, h2)
+
+	i2 := []*testItem{newTestItem(11, 1), newTestItem(12, 1), newTestItem(13, 1)}
+	for _, item := range i2 {
+		h2.put(item)
+	}
+	require.True(t, *shared.evicted)
+	requireHookEquals(t, []*testItem{i1[8], i1[9]}, h1)
+	requireHookEquals(t, i2, h2)
+	require.Equal(t, 5, rb.size)
+
+	// Removing the quota allows a hook to fill the buffer.
+	rb.updateQuotas(BufferQuotas{})
+	for i := 0; i < 5; i++ {
+		h2.put(newTestItem(14+i, 1))
+	}
+	require.Equal(t, 10, rb.size)
+	requireHookEquals(t, []*testItem{i1[8], i1[9]}, h1)
+}
+
+func TestSharedRingBufferMaxPackets(t *testing.T) {
+	t.Parallel()
+
+	rb := newSharedRingBuffer(10)
+	rb.limits = BufferLimits{MaxPackets: 3}
+	h1, h2 := rb.newHook(), rb.newHook()
+	items := []*testItem{}
+	for i := 0; i < 5; i++ {
+		items = append(items, newTestItem(i, 1))
+		h1.put(items[i])
+	}
+	requireHookEquals(t, items[2:], h1)
+	require.True(t, *items[1].evicted)
+
+	// The limit applies to the buffer, not to each hook. A shared item counts once.
+	shared := newTestItem(5, 1)
+	rb.putShared(shared, []*sharedBufferHook{h1, h2})
+	requireHookEquals(t, []*testItem{items[3], items[4], shared}, h1)
+	requireHookEquals(t, []*testItem{shared}, h2)
+	require.Equal(t, 3, rb.size)
+}
+
+func TestSharedRingBufferMaxAge(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	rb := newSharedRingBuffer(10)
+	rb.limits = BufferLimits{MaxAge: time.Minute}
+	rb.start, rb.now = now, func() time.Time { return now }
+	h := rb.newHook()
+
+	items := []*testItem{}
+	for i := 0; i < 3; i++ {
+		items = append(items, newTestItem(i, 1))
+		h.put(items[i])
+		now = now.Add(20 * time.Second)
+	}
+	requireHookEquals(t, items, h)
+
+	// Expired items are evicted by a sweep, without waiting for the next put.
+	require.Equal(t, now.Add(20*time.Second), rb.sweep())
+	requireHookEquals(t, items[1:], h)
+	require.True(t, *items[0].evicted)
+	require.Equal(t, 2, rb.size)
+
+	// Expired items are also evicted on put.
+	now = now.Add(time.Minute)
+	h.put(newTestItem(3, 1))
+	requireHookEquals(t, []*testItem{newTestItem(3, 1)}, h)
+	require.Equal(t, 1, rb.size)
+
+	// An empty buffer is next swept once an item put now would expire.
+	now = now.Add(time.Minute)
+	require.Equal(t, now.Add(time.Minute), rb.sweep())
+	require.Zero(t, rb.size)
+
+	rb.updateLimits(BufferLimits{})
+	require.True(t, rb.sweep().IsZero())
+}
+
+func TestBufferSweeper(t *testing.T) {
+	t.Parallel()
+
+	const maxAge = 50 * time.Millisecond
+
+	captureBuffer, saveBuffer := newSharedRingBuffer(10), newRingBuffer(10)
+	s := startBufferSweeper(captureBuffer, saveBuffer.sharedRingBuffer)
+	defer s.close()
+
+	captureItem, saveItem := newTestItem(0, 1), newTestItem(1, 1)
+	captureBuffer.newHook().put(captureItem)
+	saveBuffer.put(saveItem)
+
+	// Items are not evicted until a maximum age is imposed.
+	time.Sleep(2 * maxAge)
+	require.False(t, *captureItem.evicted)
+	captureBuffer.updateLimits(BufferLimits{MaxAge: 10 * maxAge})
+	saveBuffer.updateLimits(BufferLimits{MaxAge: maxAge})
+	s.limitsChanged()
+
+	deadline := time.Now().Add(time.Second)
+	for !*saveItem.evicted && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.True(t, *saveItem.evicted)
+	require.Zero(t, saveBuffer.size)
+	require.False(t, *captureItem.evicted)
+}
+
+func TestSharedRingBufferSnapshot(t *testing.T) {
+	t.Parallel()
+
+	rb := newSharedRingBuffer(4)
+	h1, h2 := rb.newHook(), rb.newHook()
+	items := []*testItem{}
+	for i := 0; i < 4; i++ {
+		items = append(items, newTestItem(i, 1))
+		h1.put(items[i])
+	}
+
+	// The buffer is not locked while iterating, so items can be put meanwhile. Items evicted by these
+	// puts are still provided by forEach and are not released until it returns.
+	visited, outer := []*testItem{}, 0
+	h1.forEach(func(i bufferItem) {
+		visited = append(visited, i.(*testItem))
+		if outer++; outer == 1 {
+			h2.put(newTestItem(4, 1))
+			h2.put(newTestItem(5, 1))
+			h1.forEach(func(bufferItem) {})
+			for _, item := range items {
+				require.False(t, *item.evicted)
+			}
+		}
+	})
+	require.Equal(t, items, visited)
+	require.True(t, *items[0].evicted)
+	require.True(t, *items[1].evicted)
+	require.False(t, *items[2].evicted)
+	requireHookEquals(t, items[2:], h1)
+	require.Empty(t, rb.readers)
+	require.Empty(t, rb.unreleased)
+}
+
+func TestSharedRingBufferForEachSince(t *testing.T) {
+	t.Parallel()
+
+	pool := bpool.NewBufferPool(dataPoolSize)
+	rb := newSharedRingBuffer(1024 * 1024)
+	h1, h2 := rb.newHook(), rb.newHook()
+	put := func(h *sharedBufferHook, id uint64, ts int64) {
+		pkt := newTestPacket(pool, id, []byte{byte(id)})
+		pkt.info.unixNano = ts
+		h.put(pkt)
+	}
+	for i := 0; i < 100; i++ {
+		put(h1, uint64(i), int64(i*10))
+		// Packets may be put out of timestamp order.
+		if i == 80 {
+			put(h1, 1000, 5)
+		}
+		put(h2, uint64(2000+i), int64(i*10+5))
+	}
+	ids := func(h *sharedBufferHook, since int64) []uint64 {
+		ids := []uint64{}
+		h.forEachSince(since, func(item bufferItem) {
+			ids = append(ids, item.(packetItem).captured().id)
+		})
+		return ids
+	}
+
+	// Packets with timestamps after since are provided, along with any put after them.
+	expected := []uint64{}
+	for i := 51; i < 100; i++ {
+		if expected = append(expected, uint64(i)); i == 80 {
+			expected = append(expected, 1000)
+		}
+	}
+	require.Equal(t, expected, ids(h1, 500))
+	require.Len(t, ids(h2, 500), 50)
+	require.Len(t, ids(h1, math.MinInt64), 101)
+	require.Empty(t, ids(h1, 990))
+}
+
+func TestSharedRingBufferStatus(t *testing.T) {
+	t.Parallel()
+
+	pool := bpool.NewBufferPool(dataPoolSize)
+	rb := newSharedRingBuffer(1024 * 1024)
+	a1, a2, b, unaddressed := rb.newHookFor("a"), rb.newHookFor("a"), rb.newHookFor("b"), rb.newHook()
+	put := func(h *sharedBufferHook, ts int64) {
+		pkt := newTestPacket(pool, uint64(ts), []byte{byte(ts)})
+		pkt.info.unixNano = ts
+		h.put(pkt)
+	}
+	put(a1, 10)
+	put(b, 20)
+	put(a2, 30)
+	put(unaddressed, 40)
+	put(b, 50)
+
+	// The newest entry is evicted, leaving it at the end of the queues.
+	rb.Lock()
+	rb.evict(rb.masterQueue.at(4))
+	rb.Unlock()
+
+	size := int(rb.masterQueue.at(0).size)
+	status := rb.status()
+	require.Equal(t, PacketUsage{4, 4 * size, time.Unix(0, 10), time.Unix(0, 40)}, status.PacketUsage)
+	require.Equal(t, 1024*1024, status.Cap)
+	require.Equal(t, map[string]PacketUsage{
+		"a": {2, 2 * size, time.Unix(0, 10), time.Unix(0, 30)},
+		"b": {1, size, time.Unix(0, 20), time.Unix(0, 20)},
+	}, status.Addresses)
+}
+
+func TestBufferQuota(t *testing.T) {
+	t.Parallel()
+
+	require.Equal(t, 0, BufferQuota{}.of(100))
+	require.Equal(t, 10, BufferQuota{Bytes: 10}.of(100))
+	require.Equal(t, 25, BufferQuota{Fraction: 0.25}.of(100))
+	require.Equal(t, 25, BufferQuota{Bytes: 10, Fraction: 0.25}.of(100))
+	require.Equal(t, 50, BufferQuota{Bytes: 50, Fraction: 0.25}.of(100))
+}
+
 func requireHookEquals(t *testing.T, expected []*testItem, h *sharedBufferHook) {
 	t.Helper()
 
@@ -223,3 +630,73 @@ func BenchmarkSharedRingBuffer(b *testing.B) {
 		hook.put(newItems[i])
 	}
 }
+
+// BenchmarkSharedRingBufferHooks measures puts of captured packets into a full buffer with many
+// hooks, as made by an interfaceCapture: each packet is copied into a buffer from the capture pool,
+// put through one of the hooks or shared by all of them, and held by the buffer's slabStore. Once
+// the buffer is at its working size, puts should not allocate.
+func BenchmarkSharedRingBufferHooks(b *testing.B) {
+	const (
+		bufferSize = 1024 * 1024
+		packetLen  = 60
+	)
+
+	data := make([]byte, packetLen)
+	for _, numHooks := range []int{1, 16, 256} {
+		for _, shared := range []bool{false, true} {
+			numHooks, shared := numHooks, shared
+			b.Run(fmt.Sprintf("hooks=%d/shared=%t", numHooks, shared), func(b *testing.B) {
+				pool := bpool.NewBufferPool(dataPoolSize)
+				rb := newSharedRingBuffer(bufferSize)
+				hooks := make([]*sharedBufferHook, numHooks)
+				for i := range hooks {
+					hooks[i] = rb.newHook()
+				}
+				put := func(i int) {
+					dataBuf := pool.Get()
+					dataBuf.Write(data)
+					info := captureInfo{unixNano: int64(i), captureLength: packetLen, length: packetLen}
+					pkt := capturedPacket{uint64(i), info, dataBuf, pool, nil}
+					if shared {
+						rb.putPacket(pkt, nil, hooks)
+					} else {
+						rb.putPacket(pkt, nil, hooks[i%numHooks:i%numHooks+1])
+					}
+				}
+				for i := 0; i < 2*bufferSize/packetLen; i++ {
+					put(i)
+				}
+				b.ReportAllocs()
+				b.ResetTimer()
+
+				for i := 0; i < b.N; i++ {
+					put(i)
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkForEachSince measures iteration over the latest packets in a large buffer, as in a call
+// to SaveCaptures with a short period.
+func BenchmarkForEachSince(b *testing.B) {
+	const packets = 100000
+
+	pool := bpool.NewBufferPool(dataPoolSize)
+	rb := newSharedRingBuffer(math.MaxInt32)
+	h := rb.newHook()
+	for i := 0; i < packets; i++ {
+		pkt := newTestPacket(pool, uint64(i), make([]byte, 60))
+		pkt.info.unixNano = int64(i)
+		h.put(pkt)
+	}
+
+	for _, window := range []int{100, packets} {
+		since := int64(packets - window - 1)
+		b.Run(fmt.Sprintf("window=%d", window), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				h.forEachSince(since, func(bufferItem) {})
+			}
+		})
+	}
+}
@@ -1,17 +1,180 @@
 package trafficlog
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
+	"sync"
 	"time"
 )
 
-const routeCheckInterval = time.Second
+const (
+	// routeCheckInterval is the interval at which routes are polled when change notifications are
+	// not available.
+	routeCheckInterval = time.Second
+
+	// Route changes tend to be signaled in bursts. After a change notification, we wait this long
+	// for things to settle before re-evaluating routes.
+	routeChangeSettleTime = 50 * time.Millisecond
+
+	// Bounds on the interval at which hosts are re-resolved. Within these bounds, hosts are
+	// re-resolved as their DNS records expire.
+	minResolveInterval = time.Second
+	maxResolveInterval = 10 * time.Minute
+
+	// resolveTimeout is the time allowed for a single resolution of a host.
+	resolveTimeout = 10 * time.Second
+
+	// Bounds on the interval at which failed resolutions or interface lookups are retried. The
+	// retry interval doubles with each consecutive failure.
+	minRouteRetryInterval = time.Second
+	maxRouteRetryInterval = time.Minute
+)
+
+// DefaultIPGracePeriod is the default period for which a traffic log continues to capture traffic
+// for an IP after its host stops resolving to that IP.
+const DefaultIPGracePeriod = 5 * time.Minute
+
+// routeChangeNotifier signals changes to the system's routes, links, or addresses. Signals carry
+// no information about the change; recipients should re-evaluate any routes of interest.
+type routeChangeNotifier interface {
+	// changes returns a channel on which changes are signaled. Multiple changes may be coalesced
+	// into a single signal.
+	changes() <-chan struct{}
+
+	// failures returns a channel on which an error is sent if the notifier fails. No changes are
+	// signaled after a failure, so recipients should fall back to polling.
+	failures() <-chan error
+
+	close()
+}
+
+// routeChangeBroadcaster shares a single routeChangeNotifier among any number of route watchers,
+// fanning its signals out to each. The notifier is opened with the first subscription and closed
+// once all subscriptions have been closed.
+type routeChangeBroadcaster struct {
+	newNotifier func() (routeChangeNotifier, error)
+
+	// Set while there are subscribers. Closing done stops the routine fanning out signals.
+	notifier    routeChangeNotifier
+	done        chan struct{}
+	subscribers map[*routeChangeSubscription]bool
+
+	sync.Mutex
+}
+
+func newRouteChangeBroadcaster(
+	newNotifier func() (routeChangeNotifier, error)) *routeChangeBroadcaster {
+
+	return &routeChangeBroadcaster{
+		newNotifier: newNotifier,
+		subscribers: map[*routeChangeSubscription]bool{},
+	}
+}
+
+// subscribe returns a notifier receiving each signal of the shared notifier. Closing the returned
+// notifier ends the subscription.
+func (b *routeChangeBroadcaster) subscribe() (routeChangeNotifier, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.notifier == nil {
+		n, err := b.newNotifier()
+		if err != nil {
+			return nil, err
+		}
+		b.notifier, b.done = n, make(chan struct{})
+		go b.fanOut(n, b.done)
+	}
+	s := &routeChangeSubscription{b: b, c: make(chan struct{}, 1), failed: make(chan error, 1)}
+	b.subscribers[s] = true
+	return s, nil
+}
+
+func (b *routeChangeBroadcaster) fanOut(n routeChangeNotifier, done chan struct{}) {
+	for {
+		select {
+		case <-n.changes():
+			b.Lock()
+			for s := range b.subscribers {
+				s.signal()
+			}
+			b.Unlock()
+		case err := <-n.failures():
+			// The failed notifier is dropped, along with its subscribers, so that later
+			// subscriptions open a new notifier.
+			b.Lock()
+			if b.notifier == n {
+				for s := range b.subscribers {
+					s.fail(err)
+				}
+				b.subscribers = map[*routeChangeSubscription]bool{}
+				b.notifier, b.done = nil, nil
+				n.close()
+			}
+			b.Unlock()
+			return
+		case <-done:
+			return
+		}
+	}
+}
+
+func (b *routeChangeBroadcaster) unsubscribe(s *routeChangeSubscription) {
+	b.Lock()
+	defer b.Unlock()
+
+	delete(b.subscribers, s)
+	if len(b.subscribers) == 0 && b.notifier != nil {
+		close(b.done)
+		b.notifier.close()
+		b.notifier, b.done = nil, nil
+	}
+}
+
+// routeChangeSubscription implements routeChangeNotifier for a subscriber to a
+// routeChangeBroadcaster.
+type routeChangeSubscription struct {
+	b         *routeChangeBroadcaster
+	c         chan struct{}
+	failed    chan error
+	closeOnce sync.Once
+}
+
+func (s *routeChangeSubscription) signal() {
+	select {
+	case s.c <- struct{}{}:
+	default:
+	}
+}
+
+func (s *routeChangeSubscription) fail(err error) {
+	select {
+	case s.failed <- err:
+	default:
+	}
+}
+
+func (s *routeChangeSubscription) changes() <-chan struct{} {
+	return s.c
+}
+
+func (s *routeChangeSubscription) failures() <-chan error {
+	return s.failed
+}
+
+func (s *routeChangeSubscription) close() {
+	s.closeOnce.Do(func() { s.b.unsubscribe(s) })
+}
 
 type routeUpdate struct {
 	ip    net.IP
 	iface networkInterface
+
+	// expired is set when the host no longer resolves to this IP and the grace period for the IP
+	// has elapsed. Traffic to and from the IP should no longer be captured.
+	expired bool
 }
 
 // routeWatcher watches for changes to routes used to connect to a host.
@@ -21,30 +184,144 @@ type routeWatcher struct {
 	stopChan    chan struct{}
 }
 
-func newRouteWatcher(host string) (*routeWatcher, error) {
-	// There are more sophisticated ways to watch for route changes, but this will do for our needs.
-	getRouteUpdates := func() ([]routeUpdate, error) {
-		remoteIPs, err := net.LookupIP(host)
+// newRouteWatcher watches routes to the input host, which should be the host of addr. The host is
+// re-resolved as its DNS records expire. IPs the host no longer resolves to are reported as expired
+// once the grace period has elapsed.
+//
+// Where available, the watcher re-evaluates routes in response to notifications of system route
+// changes, received through a subscription to routeChanges. Otherwise, routes are polled. If the
+// notifications fail, the failure is reported on the errors channel and routes are polled from then
+// on.
+//
+// Failures to resolve the host or find interfaces are reported as ErrorRoute values on the errors
+// channel and retried with backoff. Once a failing phase succeeds again, an ErrorRouteRecovered is
+// reported.
+func newRouteWatcher(
+	addr, host string, r Resolver, gracePeriod time.Duration,
+	routeChanges *routeChangeBroadcaster) (*routeWatcher, error) {
+
+	notifier, err := routeChanges.subscribe()
+	if err != nil {
+		// Fall back to polling.
+		return startRouteWatcher(addr, host, r, gracePeriod, nil)
+	}
+	rw, err := startRouteWatcher(addr, host, r, gracePeriod, notifier)
+	if err != nil {
+		notifier.close()
+	}
+	return rw, err
+}
+
+// resolvedIP is an IP to which a watched host has resolved.
+type resolvedIP struct {
+	ip        net.IP
+	expiresAt time.Time
+}
+
+// startRouteWatcher starts a routeWatcher. The notifier may be nil, in which case routes are
+// polled. If non-nil, the notifier will be closed with the route watcher.
+func startRouteWatcher(
+	addr, host string, r Resolver, gracePeriod time.Duration,
+	notifier routeChangeNotifier) (*routeWatcher, error) {
+
+	// Maps IP strings to IPs currently being watched.
+	watched := map[string]resolvedIP{}
+
+	// If the host is an IP literal, there is nothing to re-resolve.
+	literal := net.ParseIP(host) != nil
+
+	// Set while the host cannot be resolved. IPs are not expired during this time as we do not
+	// know whether the host still resolves to them.
+	resolveFailing := false
+
+	// Resolves the host and updates the set of watched IPs. Returns the time until the host should
+	// next be resolved.
+	resolve := func() (time.Duration, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+		defer cancel()
+		remoteIPs, ttl, err := r.LookupIP(ctx, host)
+		if err == nil && len(remoteIPs) == 0 {
+			err = errors.New("failed to resolve host")
+		}
 		if err != nil {
-			return nil, fmt.Errorf("failed to find IP for host: %w", err)
+			resolveFailing = true
+			return 0, err
 		}
-		if len(remoteIPs) == 0 {
-			return nil, errors.New("failed to resolve host")
+		resolveFailing = false
+		if ttl < minResolveInterval {
+			ttl = minResolveInterval
 		}
-		updates := make([]routeUpdate, len(remoteIPs))
-		for i, rip := range remoteIPs {
-			iface, err := networkInterfaceFor(rip)
-			if err != nil {
-				return nil, fmt.Errorf("failed to find interface: %w", err)
+		if ttl > maxResolveInterval {
+			ttl = maxResolveInterval
+		}
+		expiresAt := time.Now().Add(ttl + gracePeriod)
+		for _, ip := range remoteIPs {
+			watched[ip.String()] = resolvedIP{ip, expiresAt}
+		}
+		return ttl, nil
+	}
+
+	// Evaluates routes for all watched IPs. IPs past their expiration are removed from the watched
+	// set and reported as expired. If the route to an IP cannot be determined, no update is
+	// provided for that IP and an error is returned with the updates for the other IPs.
+	getRouteUpdates := func() (updates []routeUpdate, err error) {
+		updates = make([]routeUpdate, 0, len(watched))
+		now := time.Now()
+		for ipStr, rip := range watched {
+			if !literal && !resolveFailing && now.After(rip.expiresAt) {
+				delete(watched, ipStr)
+				updates = append(updates, routeUpdate{ip: rip.ip, expired: true})
+				continue
+			}
+			iface, ifaceErr := networkInterfaceFor(rip.ip)
+			if ifaceErr != nil {
+				err = ifaceErr
+				continue
 			}
-			updates[i] = routeUpdate{rip, *iface}
+			updates = append(updates, routeUpdate{ip: rip.ip, iface: *iface})
 		}
-		return updates, nil
+		return updates, err
 	}
 
+	// Returns the time until the next watched IP expires.
+	nextExpiration := func() time.Duration {
+		next := maxResolveInterval + gracePeriod
+		if resolveFailing {
+			return next
+		}
+		for _, rip := range watched {
+			if untilExpiry := time.Until(rip.expiresAt); untilExpiry < next {
+				next = untilExpiry
+			}
+		}
+		if next < 0 {
+			return 0
+		}
+		return next
+	}
+
+	// If the first attempt fails, there's probably something wrong - fail fast.
+	nextResolve, err := resolve()
+	if err != nil {
+		return nil, ErrorRoute{addr, host, RoutePhaseResolve, err}
+	}
 	updates, err := getRouteUpdates()
 	if err != nil {
-		return nil, err
+		return nil, ErrorRoute{addr, host, RoutePhaseInterface, err}
+	}
+
+	var (
+		changes  <-chan struct{}
+		failures <-chan error
+	)
+	if notifier != nil {
+		changes, failures = notifier.changes(), notifier.failures()
+	}
+	var pollTicker *time.Ticker
+	var poll <-chan time.Time
+	if notifier == nil {
+		pollTicker = time.NewTicker(routeCheckInterval)
+		poll = pollTicker.C
 	}
 
 	w := routeWatcher{
@@ -53,30 +330,144 @@ func newRouteWatcher(host string) (*routeWatcher, error) {
 		make(chan struct{}),
 	}
 	go func() {
-		timer := time.NewTimer(routeCheckInterval)
-		for {
+		var (
+			resolveBackoff, ifaceBackoff routeBackoff
+
+			// Failures and recoveries to be output.
+			events []error
+
+			resolveTimer = time.NewTimer(nextResolve)
+			expiryTimer  = time.NewTimer(nextExpiration())
+
+			// Fires when routes should be re-evaluated after a failure to find an interface.
+			ifaceRetryTimer = time.NewTimer(0)
+		)
+		stopTimer(ifaceRetryTimer)
+		if literal {
+			stopTimer(resolveTimer)
+		}
+
+		// Records the outcome of an attempt to resolve the host or to find interfaces. Returns the
+		// time until the next attempt should be made if the attempt failed.
+		record := func(b *routeBackoff, phase RoutePhase, err error) time.Duration {
 			if err != nil {
-				w.sendError(fmt.Errorf("failed to update route for %s: %w", host, err))
+				events = append(events, ErrorRoute{addr, host, phase, err})
+				return b.failed()
+			}
+			if b.recovered() {
+				events = append(events, ErrorRouteRecovered{addr, host, phase})
 			}
+			return 0
+		}
+
+		for {
+			for _, e := range events {
+				w.sendError(e)
+			}
+			events = events[:0]
 			for _, u := range updates {
 				w.sendUpdate(u)
 			}
+			if !literal {
+				stopTimer(expiryTimer)
+				expiryTimer.Reset(nextExpiration())
+			}
 
+			var (
+				reevaluate bool
+				resolveErr error
+			)
 			select {
-			case <-timer.C:
-				updates, err = getRouteUpdates()
-				timer.Reset(routeCheckInterval)
+			case <-resolveTimer.C:
+				nextResolve, resolveErr = resolve()
+				if retryAfter := record(&resolveBackoff, RoutePhaseResolve, resolveErr); resolveErr != nil {
+					nextResolve = retryAfter
+				}
+				resolveTimer.Reset(nextResolve)
+				reevaluate = true
+			case <-expiryTimer.C:
+				reevaluate = true
+			case <-ifaceRetryTimer.C:
+				reevaluate = true
+			case <-poll:
+				reevaluate = true
+			case <-changes:
+				settle := time.NewTimer(routeChangeSettleTime)
+				select {
+				case <-settle.C:
+				case <-w.stopChan:
+					settle.Stop()
+				}
+				reevaluate = true
+			case err := <-failures:
+				// Route changes are no longer signaled, so we poll instead.
+				events = append(events, fmt.Errorf(
+					"route change notifications failed; polling routes for %s: %w", addr, err))
+				changes, failures = nil, nil
+				pollTicker = time.NewTicker(routeCheckInterval)
+				poll = pollTicker.C
+				reevaluate = true
 			case <-w.stopChan:
-				timer.Stop()
+				stopTimer(resolveTimer)
+				stopTimer(expiryTimer)
+				stopTimer(ifaceRetryTimer)
+				if pollTicker != nil {
+					pollTicker.Stop()
+				}
+				if notifier != nil {
+					notifier.close()
+				}
 				close(w.updatesChan)
 				close(w.errorChan)
 				return
 			}
+			if reevaluate {
+				updates, err = getRouteUpdates()
+				stopTimer(ifaceRetryTimer)
+				if retryAfter := record(&ifaceBackoff, RoutePhaseInterface, err); err != nil {
+					ifaceRetryTimer.Reset(retryAfter)
+				}
+			}
 		}
 	}()
 	return &w, nil
 }
 
+// routeBackoff tracks consecutive failures in some phase of route watching.
+type routeBackoff struct {
+	failures int
+}
+
+// failed records a failure and returns the time to wait before retrying.
+func (b *routeBackoff) failed() time.Duration {
+	b.failures++
+	wait := minRouteRetryInterval
+	for i := 1; i < b.failures && wait < maxRouteRetryInterval; i++ {
+		wait *= 2
+	}
+	if wait > maxRouteRetryInterval {
+		wait = maxRouteRetryInterval
+	}
+	return wait
+}
+
+// recovered records a success and reports whether this ends a run of failures.
+func (b *routeBackoff) recovered() bool {
+	wasFailing := b.failures > 0
+	b.failures = 0
+	return wasFailing
+}
+
+// stopTimer stops a timer and drains its channel such that it may be safely reset.
+func stopTimer(t *time.Timer) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+}
+
 func (rw *routeWatcher) sendUpdate(u routeUpdate) {
 	select {
 	case rw.updatesChan <- u:
@@ -0,0 +1,121 @@
+package trafficlog
+
+import (
+	"fmt"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Multicast groups for rtnetlink notifications. See linux/rtnetlink.h.
+const (
+	rtmgrpLink       = 0x1
+	rtmgrpIPv4IfAddr = 0x10
+	rtmgrpIPv4Route  = 0x40
+	rtmgrpIPv6IfAddr = 0x100
+	rtmgrpIPv6Route  = 0x400
+)
+
+// The netlink socket is read with a timeout so that the reading routine can notice when the
+// notifier has been closed.
+const netlinkReadTimeout = 250 * time.Millisecond
+
+// netlinkNotifier implements routeChangeNotifier by subscribing to rtnetlink notifications of
+// link, address, and route changes.
+type netlinkNotifier struct {
+	fd        int
+	c         chan struct{}
+	failed    chan error
+	done      chan struct{}
+	readGroup sync.WaitGroup
+	closeOnce sync.Once
+}
+
+func newRouteChangeNotifier() (routeChangeNotifier, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open netlink socket: %w", err)
+	}
+	groups := uint32(rtmgrpLink | rtmgrpIPv4IfAddr | rtmgrpIPv4Route | rtmgrpIPv6IfAddr | rtmgrpIPv6Route)
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: groups}); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("failed to bind netlink socket: %w", err)
+	}
+	tv := syscall.NsecToTimeval(netlinkReadTimeout.Nanoseconds())
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("failed to set netlink read timeout: %w", err)
+	}
+
+	n := &netlinkNotifier{
+		fd: fd, c: make(chan struct{}, 1), failed: make(chan error, 1), done: make(chan struct{}),
+	}
+	n.readGroup.Add(1)
+	go n.read()
+	return n, nil
+}
+
+func (n *netlinkNotifier) read() {
+	defer n.readGroup.Done()
+
+	buf := make([]byte, syscall.Getpagesize())
+	for {
+		select {
+		case <-n.done:
+			return
+		default:
+		}
+
+		nRead, _, err := syscall.Recvfrom(n.fd, buf, 0)
+		switch err {
+		case nil:
+		case syscall.EAGAIN, syscall.EINTR:
+			continue
+		case syscall.ENOBUFS:
+			// The socket buffer overran and we missed notifications. Something changed.
+			n.signal()
+			continue
+		default:
+			// The socket is unusable. Recipients fall back to polling.
+			n.failed <- fmt.Errorf("failed to read netlink socket: %w", err)
+			return
+		}
+
+		msgs, err := syscall.ParseNetlinkMessage(buf[:nRead])
+		if err != nil {
+			n.signal()
+			continue
+		}
+		for _, msg := range msgs {
+			switch msg.Header.Type {
+			case syscall.RTM_NEWLINK, syscall.RTM_DELLINK,
+				syscall.RTM_NEWADDR, syscall.RTM_DELADDR,
+				syscall.RTM_NEWROUTE, syscall.RTM_DELROUTE:
+				n.signal()
+			}
+		}
+	}
+}
+
+func (n *netlinkNotifier) signal() {
+	select {
+	case n.c <- struct{}{}:
+	default:
+	}
+}
+
+func (n *netlinkNotifier) changes() <-chan struct{} {
+	return n.c
+}
+
+func (n *netlinkNotifier) failures() <-chan error {
+	return n.failed
+}
+
+func (n *netlinkNotifier) close() {
+	n.closeOnce.Do(func() {
+		close(n.done)
+		n.readGroup.Wait()
+		syscall.Close(n.fd)
+	})
+}
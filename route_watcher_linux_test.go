@@ -0,0 +1,24 @@
+package trafficlog
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNetlinkNotifierClose(t *testing.T) {
+	t.Parallel()
+
+	// Subscribing to rtnetlink notifications does not require elevated permissions.
+	n, err := newRouteChangeNotifier()
+	require.NoError(t, err)
+
+	closed := make(chan struct{})
+	go func() { n.close(); close(closed) }()
+	select {
+	case <-closed:
+	case <-time.After(4 * netlinkReadTimeout):
+		t.Fatal("timed out waiting for notifier to close")
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package trafficlog
+
+import "errors"
+
+func newRouteChangeNotifier() (routeChangeNotifier, error) {
+	return nil, errors.New("route change notifications are only supported on Linux")
+}
@@ -0,0 +1,318 @@
+package trafficlog
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testNotifier struct {
+	c      chan struct{}
+	failed chan error
+	closed chan struct{}
+}
+
+func newTestNotifier() *testNotifier {
+	return &testNotifier{make(chan struct{}), make(chan error, 1), make(chan struct{})}
+}
+
+func (n *testNotifier) changes() <-chan struct{} { return n.c }
+func (n *testNotifier) failures() <-chan error   { return n.failed }
+func (n *testNotifier) close()                   { close(n.closed) }
+
+// testResolver resolves every host to a configurable set of IPs.
+type testResolver struct {
+	ips []net.IP
+	ttl time.Duration
+	err error
+	sync.Mutex
+}
+
+func (r *testResolver) LookupIP(_ context.Context, _ string) ([]net.IP, time.Duration, error) {
+	r.Lock()
+	defer r.Unlock()
+	if r.err != nil {
+		return nil, 0, r.err
+	}
+	return r.ips, r.ttl, nil
+}
+
+func (r *testResolver) setError(err error) {
+	r.Lock()
+	r.err = err
+	r.Unlock()
+}
+
+func (r *testResolver) setIPs(ips ...string) {
+	r.Lock()
+	defer r.Unlock()
+	r.ips = make([]net.IP, len(ips))
+	for i, ip := range ips {
+		r.ips[i] = net.ParseIP(ip)
+	}
+}
+
+func receiveRouteUpdate(t *testing.T, rw *routeWatcher, timeout time.Duration) routeUpdate {
+	t.Helper()
+	select {
+	case u := <-rw.updates():
+		return u
+	case err := <-rw.errors():
+		t.Fatal(err)
+	case <-time.After(timeout):
+		t.Fatal("timed out waiting for route update")
+	}
+	return routeUpdate{}
+}
+
+func TestRouteWatcherNotifications(t *testing.T) {
+	t.Parallel()
+
+	const timeout = time.Second
+
+	// We should not hear from the watcher unless the notifier signals a change.
+	notifier := newTestNotifier()
+	rw, err := startRouteWatcher("127.0.0.1:80", "127.0.0.1", NetResolver{}, DefaultIPGracePeriod, notifier)
+	require.NoError(t, err)
+
+	u := receiveRouteUpdate(t, rw, timeout)
+	require.Equal(t, "127.0.0.1", u.ip.String())
+
+	select {
+	case u := <-rw.updates():
+		t.Fatalf("unexpected update: %v", u.ip)
+	case <-time.After(10 * routeChangeSettleTime):
+	}
+
+	notifier.c <- struct{}{}
+	u = receiveRouteUpdate(t, rw, timeout)
+	require.Equal(t, "127.0.0.1", u.ip.String())
+
+	rw.close()
+	select {
+	case <-notifier.closed:
+	case <-time.After(timeout):
+		t.Fatal("notifier was not closed with the route watcher")
+	}
+}
+
+func TestRouteWatcherNotifierFailure(t *testing.T) {
+	t.Parallel()
+
+	const timeout = 3 * routeCheckInterval
+
+	notifier := newTestNotifier()
+	rw, err := startRouteWatcher("127.0.0.1:80", "127.0.0.1", NetResolver{}, DefaultIPGracePeriod, notifier)
+	require.NoError(t, err)
+	defer rw.close()
+	receiveRouteUpdate(t, rw, timeout)
+
+	// The failure is reported.
+	notifyErr := errors.New("notifier failure")
+	notifier.failed <- notifyErr
+	select {
+	case err := <-rw.errors():
+		require.True(t, errors.Is(err, notifyErr), "unexpected error: %v", err)
+	case <-time.After(timeout):
+		t.Fatal("timed out waiting for error")
+	}
+
+	// Without any signals from the notifier, routes are still re-evaluated.
+	for i := 0; i < 2; i++ {
+		u := receiveRouteUpdate(t, rw, timeout)
+		require.Equal(t, "127.0.0.1", u.ip.String())
+	}
+}
+
+func TestRouteWatcherGracePeriod(t *testing.T) {
+	t.Parallel()
+
+	const (
+		gracePeriod = 100 * time.Millisecond
+		timeout     = 2 * (minResolveInterval + gracePeriod)
+	)
+
+	r := new(testResolver)
+	r.setIPs("127.0.0.1", "127.0.0.2")
+
+	rw, err := startRouteWatcher("test.host:80", "test.host", r, gracePeriod, newTestNotifier())
+	require.NoError(t, err)
+	defer rw.close()
+
+	initial := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		u := receiveRouteUpdate(t, rw, timeout)
+		require.False(t, u.expired)
+		initial[u.ip.String()] = true
+	}
+	require.Equal(t, map[string]bool{"127.0.0.1": true, "127.0.0.2": true}, initial)
+
+	// The host stops resolving to 127.0.0.2 and starts resolving to 127.0.0.3.
+	r.setIPs("127.0.0.1", "127.0.0.3")
+	start := time.Now()
+	var expiredAt time.Time
+	for expiredAt.IsZero() {
+		u := receiveRouteUpdate(t, rw, timeout)
+		switch u.ip.String() {
+		case "127.0.0.2":
+			// The IP is still reported until the grace period elapses.
+			if u.expired {
+				expiredAt = time.Now()
+			}
+		case "127.0.0.1", "127.0.0.3":
+			require.False(t, u.expired)
+		default:
+			t.Fatalf("unexpected update for %v", u.ip)
+		}
+	}
+	require.True(t, expiredAt.Sub(start) >= minResolveInterval, "IP expired before grace period elapsed")
+}
+
+func TestRouteWatcherErrors(t *testing.T) {
+	t.Parallel()
+
+	const (
+		addr    = "test.host:80"
+		timeout = 3 * minRouteRetryInterval
+	)
+
+	r := new(testResolver)
+	r.setIPs("127.0.0.1")
+	rw, err := startRouteWatcher(addr, "test.host", r, time.Hour, newTestNotifier())
+	require.NoError(t, err)
+	defer rw.close()
+
+	// Returns the next error, ignoring updates.
+	receiveError := func() error {
+		t.Helper()
+		for {
+			select {
+			case <-rw.updates():
+			case err := <-rw.errors():
+				return err
+			case <-time.After(timeout):
+				t.Fatal("timed out waiting for error")
+			}
+		}
+	}
+
+	resolveErr := errors.New("resolution failure")
+	r.setError(resolveErr)
+	err = receiveError()
+	var routeErr ErrorRoute
+	require.True(t, errors.As(err, &routeErr), "unexpected error: %v", err)
+	require.Equal(t, addr, routeErr.Address)
+	require.Equal(t, "test.host", routeErr.Host)
+	require.Equal(t, RoutePhaseResolve, routeErr.Phase)
+	require.True(t, errors.Is(err, resolveErr))
+
+	// The watcher should retry and report recovery.
+	r.setError(nil)
+	err = receiveError()
+	require.Equal(t, ErrorRouteRecovered{addr, "test.host", RoutePhaseResolve}, err)
+}
+
+func TestRouteBackoff(t *testing.T) {
+	t.Parallel()
+
+	b := new(routeBackoff)
+	require.False(t, b.recovered())
+	require.Equal(t, minRouteRetryInterval, b.failed())
+	require.Equal(t, 2*minRouteRetryInterval, b.failed())
+	for i := 0; i < 100; i++ {
+		require.True(t, b.failed() <= maxRouteRetryInterval)
+	}
+	require.Equal(t, maxRouteRetryInterval, b.failed())
+	require.True(t, b.recovered())
+	require.Equal(t, minRouteRetryInterval, b.failed())
+}
+
+func TestRouteChangeBroadcaster(t *testing.T) {
+	t.Parallel()
+
+	var (
+		notifiers   []*testNotifier
+		notifiersMu sync.Mutex
+	)
+	b := newRouteChangeBroadcaster(func() (routeChangeNotifier, error) {
+		notifiersMu.Lock()
+		defer notifiersMu.Unlock()
+		n := newTestNotifier()
+		notifiers = append(notifiers, n)
+		return n, nil
+	})
+	requireSignaled := func(n routeChangeNotifier) {
+		t.Helper()
+		select {
+		case <-n.changes():
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for signal")
+		}
+	}
+
+	// Subscribers share a single notifier.
+	s1, err := b.subscribe()
+	require.NoError(t, err)
+	s2, err := b.subscribe()
+	require.NoError(t, err)
+	require.Len(t, notifiers, 1)
+	notifiers[0].c <- struct{}{}
+	requireSignaled(s1)
+	requireSignaled(s2)
+
+	// The notifier is closed along with the last subscription.
+	s1.close()
+	s1.close()
+	notifiers[0].c <- struct{}{}
+	requireSignaled(s2)
+	s2.close()
+	select {
+	case <-notifiers[0].closed:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for notifier to close")
+	}
+
+	// Subscribing again opens a new notifier.
+	s3, err := b.subscribe()
+	require.NoError(t, err)
+	defer s3.close()
+	require.Len(t, notifiers, 2)
+	notifiers[1].c <- struct{}{}
+	requireSignaled(s3)
+
+	// A notifier's failure is passed on to its subscribers. The notifier is closed and the next
+	// subscription opens a new notifier.
+	notifyErr := errors.New("notifier failure")
+	notifiers[1].failed <- notifyErr
+	select {
+	case err := <-s3.failures():
+		require.Equal(t, notifyErr, err)
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for failure")
+	}
+	select {
+	case <-notifiers[1].closed:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for notifier to close")
+	}
+	s4, err := b.subscribe()
+	require.NoError(t, err)
+	defer s4.close()
+	notifiersMu.Lock()
+	require.Len(t, notifiers, 3)
+	notifiersMu.Unlock()
+	notifiers[2].c <- struct{}{}
+	requireSignaled(s4)
+
+	// Failures to open a notifier are passed on to subscribers.
+	failing := newRouteChangeBroadcaster(func() (routeChangeNotifier, error) {
+		return nil, errors.New("unsupported")
+	})
+	_, err = failing.subscribe()
+	require.Error(t, err)
+}
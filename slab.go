@@ -0,0 +1,296 @@
+package trafficlog
+
+import "encoding/binary"
+
+// Bounds on the size of the slabs allocated by a slabStore. Within these bounds, slabs are sized
+// at a sixteenth of the capacity of their buffer.
+const (
+	minSlabSize = 16 * 1024
+	maxSlabSize = 1024 * 1024
+)
+
+// The number of free slabs a slabStore keeps for reuse. Packets are mostly evicted in the order in
+// which they were put, so a slab is usually freed shortly before another is needed.
+const maxFreeSlabs = 2
+
+// Packets held in a slab are stored as records: a header followed by the packet's data. The header
+// is a sequence of varints (see encoding/binary), as follows.
+//
+//	data length                    uvarint
+//	interface                      uvarint  index into the slab's interfaces, shifted left by one;
+//	                                        the low bit is set for saved packets
+//	capture length - data length   varint
+//	length - capture length        varint
+//	timestamp - slab base time     varint   nanoseconds
+//	ID - slab base ID              varint
+//
+// The base time and ID are those of the first record written to the slab. Each field is small or
+// close to the same field of the slab's other packets, so a header is usually around a dozen bytes.
+const maxSlabRecordHeaderLen = 6 * binary.MaxVarintLen64
+
+func slabSizeFor(bufferCap int) int {
+	size := bufferCap / 16
+	if size < minSlabSize {
+		return minSlabSize
+	}
+	if size > maxSlabSize {
+		return maxSlabSize
+	}
+	return size
+}
+
+// slabStore holds the packets in a sharedRingBuffer as records in large slabs. Records are written
+// to the open slab until it is full, at which point a new slab is opened. A slab is freed once all
+// of its records have been released, and may then be reused.
+//
+// This saves the allocation of storage for each packet. Instead, the buffer entry of each packet
+// locates its record (see sharedEntry.slab). As with a blockStore, a slab holding a single live
+// record occupies space not accounted for by the buffer. Slabs are small relative to the buffer, so
+// this is not expected to make a significant difference.
+//
+// A slabStore is used with its buffer locked, as are its slabs, except for reads of records. These
+// may be made concurrently with writes as a record is never written while it may be read.
+type slabStore struct {
+	open *slab
+	free []*slab
+
+	// The size of the slabs allocated for the buffer, as of the last allocation.
+	slabSize int
+}
+
+func newSlabStore() *slabStore {
+	return new(slabStore)
+}
+
+// store the packet in a record in the open slab, opening a new slab if needed.
+func (s *slabStore) store(
+	buf *sharedRingBuffer, entry *sharedEntry, pkt capturedPacket, saved *packetIDSet) bool {
+
+	data, err := pkt.data()
+	if err != nil {
+		return false
+	}
+	// The length of the header is not known until it is written, so room is made for the longest.
+	recordLen := maxSlabRecordHeaderLen + len(data)
+	if s.open == nil || s.open.used+recordLen > len(s.open.data) {
+		s.seal()
+		s.open = s.allocate(buf.cap, recordLen)
+	}
+	entry.slab, entry.offset = s.open, int32(s.open.write(pkt, data, saved))
+	return true
+}
+
+// seal the open slab; no more records will be written to it.
+func (s *slabStore) seal() {
+	sealed := s.open
+	s.open = nil
+	if sealed != nil && sealed.live == 0 {
+		s.recycle(sealed)
+	}
+}
+
+// allocate a slab with room for a record of the input length, reusing a free slab if possible.
+func (s *slabStore) allocate(bufferCap, recordLen int) *slab {
+	s.slabSize = slabSizeFor(bufferCap)
+	if recordLen > s.slabSize {
+		return &slab{store: s, data: make([]byte, recordLen)}
+	}
+	for len(s.free) > 0 {
+		sl := s.free[len(s.free)-1]
+		s.free[len(s.free)-1] = nil
+		s.free = s.free[:len(s.free)-1]
+		// Slabs allocated before a change to the buffer's capacity are discarded.
+		if len(sl.data) == s.slabSize {
+			return sl
+		}
+	}
+	return &slab{store: s, data: make([]byte, s.slabSize)}
+}
+
+// recycle a sealed slab with no live records. The slab is kept for reuse if there is room.
+func (s *slabStore) recycle(sl *slab) {
+	if len(sl.data) == s.slabSize && len(s.free) < maxFreeSlabs {
+		sl.reset()
+		s.free = append(s.free, sl)
+	}
+}
+
+// slab is a block of packet records. Records are written in order, from the start of the slab.
+type slab struct {
+	store *slabStore
+	data  []byte
+
+	// used is the length of the records written to the slab. live is the number of these records
+	// which have not been released.
+	used, live int
+
+	// The base time and ID of the slab's records; see maxSlabRecordHeaderLen.
+	baseTime int64
+	baseID   uint64
+
+	// The interfaces on which the slab's packets were captured, referenced by the records.
+	ifaces []slabInterface
+
+	// The set holding the IDs of the saved packets in the slab. IDs are removed as their records
+	// are released.
+	saved *packetIDSet
+}
+
+// slabInterface is an interface referenced by slab records, along with the interface index
+// reported with the packets (see captureInfo).
+type slabInterface struct {
+	iface *networkInterface
+	index int
+}
+
+// write a record holding the packet with the input data. If saved is non-nil, the packet is a saved
+// packet with its ID held in saved. Returns the offset of the record.
+func (sl *slab) write(pkt capturedPacket, data []byte, saved *packetIDSet) int {
+	offset := sl.used
+	if offset == 0 {
+		sl.baseTime, sl.baseID = pkt.info.unixNano, pkt.id
+	}
+	iface := uint64(sl.interfaceFor(pkt.info.iface, pkt.info.interfaceIndex)) << 1
+	if saved != nil {
+		sl.saved = saved
+		iface |= 1
+	}
+	b := sl.data[offset:]
+	n := binary.PutUvarint(b, uint64(len(data)))
+	n += binary.PutUvarint(b[n:], iface)
+	n += binary.PutVarint(b[n:], int64(pkt.info.captureLength-len(data)))
+	n += binary.PutVarint(b[n:], int64(pkt.info.length-pkt.info.captureLength))
+	n += binary.PutVarint(b[n:], pkt.info.unixNano-sl.baseTime)
+	n += binary.PutVarint(b[n:], int64(pkt.id-sl.baseID))
+	n += copy(b[n:], data)
+	sl.used += n
+	sl.live++
+	return offset
+}
+
+// Returns the index of the interface in the slab's interfaces, adding it if necessary.
+func (sl *slab) interfaceFor(iface *networkInterface, index int) int {
+	for i, si := range sl.ifaces {
+		if si.iface == iface && si.index == index {
+			return i
+		}
+	}
+	sl.ifaces = append(sl.ifaces, slabInterface{iface, index})
+	return len(sl.ifaces) - 1
+}
+
+// slabRecord is the decoded header of a slab record.
+type slabRecord struct {
+	id                    uint64
+	unixNano              int64
+	captureLength, length int
+
+	// The index of the record's interface in the slab's interfaces.
+	iface int
+	saved bool
+
+	// The location of the packet's data in the slab.
+	dataStart, dataLen int
+}
+
+// read the header of the record at the input offset.
+func (sl *slab) read(offset int) slabRecord {
+	b := sl.data[offset:]
+	dataLen, n := binary.Uvarint(b)
+	pos := n
+	iface, n := binary.Uvarint(b[pos:])
+	pos += n
+	captureDelta, n := binary.Varint(b[pos:])
+	pos += n
+	lengthDelta, n := binary.Varint(b[pos:])
+	pos += n
+	timeDelta, n := binary.Varint(b[pos:])
+	pos += n
+	idDelta, n := binary.Varint(b[pos:])
+	pos += n
+
+	captureLength := int(dataLen) + int(captureDelta)
+	return slabRecord{
+		id:            sl.baseID + uint64(idDelta),
+		unixNano:      sl.baseTime + timeDelta,
+		captureLength: captureLength,
+		length:        captureLength + int(lengthDelta),
+		iface:         int(iface >> 1),
+		saved:         iface&1 != 0,
+		dataStart:     offset + pos,
+		dataLen:       int(dataLen),
+	}
+}
+
+// packet returns the packet held in the record at the input offset. Should be called with the
+// buffer locked; the returned packet may then be read without the lock.
+func (sl *slab) packet(offset int) slabPacket {
+	return slabPacket{sl, sl.ifaces[sl.read(offset).iface], offset}
+}
+
+// release a record. Once all of the slab's records have been released, the slab is reused.
+func (sl *slab) release(offset int) {
+	if rec := sl.read(offset); rec.saved {
+		sl.saved.remove(rec.id)
+	}
+	if sl.live--; sl.live > 0 {
+		return
+	}
+	if sl == sl.store.open {
+		sl.reset()
+		return
+	}
+	sl.store.recycle(sl)
+}
+
+// reset an empty slab, such that records are written from its start.
+func (sl *slab) reset() {
+	for i := range sl.ifaces {
+		sl.ifaces[i] = slabInterface{}
+	}
+	sl.used, sl.ifaces, sl.saved = 0, sl.ifaces[:0], nil
+}
+
+// slabPacket is a packet held in a slab record, in the form provided to readers of the buffer (see
+// sharedEntry.held). The packet's interface is resolved when the slabPacket is made, as readers may
+// not access the slab's interfaces.
+type slabPacket struct {
+	slab   *slab
+	iface  slabInterface
+	offset int
+}
+
+func (pkt slabPacket) size() int {
+	return pkt.len() + overheadPerPacket
+}
+
+func (pkt slabPacket) onEvict() {
+	pkt.slab.release(pkt.offset)
+}
+
+func (pkt slabPacket) captured() capturedPacket {
+	rec := pkt.slab.read(pkt.offset)
+	info := captureInfo{rec.unixNano, rec.captureLength, rec.length, pkt.iface.index, pkt.iface.iface}
+	return capturedPacket{rec.id, info, nil, nil, pkt}
+}
+
+func (pkt slabPacket) timestamp() int64 {
+	return pkt.slab.read(pkt.offset).unixNano
+}
+
+// slabPacket is also the dataRef of the packets returned by captured. The data should not be
+// modified.
+func (pkt slabPacket) data() ([]byte, error) {
+	rec := pkt.slab.read(pkt.offset)
+	end := rec.dataStart + rec.dataLen
+	return pkt.slab.data[rec.dataStart:end:end], nil
+}
+
+func (pkt slabPacket) len() int {
+	length, _ := binary.Uvarint(pkt.slab.data[pkt.offset:])
+	return int(length)
+}
+
+func (pkt slabPacket) release() {
+	pkt.slab.release(pkt.offset)
+}
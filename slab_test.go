@@ -0,0 +1,91 @@
+package trafficlog
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"runtime"
+	"testing"
+
+	"github.com/oxtoacart/bpool"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSlabStore(t *testing.T) {
+	t.Parallel()
+
+	const (
+		bufferSize = 64 * 1024
+		packetLen  = 1000
+	)
+
+	pool := bpool.NewBufferPool(dataPoolSize)
+	rb := newSharedRingBuffer(bufferSize)
+	store := rb.store.(*slabStore)
+	h := rb.newHook()
+	expected := [][]byte{}
+	put := func() {
+		i := len(expected)
+		data := bytes.Repeat([]byte{byte(i)}, packetLen)
+		h.put(newTestPacket(pool, uint64(i), data))
+		expected = append(expected, data)
+	}
+
+	// Many times the buffer's capacity is put. Slabs are reused as their records are released, so
+	// few slabs are needed.
+	opened := map[*slab]bool{}
+	for i := 0; i < 20*bufferSize/packetLen; i++ {
+		put()
+		opened[store.open] = true
+	}
+	require.LessOrEqual(t, len(opened), bufferSize/minSlabSize+maxFreeSlabs+1)
+	contents := hookContents(t, h)
+	require.NotEmpty(t, contents)
+	require.Equal(t, expected[len(expected)-len(contents):], contents)
+
+	// Records held by a reader are not overwritten, even once evicted.
+	read := [][]byte{}
+	h.forEach(func(item bufferItem) {
+		if len(read) == 0 {
+			for i := 0; i < 2*bufferSize/packetLen; i++ {
+				put()
+			}
+		}
+		data, err := item.(packetItem).captured().data()
+		require.NoError(t, err)
+		read = append(read, append([]byte{}, data...))
+	})
+	require.Equal(t, contents, read)
+	require.Equal(t, expected[len(expected)-len(hookContents(t, h)):], hookContents(t, h))
+}
+
+// BenchmarkPacketOverhead reports the heap allocated per packet held in a capture buffer, beyond the
+// packet's data. This is the figure measured by internal/opp, without the need for a live capture.
+func BenchmarkPacketOverhead(b *testing.B) {
+	const packets = 100000
+
+	for _, packetLen := range []int{4, 60, 1500} {
+		packetLen := packetLen
+		b.Run(fmt.Sprintf("len=%d", packetLen), func(b *testing.B) {
+			data := make([]byte, packetLen)
+			pool := bpool.NewBufferPool(dataPoolSize)
+			var overhead float64
+			for i := 0; i < b.N; i++ {
+				var before, after runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+				rb := newSharedRingBuffer(math.MaxInt32)
+				h := rb.newHook()
+				for j := 0; j < packets; j++ {
+					h.put(newTestPacket(pool, uint64(j), data))
+				}
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				allocated := int(after.HeapAlloc) - int(before.HeapAlloc)
+				overhead = float64(allocated-packets*packetLen) / packets
+				runtime.KeepAlive(h)
+			}
+			b.ReportMetric(overhead, "B/pkt")
+		})
+	}
+}
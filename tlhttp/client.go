@@ -8,6 +8,8 @@ import (
 	"io"
 	"net/http"
 	"time"
+
+	"github.com/getlantern/trafficlog"
 )
 
 // DefaultScheme is the scheme used by Clients when Client.Scheme is not specified.
@@ -39,8 +41,12 @@ func (c Client) UpdateAddresses(addresses []string) error {
 }
 
 // UpdateBufferSizes calls the corresponding method on the server's traffic log.
-func (c Client) UpdateBufferSizes(captureBytes, saveBytes int) error {
-	return c.do(actionUpdateBufferSizes, requestUpdateBufferSizes{captureBytes, saveBytes}, nil)
+func (c Client) UpdateBufferSizes(captureBytes, saveBytes int) (trafficlog.BufferEvictions, error) {
+	req, resp := requestUpdateBufferSizes{captureBytes, saveBytes}, new(responseUpdateBufferSizes)
+	if err := c.do(actionUpdateBufferSizes, req, resp); err != nil {
+		return trafficlog.BufferEvictions{}, err
+	}
+	return resp.Evictions, nil
 }
 
 // SaveCaptures calls the corresponding method on the server's traffic log.
@@ -61,6 +67,15 @@ func (c Client) WritePcapng(w io.Writer) error {
 	return nil
 }
 
+// BufferStatus calls the corresponding method on the server's traffic log.
+func (c Client) BufferStatus() (trafficlog.BufferStatus, error) {
+	resp := new(responseGetBufferStatus)
+	if err := c.do(actionGetBufferStatus, nil, resp); err != nil {
+		return trafficlog.BufferStatus{}, err
+	}
+	return resp.Status, nil
+}
+
 // CheckHealth makes a test request to check the health of the server and the client's ability to
 // connect to the server.
 func (c Client) CheckHealth() error {
@@ -22,9 +22,10 @@ type action struct {
 
 var (
 	actionUpdateAddresses   = action{"/addresses", "PUT", http.StatusNoContent}
-	actionUpdateBufferSizes = action{"/buffer-sizes", "PUT", http.StatusNoContent}
+	actionUpdateBufferSizes = action{"/buffer-sizes", "PUT", http.StatusOK}
 	actionSaveCaptures      = action{"/save-captures", "POST", http.StatusNoContent}
 	actionGetCaptures       = action{"/captures", "GET", http.StatusOK}
+	actionGetBufferStatus   = action{"/buffer-status", "GET", http.StatusOK}
 	actionCheckHealth       = action{"/health", "GET", http.StatusNoContent}
 )
 
@@ -65,6 +66,7 @@ func RequestHandler(tl *trafficlog.TrafficLog, errorLog io.Writer) http.Handler
 		{actionUpdateBufferSizes, m.updateBufferSizes},
 		{actionSaveCaptures, m.saveCaptures},
 		{actionGetCaptures, m.getCaptures},
+		{actionGetBufferStatus, m.getBufferStatus},
 		{actionCheckHealth, m.checkHealth},
 	} {
 		m.handle(e.action, e.handler)
@@ -129,8 +131,18 @@ func (m trafficLogMux) updateBufferSizes(w http.ResponseWriter, req *http.Reques
 	if err := json.NewDecoder(req.Body).Decode(reqBody); err != nil {
 		return nil, httpErrorf(http.StatusBadRequest, "failed to decode request: %w", err)
 	}
-	m.UpdateBufferSizes(reqBody.CaptureBytes, reqBody.SaveBytes)
-	return nil, nil
+	evictions, err := m.UpdateBufferSizes(reqBody.CaptureBytes, reqBody.SaveBytes)
+	if err != nil {
+		if ok := errors.As(err, new(trafficlog.ErrorBufferSize)); ok {
+			return nil, httpErrorf(http.StatusBadRequest, err.Error())
+		}
+		return nil, httpErrorf(http.StatusInternalServerError, err.Error())
+	}
+	return responseUpdateBufferSizes{evictions}, nil
+}
+
+type responseUpdateBufferSizes struct {
+	Evictions trafficlog.BufferEvictions
 }
 
 type requestSaveCaptures struct {
@@ -166,6 +178,14 @@ func (m trafficLogMux) getCaptures(w http.ResponseWriter, req *http.Request) (in
 	return responseGetCaptures{buf.Bytes()}, nil
 }
 
+type responseGetBufferStatus struct {
+	Status trafficlog.BufferStatus
+}
+
+func (m trafficLogMux) getBufferStatus(w http.ResponseWriter, req *http.Request) (interface{}, *httpError) {
+	return responseGetBufferStatus{m.BufferStatus()}, nil
+}
+
 func (m trafficLogMux) checkHealth(w http.ResponseWriter, req *http.Request) (interface{}, *httpError) {
 	return nil, nil
 }
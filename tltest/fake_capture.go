@@ -0,0 +1,332 @@
+package tltest
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// The number of packets a FakeSource will queue before dropping new packets.
+const fakeSourceQueueSize = 1024
+
+// ErrFakeReadTimeout is returned by FakeSource.ZeroCopyReadPacketData when no packet arrives
+// within the source's read timeout.
+var ErrFakeReadTimeout = errors.New("fake source read timeout")
+
+// FakeCapture is an in-memory stand-in for packet capture. Sources opened with a FakeCapture
+// receive link-layer frames generated by calls to Inject, rather than traffic from a network
+// interface. This allows traffic logs to be tested without elevated permissions.
+//
+// FakeSource mirrors the PacketSource interface defined in the trafficlog package. Users of this
+// type will need to adapt it to that interface.
+type FakeCapture struct {
+	linkType layers.LinkType
+
+	// sources holds the sources which are open. opened holds every source opened, in order.
+	sources map[*FakeSource]bool
+	opened  []*FakeSource
+
+	sync.Mutex
+}
+
+// NewFakeCapture creates a new FakeCapture. Sources opened by the capture have the ethernet link
+// type.
+func NewFakeCapture() *FakeCapture {
+	return NewFakeCaptureWithLinkType(layers.LinkTypeEthernet)
+}
+
+// NewFakeCaptureWithLinkType creates a new FakeCapture whose sources have the input link type.
+// Frames of this link type may be delivered using InjectFrame. Inject generates ethernet frames,
+// so should only be used with the ethernet link type.
+func NewFakeCaptureWithLinkType(lt layers.LinkType) *FakeCapture {
+	return &FakeCapture{linkType: lt, sources: map[*FakeSource]bool{}}
+}
+
+// Open a new source. The source will receive all packets injected until it is closed. All sources
+// see the same traffic, regardless of interface.
+func (fc *FakeCapture) Open(iface string, snapLen int, readTimeout time.Duration) *FakeSource {
+	s := &FakeSource{
+		fc:          fc,
+		iface:       iface,
+		linkType:    fc.linkType,
+		snapLen:     snapLen,
+		readTimeout: readTimeout,
+		packets:     make(chan fakePacket, fakeSourceQueueSize),
+		closed:      make(chan struct{}),
+	}
+	fc.Lock()
+	fc.sources[s] = true
+	fc.opened = append(fc.opened, s)
+	fc.Unlock()
+	return s
+}
+
+// Sources returns every source opened by the capture, including those since closed, in the order
+// in which they were opened.
+func (fc *FakeCapture) Sources() []*FakeSource {
+	fc.Lock()
+	defer fc.Unlock()
+	return append([]*FakeSource{}, fc.opened...)
+}
+
+// Inject generates a TCP segment carrying the input payload and delivers it, as an ethernet
+// frame, to each open source with a matching filter. The source and destination addresses must
+// be of the form ip:port.
+func (fc *FakeCapture) Inject(src, dst string, payload []byte) error {
+	frame, err := tcpFrame(src, dst, payload)
+	if err != nil {
+		return err
+	}
+	fc.InjectFrame(frame)
+	return nil
+}
+
+// InjectFrame delivers a link-layer frame to each open source with a matching filter.
+func (fc *FakeCapture) InjectFrame(frame []byte) {
+	ci := gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: len(frame), Length: len(frame)}
+
+	fc.Lock()
+	defer fc.Unlock()
+	for s := range fc.sources {
+		s.deliver(ci, frame)
+	}
+}
+
+// Sync blocks until every packet injected so far has been read from its source and the reader
+// has come back for more. Thus, when Sync returns, a traffic log reading from these sources has
+// finished processing the injected packets.
+func (fc *FakeCapture) Sync(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		pending := 0
+		fc.Lock()
+		for s := range fc.sources {
+			pending += s.pendingPackets()
+		}
+		fc.Unlock()
+		if pending == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%d packets still pending after %v", pending, timeout)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+type fakePacket struct {
+	ci   gopacket.CaptureInfo
+	data []byte
+}
+
+// FakeSource is a packet source opened by a FakeCapture. The methods of this type mirror those of
+// the PacketSource interface in the trafficlog package.
+type FakeSource struct {
+	fc          *FakeCapture
+	iface       string
+	linkType    layers.LinkType
+	snapLen     int
+	readTimeout time.Duration
+	packets     chan fakePacket
+	closed      chan struct{}
+
+	filter            *pcap.BPF
+	filterExpr        string
+	received, dropped uint64
+
+	// pending counts packets delivered, but not yet processed by the reader. A packet is processed
+	// once the reader comes back for the next packet.
+	pending  int
+	inFlight bool
+
+	mu sync.Mutex
+}
+
+func (s *FakeSource) deliver(ci gopacket.CaptureInfo, frame []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.filter != nil && !s.filter.Matches(ci, frame) {
+		return
+	}
+	data := make([]byte, len(frame))
+	copy(data, frame)
+	if s.snapLen > 0 && len(data) > s.snapLen {
+		data = data[:s.snapLen]
+		ci.CaptureLength = s.snapLen
+	}
+	select {
+	case s.packets <- fakePacket{ci, data}:
+		s.pending++
+	default:
+		s.dropped++
+	}
+}
+
+func (s *FakeSource) pendingPackets() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pending
+}
+
+// ZeroCopyReadPacketData reads the next packet from the source. Returns ErrFakeReadTimeout if no
+// packet arrives within the read timeout and io.EOF once the source is closed.
+func (s *FakeSource) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	s.mu.Lock()
+	if s.inFlight {
+		s.inFlight = false
+		s.pending--
+	}
+	s.mu.Unlock()
+
+	timer := time.NewTimer(s.readTimeout)
+	defer timer.Stop()
+	select {
+	case pkt := <-s.packets:
+		s.mu.Lock()
+		s.inFlight = true
+		s.received++
+		s.mu.Unlock()
+		return pkt.data, pkt.ci, nil
+	case <-s.closed:
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	case <-timer.C:
+		return nil, gopacket.CaptureInfo{}, ErrFakeReadTimeout
+	}
+}
+
+// LinkType of packets read from this source. This is the link type of the FakeCapture.
+func (s *FakeSource) LinkType() layers.LinkType {
+	return s.linkType
+}
+
+// SetBPFFilter restricts the packets delivered to this source. Filters are evaluated in user
+// space by libpcap; this does not require elevated permissions.
+func (s *FakeSource) SetBPFFilter(expr string) error {
+	filter, err := pcap.NewBPF(s.linkType, s.snapLen, expr)
+	if err != nil {
+		return fmt.Errorf("failed to compile filter: %w", err)
+	}
+	s.mu.Lock()
+	s.filter, s.filterExpr = filter, expr
+	s.mu.Unlock()
+	return nil
+}
+
+// Interface returns the name of the interface with which the source was opened.
+func (s *FakeSource) Interface() string {
+	return s.iface
+}
+
+// Filter returns the expression last passed to SetBPFFilter, or the empty string if no filter has
+// been set.
+func (s *FakeSource) Filter() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.filterExpr
+}
+
+// Closed reports whether the source has been closed.
+func (s *FakeSource) Closed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Stats returns the number of packets read from and dropped by this source.
+func (s *FakeSource) Stats() (received, dropped uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.received, s.dropped
+}
+
+// Close the source. Queued packets are discarded.
+func (s *FakeSource) Close() {
+	s.fc.Lock()
+	delete(s.fc.sources, s)
+	s.fc.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.closed:
+		return
+	default:
+	}
+	close(s.closed)
+	s.pending = 0
+	s.inFlight = false
+}
+
+func tcpFrame(src, dst string, payload []byte) ([]byte, error) {
+	srcIP, srcPort, err := splitIPPort(src)
+	if err != nil {
+		return nil, fmt.Errorf("bad source address: %w", err)
+	}
+	dstIP, dstPort, err := splitIPPort(dst)
+	if err != nil {
+		return nil, fmt.Errorf("bad destination address: %w", err)
+	}
+
+	var (
+		eth = layers.Ethernet{
+			SrcMAC: net.HardwareAddr{0, 0, 0, 0, 0, 0},
+			DstMAC: net.HardwareAddr{0, 0, 0, 0, 0, 0},
+		}
+		tcp          = layers.TCP{SrcPort: srcPort, DstPort: dstPort, PSH: true, ACK: true, Window: 65535}
+		networkLayer gopacket.SerializableLayer
+	)
+	switch {
+	case srcIP.To4() != nil && dstIP.To4() != nil:
+		eth.EthernetType = layers.EthernetTypeIPv4
+		ip := &layers.IPv4{
+			Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: srcIP.To4(), DstIP: dstIP.To4(),
+		}
+		tcp.SetNetworkLayerForChecksum(ip)
+		networkLayer = ip
+	case srcIP.To4() == nil && dstIP.To4() == nil:
+		eth.EthernetType = layers.EthernetTypeIPv6
+		ip := &layers.IPv6{
+			Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolTCP, SrcIP: srcIP, DstIP: dstIP,
+		}
+		tcp.SetNetworkLayerForChecksum(ip)
+		networkLayer = ip
+	default:
+		return nil, errors.New("source and destination must be of the same IP version")
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	err = gopacket.SerializeLayers(buf, opts, &eth, networkLayer, &tcp, gopacket.Payload(payload))
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize frame: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func splitIPPort(addr string) (net.IP, layers.TCPPort, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, 0, fmt.Errorf("%s is not an IP address", host)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, 0, fmt.Errorf("bad port: %w", err)
+	}
+	return ip, layers.TCPPort(port), nil
+}
@@ -7,7 +7,6 @@ import (
 	"flag"
 	"fmt"
 	"io"
-	"net"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -118,7 +117,7 @@ func TestTrafficLog(t *testing.T, tl TrafficLog) {
 	}
 
 	// Ensure that we can filter by time.
-	clearSaveBuffer(t, tl, addresses, captureBufferSize, saveBufferSize)
+	clearSaveBuffer(t, tl, captureBufferSize, saveBufferSize)
 	pcapFileBuf.Reset()
 	resetTime := time.Now()
 
@@ -146,38 +145,159 @@ func TestTrafficLog(t *testing.T, tl TrafficLog) {
 	}
 }
 
-// As a side effect, there will be a single packet in the save buffer. This packet will be to or
-// from an address reserved until the end of the test, so it should not interfere with testing.
-func clearSaveBuffer(t *testing.T, tl TrafficLog, addresses []string, captureBufferSize, saveBufferSize int) {
+// TestTrafficLogFakeCapture tests a TrafficLog for correctness without capturing live traffic.
+// Unlike TestTrafficLog, this test does not require elevated permissions.
+//
+// The traffic log must be configured to capture packets using sources opened by the input
+// FakeCapture. Traffic for the test is generated using fc.Inject.
+func TestTrafficLogFakeCapture(t *testing.T, tl TrafficLog, fc *FakeCapture) {
 	t.Helper()
+	t.Parallel()
 
-	l, err := net.Listen("tcp", "127.0.0.1:")
-	require.NoError(t, err)
-	t.Cleanup(func() { l.Close() })
+	defer tl.Close()
 
-	require.NoError(t, tl.UpdateAddresses(append([]string{l.Addr().String()}, addresses...)))
-	defer func() { require.NoError(t, tl.UpdateAddresses(addresses)) }()
+	const (
+		captureAddresses = 10
+		serverResponse   = "TestTrafficLogFakeCapture fake server response"
+		syncTimeout      = 5 * time.Second
 
-	conn, err := net.Dial("tcp", l.Addr().String())
-	require.NoError(t, err)
-	conn.Close()
+		// Addresses are not actually bound, so these ports just need to be distinct.
+		clientAddr     = "127.0.0.1:40000"
+		serverPortBase = 40001
 
-	time.Sleep(captureWaitTime)
+		// Make the buffers large enough that we will not lose any packets.
+		captureBufferSize, saveBufferSize = 1024 * 1024, 1024 * 1024
+	)
+
+	responseFor := func(serverNumber int) string {
+		return fmt.Sprintf("<%s - server number %d>", serverResponse, serverNumber)
+	}
 
-	require.NoError(t, tl.UpdateBufferSizes(captureBufferSize, 0))
-	require.NoError(t, tl.SaveCaptures(l.Addr().String(), time.Hour)) // flush the change
+	serverAddr := func(serverNumber int) string {
+		return fmt.Sprintf("127.0.0.1:%d", serverPortBase+serverNumber)
+	}
+
+	makeServers := func(n, start int) (addresses []string) {
+		addresses = make([]string, n)
+		for i := 0; i < n; i++ {
+			addresses[i] = serverAddr(start + i)
+		}
+		return addresses
+	}
+
+	exchange := func(serverNumber int) {
+		t.Helper()
+		addr := serverAddr(serverNumber)
+		require.NoError(t, fc.Inject(clientAddr, addr, []byte("request")))
+		require.NoError(t, fc.Inject(addr, clientAddr, []byte(responseFor(serverNumber))))
+	}
+
+	addresses := makeServers(captureAddresses, 0)
+	require.NoError(t, tl.UpdateAddresses(addresses))
+
+	go func() {
+		for err := range tl.Errors() {
+			t.Log(err)
+			t.Fail()
+			return
+		}
+	}()
+
+	for i := range addresses {
+		exchange(i)
+	}
+	require.NoError(t, fc.Sync(syncTimeout))
+
+	for i, addr := range addresses {
+		// Ensure that we can filter by address by only capturing for even servers.
+		if i%2 == 0 {
+			require.NoError(t, tl.SaveCaptures(addr, time.Minute))
+		}
+	}
+
+	pcapFileBuf := new(bytes.Buffer)
+	require.NoError(t, tl.WritePcapng(pcapFileBuf))
+	// Each server saw a request and a response.
+	requirePacketCount(t, pcapFileBuf.Bytes(), captureAddresses)
+
+	pcapFile := pcapFileBuf.String()
+	for i := 0; i < captureAddresses; i++ {
+		switch i % 2 {
+		case 0:
+			requireContainsOnce(t, pcapFile, responseFor(i))
+		default:
+			requireNotContains(t, pcapFile, responseFor(i))
+		}
+	}
+
+	// Ensure that we can filter by time.
+	clearSaveBuffer(t, tl, captureBufferSize, saveBufferSize)
+	pcapFileBuf.Reset()
+	resetTime := time.Now()
+
+	newAddresses := makeServers(captureAddresses, len(addresses))
+	require.NoError(t, tl.UpdateAddresses(concat(addresses, newAddresses)))
+
+	// Traffic for the old servers predates resetTime, but this traffic for the new servers does not.
+	for i := len(addresses); i < len(addresses)+len(newAddresses); i++ {
+		exchange(i)
+	}
+	require.NoError(t, fc.Sync(syncTimeout))
+
+	for _, addr := range concat(addresses, newAddresses) {
+		require.NoError(t, tl.SaveCaptures(addr, time.Since(resetTime)))
+	}
+
+	require.NoError(t, tl.WritePcapng(pcapFileBuf))
+	requirePacketCount(t, pcapFileBuf.Bytes(), 2*len(newAddresses))
+	pcapFile = pcapFileBuf.String()
+	for i := 0; i < len(addresses); i++ {
+		requireNotContains(t, pcapFile, responseFor(i))
+	}
+	for i := len(addresses); i < len(addresses)+len(newAddresses); i++ {
+		requireContainsOnce(t, pcapFile, responseFor(i))
+	}
+
+	// Ensure that capture stops for removed addresses.
+	require.NoError(t, tl.UpdateAddresses(newAddresses))
+	exchange(0)
+	require.NoError(t, fc.Sync(syncTimeout))
+	require.NoError(t, tl.SaveCaptures(addresses[0], time.Minute))
+	pcapFileBuf.Reset()
+	require.NoError(t, tl.WritePcapng(pcapFileBuf))
+	requireNotContains(t, pcapFileBuf.String(), responseFor(0))
+}
+
+// clearSaveBuffer evicts all packets from the save buffer by briefly shrinking the buffer below the
+// size of any packet.
+func clearSaveBuffer(t *testing.T, tl TrafficLog, captureBufferSize, saveBufferSize int) {
+	t.Helper()
+
+	require.NoError(t, tl.UpdateBufferSizes(captureBufferSize, 1))
 	require.NoError(t, tl.UpdateBufferSizes(captureBufferSize, saveBufferSize))
 
-	// Sanity check by writing out captured packets - we should see a single packet from our earlier
-	// TCP connection.
 	buf := new(bytes.Buffer)
 	require.NoError(t, tl.WritePcapng(buf))
-	pcapReader, err := pcapgo.NewNgReader(buf, pcapgo.NgReaderOptions{WantMixedLinkType: true})
-	require.NoError(t, err)
-	_, _, err = pcapReader.ReadPacketData()
+	requirePacketCount(t, buf.Bytes(), 0)
+}
+
+func requirePacketCount(t *testing.T, pcapngFile []byte, expected int) {
+	t.Helper()
+
+	pcapReader, err := pcapgo.NewNgReader(bytes.NewReader(pcapngFile), pcapgo.NgReaderOptions{WantMixedLinkType: true})
 	require.NoError(t, err)
-	_, _, err = pcapReader.ReadPacketData()
-	require.True(t, errors.Is(err, io.EOF), "error type: %T; msg: %v", err, err)
+	count := 0
+	for {
+		_, _, err := pcapReader.ReadPacketData()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		count++
+	}
+	if count != expected {
+		fail(t, "expected %d packets, but found %d", expected, count)
+	}
 }
 
 func requireContainsOnce(t *testing.T, s, substring string) {
@@ -4,6 +4,7 @@
 package trafficlog
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"runtime"
@@ -30,18 +31,23 @@ const (
 	// To avoid discarding the buffers, we therefore make the pools able to hold up to 30 buffers.
 	dataPoolSize = 30
 
-	// Capture processes report their stats to the traffic log more often than the traffic log
+	// Interface captures report their stats to the traffic log more often than the traffic log
 	// reports aggregated stats. This keeps the aggregated stats current.
 	procStatsPerLogStats = 5
 )
 
+// AllInterfaces may be passed to TrafficLog.UpdateInterfaces in place of an interface name to
+// capture on all network interfaces.
+const AllInterfaces = "*"
+
 // DefaultStatsInterval is the default interval at which a traffic log outputs statistics.
 const DefaultStatsInterval = 15 * time.Second
 
 // MinimumStatsInterval is the minimum acceptable stats interval for traffic logs.
 const MinimumStatsInterval = 500 * time.Millisecond
 
-// ErrorMalformedAddress may be returned by TrafficLog.UpdateAddresses.
+// ErrorMalformedAddress may be returned by TrafficLog.UpdateAddresses or
+// TrafficLog.UpdateInterfaces.
 type ErrorMalformedAddress struct {
 	cause error
 }
@@ -55,6 +61,89 @@ func (e ErrorMalformedAddress) Error() string {
 	return fmt.Sprintf("malformed address: %v", e.cause)
 }
 
+// ErrorBufferFile is output on TrafficLog.Errors when the file named by Options.BufferFile cannot be
+// used. If the file cannot be opened, the capture and save buffers are held in memory instead.
+type ErrorBufferFile struct {
+	Path  string
+	cause error
+}
+
+// Unwrap allows for Go 1.13-style error unwrapping.
+func (e ErrorBufferFile) Unwrap() error {
+	return e.cause
+}
+
+func (e ErrorBufferFile) Error() string {
+	return fmt.Sprintf("buffer file %s: %v", e.Path, e.cause)
+}
+
+// ErrorBufferSize is returned by TrafficLog.UpdateBufferSizes when a buffer size is not positive.
+type ErrorBufferSize struct {
+	// Buffer is either "capture" or "save".
+	Buffer string
+	Size   int
+}
+
+func (e ErrorBufferSize) Error() string {
+	return fmt.Sprintf("invalid %s buffer size %d: must be positive", e.Buffer, e.Size)
+}
+
+// RoutePhase denotes a phase in establishing the route to an address.
+type RoutePhase int
+
+// Route phases.
+const (
+	// RoutePhaseResolve is the resolution of an address' host to IP addresses.
+	RoutePhaseResolve RoutePhase = iota
+
+	// RoutePhaseInterface is the lookup of the network interface used to reach an IP address.
+	RoutePhaseInterface RoutePhase = iota
+)
+
+func (p RoutePhase) String() string {
+	switch p {
+	case RoutePhaseResolve:
+		return "resolve"
+	case RoutePhaseInterface:
+		return "interface lookup"
+	default:
+		return fmt.Sprintf("unknown phase %d", int(p))
+	}
+}
+
+// ErrorRoute may be returned by TrafficLog.UpdateAddresses or output on TrafficLog.Errors. This
+// indicates a failure to establish the route to an address. When output on TrafficLog.Errors,
+// capture continues for the address on any previously-established routes and the failed phase is
+// retried with backoff.
+type ErrorRoute struct {
+	Address string
+	Host    string
+	Phase   RoutePhase
+	cause   error
+}
+
+// Unwrap allows for Go 1.13-style error unwrapping.
+func (e ErrorRoute) Unwrap() error {
+	return e.cause
+}
+
+func (e ErrorRoute) Error() string {
+	return fmt.Sprintf("route failure for %s (%s phase): %v", e.Address, e.Phase, e.cause)
+}
+
+// ErrorRouteRecovered is output on TrafficLog.Errors when a phase which previously produced an
+// ErrorRoute succeeds. This is not really an error, but allows listeners to track the state of
+// routes to each address.
+type ErrorRouteRecovered struct {
+	Address string
+	Host    string
+	Phase   RoutePhase
+}
+
+func (e ErrorRouteRecovered) Error() string {
+	return fmt.Sprintf("route recovered for %s (%s phase)", e.Address, e.Phase)
+}
+
 // CaptureStats holds information about packet capture statistics.
 type CaptureStats struct {
 	// Received is the total number of packets successfully processed.
@@ -128,7 +217,11 @@ func (st *statsTracker) track(c <-chan CaptureStats) {
 			if !ok {
 				return
 			}
-			st.input <- CaptureStats{stats.Received - received, stats.Dropped - dropped}
+			select {
+			case st.input <- CaptureStats{stats.Received - received, stats.Dropped - dropped}:
+			case <-st.done:
+				return
+			}
 			received, dropped = stats.Received, stats.Dropped
 		case <-st.done:
 			return
@@ -143,6 +236,105 @@ func (st *statsTracker) close() {
 	close(st.output)
 }
 
+// CaptureSettings configure the packet sources from which a traffic log captures. The zero value
+// uses the defaults described for each field.
+type CaptureSettings struct {
+	// SnapLen is the maximum number of bytes captured from each packet.
+	//
+	// Defaults to the MTU of the network interface.
+	SnapLen int
+
+	// Promiscuous puts network interfaces into promiscuous mode, capturing packets which are not
+	// addressed to this host.
+	Promiscuous bool
+
+	// ImmediateMode delivers packets as soon as they arrive, rather than having the kernel buffer
+	// them. This reduces capture latency at the cost of CPU usage.
+	ImmediateMode bool
+
+	// BufferSize is the size, in bytes, of the kernel buffer holding packets until they are read.
+	// Larger buffers reduce drops when traffic is bursty.
+	//
+	// Defaults to the default for the packet source.
+	BufferSize int
+
+	// NanosecondTimestamps keeps packet timestamps with nanosecond precision, when the packet
+	// source provides it. Otherwise, timestamps are truncated to microseconds.
+	NanosecondTimestamps bool
+}
+
+// resolve returns the settings for capture on the input interface, with defaults applied.
+func (s CaptureSettings) resolve(iface networkInterface) CaptureSettings {
+	if s.SnapLen <= 0 {
+		s.SnapLen = iface.mtu()
+	}
+	return s
+}
+
+// merge returns settings satisfying both s and other: the larger snap length and buffer size are
+// used and modes are enabled if enabled in either.
+func (s CaptureSettings) merge(other CaptureSettings) CaptureSettings {
+	if other.SnapLen > s.SnapLen {
+		s.SnapLen = other.SnapLen
+	}
+	if other.BufferSize > s.BufferSize {
+		s.BufferSize = other.BufferSize
+	}
+	s.Promiscuous = s.Promiscuous || other.Promiscuous
+	s.ImmediateMode = s.ImmediateMode || other.ImmediateMode
+	s.NanosecondTimestamps = s.NanosecondTimestamps || other.NanosecondTimestamps
+	return s
+}
+
+// A BufferQuota is an amount of space in the capture buffer. It may be given in bytes, as a fraction
+// of the buffer's capacity, or both, in which case the larger amount applies.
+type BufferQuota struct {
+	Bytes    int
+	Fraction float64
+}
+
+// of returns the quota in bytes for a buffer with the input capacity.
+func (q BufferQuota) of(capacity int) int {
+	n := int(q.Fraction * float64(capacity))
+	if q.Bytes > n {
+		return q.Bytes
+	}
+	return n
+}
+
+// BufferQuotas govern how space in the capture buffer is divided among captured addresses. By
+// default, the oldest packet in the buffer is evicted to make room for a new one, regardless of the
+// address for which it was captured. This allows a busy address to flush out the history of quieter
+// addresses. The zero value imposes no quotas.
+//
+// Quotas apply to each address passed to UpdateAddresses, each entry passed to UpdateInterfaces and
+// each address passed to Replay while not being captured. A packet captured for more than one
+// address counts in full toward the usage of each.
+type BufferQuotas struct {
+	// Reserved is the space reserved for each address. Packets are not evicted from an address
+	// holding no more than its reservation to make room for another address' packets. Instead, the
+	// oldest packets of addresses over their reservations are evicted. If there is not enough space
+	// to honor every reservation, the oldest packets are evicted as usual.
+	Reserved BufferQuota
+
+	// MaxShare is the most space any one address may occupy. Once an address reaches its maximum
+	// share, its oldest packets are evicted to make room for its new packets, even if there is
+	// space elsewhere in the buffer. A zero MaxShare imposes no maximum.
+	MaxShare BufferQuota
+}
+
+// BufferLimits bound the packets held in a buffer, in addition to the buffer's size in bytes. The
+// zero value imposes no limits.
+type BufferLimits struct {
+	// MaxAge is the longest a packet is held in the buffer. Packets are evicted once they reach this
+	// age, even if there is space for them and even if no new packets arrive. Age is measured from
+	// the time the packet entered the buffer. A zero MaxAge imposes no maximum.
+	MaxAge time.Duration
+
+	// MaxPackets is the most packets the buffer may hold. A zero MaxPackets imposes no maximum.
+	MaxPackets int
+}
+
 // Options for running a traffic log.
 type Options struct {
 	// A MutatorFactory is used to govern mutations which are made to packets upon capture. The
@@ -157,6 +349,81 @@ type Options struct {
 	//
 	// Defaults to DefaultStatsInterval
 	StatsInterval time.Duration
+
+	// A PacketSourceFactory is used to open the sources from which packets are captured. This can
+	// be used to capture using an alternative backend or to feed packets to the traffic log from
+	// somewhere other than a network interface. On Linux, AFPacketSourceFactory is available as an
+	// alternative to libpcap.
+	//
+	// Defaults to PcapSourceFactory.
+	PacketSourceFactory PacketSourceFactory
+
+	// Resolver is used to resolve the hosts of captured addresses. Hosts are re-resolved as their
+	// DNS records expire, according to the TTLs reported by the resolver.
+	//
+	// Defaults to a NetResolver using net.DefaultResolver.
+	Resolver Resolver
+
+	// IPGracePeriod is the period for which capture continues for an IP after the host of an
+	// address stops resolving to that IP. Once the grace period elapses, capture stops for the IP.
+	//
+	// Defaults to DefaultIPGracePeriod.
+	IPGracePeriod time.Duration
+
+	// CaptureICMPAndFragments widens capture for each address to include packets which do not carry
+	// the address' ports, but which are nonetheless related to the address' traffic:
+	//
+	//   - ICMP and ICMPv6 error messages (e.g. destination unreachable, packet too big) about packets
+	//     going to or coming from the address. These are useful in debugging path MTU issues and
+	//     blocked connections.
+	//   - IP fragments going to or coming from the address' IPs. Only the initial fragment of a
+	//     packet carries its ports, so other fragments are otherwise not captured.
+	CaptureICMPAndFragments bool
+
+	// CaptureSettings configure the packet sources opened for capture.
+	CaptureSettings CaptureSettings
+
+	// AddressCaptureSettings override CaptureSettings for specific addresses. This is keyed by the
+	// addresses passed to UpdateAddresses; entries passed to UpdateInterfaces may also be used.
+	//
+	// Packets for all addresses routed over a network interface are captured from a single packet
+	// source. The settings for this source are merged from the settings for each address: the
+	// largest snap length and buffer size are used and each mode is enabled if enabled for any
+	// address. If an address requires more than a running source provides, the source is reopened
+	// with the merged settings; packets may be missed while this happens. Settings are not relaxed
+	// as addresses are removed.
+	AddressCaptureSettings map[string]CaptureSettings
+
+	// CaptureBufferQuotas divide space in the capture buffer among addresses. These may be changed
+	// using UpdateBufferQuotas.
+	CaptureBufferQuotas BufferQuotas
+
+	// CaptureBufferLimits and SaveBufferLimits bound the capture and save buffers respectively.
+	// These may be changed using UpdateBufferLimits.
+	CaptureBufferLimits, SaveBufferLimits BufferLimits
+
+	// CompressBuffers causes packet data in the capture and save buffers to be held in compressed
+	// blocks. Buffer sizes then apply to the compressed data, so the buffers hold more packets,
+	// particularly when packet payloads are stripped by the MutatorFactory. This costs CPU time as
+	// blocks are compressed during capture and decompressed by SaveCaptures and WritePcapng.
+	CompressBuffers bool
+
+	// BufferFile names a file in which to hold the packets in the capture and save buffers, in place
+	// of the heap. The file is created if necessary and sized to hold both buffers, at the sizes
+	// passed to New. The buffers still keep an index of their packets in memory. The file is not
+	// resized by UpdateBufferSizes; once a buffer's share of the file is full, the buffer's oldest
+	// packets are evicted to make room, whatever the size of the buffer. CompressBuffers is ignored
+	// when a buffer file is used.
+	//
+	// If the file holds packets from a previous traffic log, as after a crash or restart of the
+	// process, these packets are recovered. Recovered packets captured for an address (or an entry
+	// passed to UpdateInterfaces) are held as though replayed for the address; see Replay. They
+	// can thus be saved by passing the address to SaveCaptures. Recovered saved packets are
+	// restored to the save buffer and can be written out using WritePcapng.
+	//
+	// If the file cannot be used, an ErrorBufferFile is output on Errors and the buffers are held
+	// in memory.
+	BufferFile string
 }
 
 func (opts Options) mutatorFactory() MutatorFactory {
@@ -166,6 +433,27 @@ func (opts Options) mutatorFactory() MutatorFactory {
 	return opts.MutatorFactory
 }
 
+func (opts Options) sourceFactory() PacketSourceFactory {
+	if opts.PacketSourceFactory == nil {
+		return new(PcapSourceFactory)
+	}
+	return opts.PacketSourceFactory
+}
+
+func (opts Options) resolver() Resolver {
+	if opts.Resolver == nil {
+		return NetResolver{}
+	}
+	return opts.Resolver
+}
+
+func (opts Options) ipGracePeriod() time.Duration {
+	if opts.IPGracePeriod <= 0 {
+		return DefaultIPGracePeriod
+	}
+	return opts.IPGracePeriod
+}
+
 func (opts Options) statsInterval() time.Duration {
 	if opts.StatsInterval <= 0 {
 		return DefaultStatsInterval
@@ -184,14 +472,25 @@ func (opts Options) statsInterval() time.Duration {
 type TrafficLog struct {
 	captureBuffer    *sharedRingBuffer
 	saveBuffer       *ringBuffer
+	savedIDs         *packetIDSet
 	capturePool      *bpool.BufferPool
 	savePool         *bpool.BufferPool
 	captureProcs     map[string]*captureProcess
+	ifaceCaptures    map[string]*interfaceWideCapture
+	replayHooks      map[string]*sharedBufferHook
 	captureProcsLock sync.Mutex
+	captures         *captureManager
 	statsTracker     *statsTracker
 	errorChan        chan error
 	mutatorFactory   MutatorFactory
-	statsInterval    time.Duration
+	resolver         Resolver
+	ipGracePeriod    time.Duration
+	routeChanges     *routeChangeBroadcaster
+	captureSettings  CaptureSettings
+	addressSettings  map[string]CaptureSettings
+	lastReplayIndex  int32
+	sweeper          *bufferSweeper
+	bufferFile       *bufferFile
 }
 
 // New returns a new TrafficLog. Start capture by calling UpdateAddresses. The options may be nil in
@@ -208,94 +507,428 @@ func New(captureBytes, saveBytes int, opts *Options) *TrafficLog {
 	if opts == nil {
 		opts = &Options{}
 	}
-	return &TrafficLog{
-		newSharedRingBuffer(captureBytes),
-		newRingBuffer(saveBytes),
-		bpool.NewBufferPool(dataPoolSize),
+	var (
+		captureBuffer = newSharedRingBufferWithQuotas(captureBytes, opts.CaptureBufferQuotas)
+		saveBuffer    = newRingBufferWithLimits(saveBytes, opts.SaveBufferLimits)
+		capturePool   = bpool.NewBufferPool(dataPoolSize)
+		statsTracker  = newStatsTracker(opts.statsInterval())
+		errorChan     = make(chan error, channelBufferSize)
+	)
+	captureBuffer.limits = opts.CaptureBufferLimits
+	// Copied so that later changes to the caller's map have no effect.
+	addressSettings := map[string]CaptureSettings{}
+	for addr, settings := range opts.AddressCaptureSettings {
+		addressSettings[addr] = settings
+	}
+	tl := &TrafficLog{
+		captureBuffer,
+		saveBuffer,
+		newPacketIDSet(),
+		capturePool,
 		bpool.NewBufferPool(dataPoolSize),
 		map[string]*captureProcess{},
+		map[string]*interfaceWideCapture{},
+		map[string]*sharedBufferHook{},
 		sync.Mutex{},
-		newStatsTracker(opts.statsInterval()),
-		make(chan error, channelBufferSize),
+		newCaptureManager(capturePool, *opts, statsTracker, errorChan),
+		statsTracker,
+		errorChan,
 		opts.mutatorFactory(),
-		opts.statsInterval(),
+		opts.resolver(),
+		opts.ipGracePeriod(),
+		newRouteChangeBroadcaster(newRouteChangeNotifier),
+		opts.CaptureSettings,
+		addressSettings,
+		0,
+		startBufferSweeper(captureBuffer, saveBuffer.sharedRingBuffer),
+		nil,
 	}
+	if opts.BufferFile != "" {
+		bf, recovered, err := openBufferFile(opts.BufferFile, captureBytes, saveBytes, tl.nextReplayIndex)
+		if err != nil {
+			tl.logError(ErrorBufferFile{opts.BufferFile, err})
+		} else {
+			bf.logError = func(err error) { tl.logError(ErrorBufferFile{bf.path, err}) }
+			captureBuffer.store, saveBuffer.store = bf.capture, bf.save
+			tl.bufferFile = bf
+			tl.restore(recovered)
+		}
+	}
+	if opts.CompressBuffers && tl.bufferFile == nil {
+		captureBuffer.store, saveBuffer.store = newBlockStore(), newBlockStore()
+	}
+	return tl
 }
 
 // UpdateAddresses updates the addresses for which traffic is being captured. Capture will begin (or
 // continue) for all addresses in the input slice. All packets going to or coming from any of these
 // addresses will be captured. Capture will be stopped for any addresses not in the input slice.
 //
+// Addresses take one of the following forms:
+//
+//	host:port           TCP and UDP traffic on the port, e.g. example.com:443
+//	host:first-last     TCP and UDP traffic on a range of ports, e.g. example.com:8000-8100
+//	host                all traffic, on any port or protocol
+//	tcp://host[:ports]  TCP traffic only, e.g. tcp://example.com:443
+//	udp://host[:ports]  UDP traffic only, e.g. udp://example.com:53
+//
+// The host may be a hostname, an IP address or a network in CIDR notation, e.g. 10.0.0.0/8:443.
+// IPv6 addresses and networks must be enclosed in square brackets when followed by ports, e.g.
+// [2001:db8::/32]:443.
+//
+// Any of these forms may be followed by "and" and a filter expression, using the syntax described
+// in the pcap-filter man page. Only packets matching the expression are captured for the address.
+// For example, the following captures only SYN, FIN and RST segments:
+//
+//	tcp://example.com:443 and tcp[tcpflags] & (tcp-syn|tcp-fin|tcp-rst) != 0
+//
+// Invalid addresses, including those with invalid filter expressions, result in an
+// ErrorMalformedAddress.
+//
 // If an error is returned, the addresses have not been updated. In other words, a partial update is
 // not possible.
+//
+// Packets are captured using a single capture per network interface, filtered to the addresses
+// routed over that interface. The filter for each interface is updated once for the addresses
+// added by this call and once for those removed. Each update replaces the previous filter
+// atomically, so capture continues uninterrupted for addresses which remain.
 func (tl *TrafficLog) UpdateAddresses(addresses []string) error {
 	tl.captureProcsLock.Lock()
 	defer tl.captureProcsLock.Unlock()
 
+	// Parse new addresses (including any filter expressions) before starting any captures.
+	specs := map[string]*addressSpec{}
+	for _, addr := range addresses {
+		if _, ok := tl.captureProcs[addr]; ok {
+			continue
+		}
+		spec, err := parseAddress(addr)
+		if err != nil {
+			return fmt.Errorf("failed to parse %s: %w", addr, err)
+		}
+		spec.settings = tl.captureSettingsFor(addr)
+		specs[addr] = spec
+	}
+
+	// Capture processes which took over replay hooks (see below) leave them open when rolled back.
+	// The hooks remain registered for further replays and for later calls to UpdateAddresses.
 	newCaptureProcs := []*captureProcess{}
+	usingReplayHook := map[*captureProcess]bool{}
 	stopAllNewCaptures := func() {
+		tl.captures.beginBatch()
 		for _, proc := range newCaptureProcs {
-			proc.stop()
+			if usingReplayHook[proc] {
+				proc.halt()
+			} else {
+				proc.stop()
+			}
+		}
+		if err := tl.captures.endBatch(); err != nil {
+			tl.logError(err)
 		}
 	}
 
+	tl.captures.beginBatch()
 	captureProcs := map[string]*captureProcess{}
 	for _, addr := range addresses {
 		if proc, ok := tl.captureProcs[addr]; ok {
 			captureProcs[addr] = proc
 		} else {
+			// If packets have been replayed for this address, the capture process takes over the
+			// hook holding them.
+			hook, isReplayHook := tl.replayHooks[addr]
+			if !isReplayHook {
+				hook = tl.captureBuffer.newHookFor(addr)
+			}
 			proc, err := startCapture(
-				addr, tl.captureBuffer.newHook(), tl.capturePool,
-				tl.mutatorFactory, tl.statsInterval/procStatsPerLogStats)
+				addr, specs[addr], hook, tl.captures, tl.resolver, tl.ipGracePeriod, tl.routeChanges)
 			if err != nil {
+				if !isReplayHook {
+					hook.close()
+				}
 				stopAllNewCaptures()
 				return fmt.Errorf("failed to start capture for %s: %w", addr, err)
 			}
 			captureProcs[addr] = proc
-			go tl.statsTracker.track(proc.statsChan)
 			go tl.watchErrors(proc.errorChan)
 			newCaptureProcs = append(newCaptureProcs, proc)
+			usingReplayHook[proc] = isReplayHook
 		}
 	}
+	if err := tl.captures.endBatch(); err != nil {
+		stopAllNewCaptures()
+		return err
+	}
+
+	tl.captures.beginBatch()
 	for addr, proc := range tl.captureProcs {
 		if _, ok := captureProcs[addr]; !ok {
 			proc.stop()
 		}
 	}
+	if err := tl.captures.endBatch(); err != nil {
+		tl.logError(err)
+	}
+	for addr := range captureProcs {
+		delete(tl.replayHooks, addr)
+	}
 	tl.captureProcs = captureProcs
 	return nil
 }
 
-// UpdateBufferSizes imposes new limits on the size of the capture and save buffers. These buffers
-// are not immediately resized - the update will take effect as new packets arrive.
-func (tl *TrafficLog) UpdateBufferSizes(captureBytes, saveBytes int) {
-	tl.captureBuffer.updateCap(captureBytes)
-	tl.saveBuffer.updateCap(saveBytes)
+// UpdateInterfaces updates the network interfaces on which all traffic is captured, regardless of
+// address. This is useful in capturing context around the traffic for captured addresses, like DNS,
+// DHCP or ARP traffic. Capture will begin (or continue) for all entries in the input slice and stop
+// for any entries not in the input slice. Interface-wide capture is independent of the capture
+// configured by UpdateAddresses; the two may be used together.
+//
+// Each entry is the name of a network interface, or AllInterfaces, optionally followed by "and"
+// and a filter expression, as described for UpdateAddresses. For example, the following captures
+// DNS and ARP traffic on eth0:
+//
+//	eth0 and (port 53 or arp)
+//
+// Interfaces are looked up when capture begins for an entry. For AllInterfaces, capture begins on
+// each interface which is up at that time. Malformed entries, including those with invalid filter
+// expressions, result in an ErrorMalformedAddress.
+//
+// Packets captured for an entry are stored alongside the packets captured for addresses and can be
+// saved by passing the entry to SaveCaptures.
+//
+// If an error is returned, the interface-wide captures have not been updated. In other words, a
+// partial update is not possible.
+func (tl *TrafficLog) UpdateInterfaces(interfaces []string) error {
+	tl.captureProcsLock.Lock()
+	defer tl.captureProcsLock.Unlock()
+
+	// Parse new entries and look up their interfaces before starting any captures.
+	type newEntry struct {
+		ifaces   []networkInterface
+		filter   string
+		settings CaptureSettings
+	}
+	newEntries := map[string]newEntry{}
+	for _, entry := range interfaces {
+		if _, ok := tl.ifaceCaptures[entry]; ok {
+			continue
+		}
+		name, filter, err := parseInterfaceCapture(entry)
+		if err != nil {
+			return fmt.Errorf("failed to parse %s: %w", entry, err)
+		}
+		ifaces, err := networkInterfacesFor(name)
+		if err != nil {
+			return fmt.Errorf("failed to find interfaces for %s: %w", entry, err)
+		}
+		newEntries[entry] = newEntry{ifaces, filter, tl.captureSettingsFor(entry)}
+	}
+
+	newCaptures := []*interfaceWideCapture{}
+	stopAllNewCaptures := func() {
+		tl.captures.beginBatch()
+		for _, c := range newCaptures {
+			c.stop()
+		}
+		if err := tl.captures.endBatch(); err != nil {
+			tl.logError(err)
+		}
+	}
+
+	tl.captures.beginBatch()
+	ifaceCaptures := map[string]*interfaceWideCapture{}
+	for _, entry := range interfaces {
+		if c, ok := tl.ifaceCaptures[entry]; ok {
+			ifaceCaptures[entry] = c
+			continue
+		}
+		if _, ok := ifaceCaptures[entry]; ok {
+			continue
+		}
+		e, hook := newEntries[entry], tl.captureBuffer.newHookFor(entry)
+		c, err := startInterfaceWideCapture(e.ifaces, e.filter, e.settings, hook, tl.captures)
+		if err != nil {
+			hook.close()
+			stopAllNewCaptures()
+			return fmt.Errorf("failed to start capture for %s: %w", entry, err)
+		}
+		ifaceCaptures[entry] = c
+		newCaptures = append(newCaptures, c)
+	}
+	if err := tl.captures.endBatch(); err != nil {
+		stopAllNewCaptures()
+		return err
+	}
+
+	tl.captures.beginBatch()
+	for entry, c := range tl.ifaceCaptures {
+		if _, ok := ifaceCaptures[entry]; !ok {
+			c.stop()
+		}
+	}
+	if err := tl.captures.endBatch(); err != nil {
+		tl.logError(err)
+	}
+	tl.ifaceCaptures = ifaceCaptures
+	return nil
+}
+
+// UpdateBufferSizes imposes new limits on the size of the capture and save buffers. Both sizes must
+// be positive; otherwise, an ErrorBufferSize is returned and neither buffer is changed.
+//
+// A buffer shrunk below the size of its packets is resized immediately, evicting its oldest packets
+// (subject to Options.CaptureBufferQuotas) and releasing the memory they held. The packets evicted
+// from each buffer are reported.
+func (tl *TrafficLog) UpdateBufferSizes(captureBytes, saveBytes int) (BufferEvictions, error) {
+	if captureBytes <= 0 {
+		return BufferEvictions{}, ErrorBufferSize{"capture", captureBytes}
+	}
+	if saveBytes <= 0 {
+		return BufferEvictions{}, ErrorBufferSize{"save", saveBytes}
+	}
+	var evictions BufferEvictions
+	evictions.Capture.Packets, evictions.Capture.Bytes = tl.captureBuffer.updateCap(captureBytes)
+	evictions.Save.Packets, evictions.Save.Bytes = tl.saveBuffer.updateCap(saveBytes)
+	return evictions, nil
+}
+
+// BufferEvictions reports the packets evicted from the capture and save buffers by
+// TrafficLog.UpdateBufferSizes.
+type BufferEvictions struct {
+	Capture, Save Evictions
+}
+
+// Evictions counts the packets evicted from a buffer.
+type Evictions struct {
+	Packets int
+
+	// Bytes is the space the packets occupied in the buffer, including per-packet overhead.
+	Bytes int
+}
+
+// BufferStatus reports the packets held in the capture and save buffers. This may be used to size
+// the buffers from the traffic they actually hold.
+func (tl *TrafficLog) BufferStatus() BufferStatus {
+	return BufferStatus{tl.captureBuffer.status(), tl.saveBuffer.status()}
+}
+
+// BufferStatus reports the contents of the capture and save buffers; see TrafficLog.BufferStatus.
+type BufferStatus struct {
+	Capture, Save BufferUsage
+}
+
+// BufferUsage describes the packets held in a buffer.
+type BufferUsage struct {
+	PacketUsage
+
+	// Cap is the size of the buffer, as set by New or TrafficLog.UpdateBufferSizes.
+	Cap int
+
+	// Addresses breaks the packets down by the address (or interface-wide capture entry) for which
+	// they were captured. Packets captured for several addresses count fully toward each. Packets in
+	// the save buffer are not held by address, so this is nil for the save buffer.
+	Addresses map[string]PacketUsage
+}
+
+// PacketUsage describes a set of packets held in a buffer.
+type PacketUsage struct {
+	Packets int
+
+	// Bytes is the space the packets occupy in the buffer, including per-packet overhead.
+	Bytes int
+
+	// Oldest and Newest are the capture times of the first and last of the packets to have arrived.
+	// Packets usually arrive in order of capture, but this is not guaranteed. Both are zero if there
+	// are no packets.
+	Oldest, Newest time.Time
+}
+
+// add combines two sets of packets, which are assumed not to overlap.
+func (u PacketUsage) add(other PacketUsage) PacketUsage {
+	if u.Packets == 0 {
+		other.Bytes += u.Bytes
+		return other
+	}
+	if other.Packets > 0 {
+		if other.Oldest.Before(u.Oldest) {
+			u.Oldest = other.Oldest
+		}
+		if other.Newest.After(u.Newest) {
+			u.Newest = other.Newest
+		}
+	}
+	u.Packets += other.Packets
+	u.Bytes += other.Bytes
+	return u
+}
+
+// UpdateBufferQuotas replaces the quotas dividing the capture buffer among addresses, as described
+// in Options.CaptureBufferQuotas. This takes effect as new packets arrive.
+func (tl *TrafficLog) UpdateBufferQuotas(quotas BufferQuotas) {
+	tl.captureBuffer.updateQuotas(quotas)
+}
+
+// UpdateBufferLimits replaces the limits on the capture and save buffers, as described in
+// Options.CaptureBufferLimits. Packets exceeding the new maximum ages are evicted immediately. The
+// maximum packet counts take effect as new packets arrive.
+func (tl *TrafficLog) UpdateBufferLimits(captureLimits, saveLimits BufferLimits) {
+	tl.captureBuffer.updateLimits(captureLimits)
+	tl.saveBuffer.updateLimits(saveLimits)
+	tl.sweeper.limitsChanged()
 }
 
 // SaveCaptures saves all captures for the given address received in the past duration d. These
 // captured packets will be copied from the main capture buffer into a fixed-size ring buffer
 // specifically for saved captures. Saved packets will only be overwritten upon future calls to
-// SaveCaptures.
+// SaveCaptures, unless evicted according to Options.SaveBufferLimits.
+//
+// The address may also be an entry passed to UpdateInterfaces, in which case the packets captured
+// for that entry are saved.
+//
+// Packets going to or coming from several captured addresses are saved at most once, regardless
+// of how many of these addresses are passed to SaveCaptures.
+//
+// Capture continues while packets are copied. Packets evicted from the capture buffer before they
+// are reached may not be saved. Packets captured before the period are skipped without being
+// visited, so the cost of a save depends on the length of the period rather than the size of the
+// capture buffer.
 func (tl *TrafficLog) SaveCaptures(address string, d time.Duration) {
 	tl.captureProcsLock.Lock()
-	proc, ok := tl.captureProcs[address]
+	var hook *sharedBufferHook
+	if proc, ok := tl.captureProcs[address]; ok {
+		hook = proc.buffer
+	} else if c, ok := tl.ifaceCaptures[address]; ok {
+		hook = c.buffer
+	} else if replayHook, ok := tl.replayHooks[address]; ok {
+		hook = replayHook
+	}
 	tl.captureProcsLock.Unlock()
-	if !ok {
+	if hook == nil {
 		// Not really an error as it's possible the capture process has simply stopped.
 		return
 	}
 
+	// A packet matching several addresses is shared by their hooks. If the packet has already been
+	// saved for another address, we do not save it again.
 	sinceNano := time.Now().Add(-1 * d).UnixNano()
-	proc.forEach(func(pkt capturedPacket) {
-		if pkt.info.unixNano > sinceNano {
-			// Note: writes to bytes.Buffers do not return errors.
-			newBuf := tl.savePool.Get()
-			newBuf.Write(pkt.dataBuf.Bytes())
-			pkt.dataBuf = newBuf
-			pkt.dataPool = tl.savePool
-			tl.saveBuffer.put(pkt)
+	hook.forEachSince(sinceNano, func(item bufferItem) {
+		pkt := item.(packetItem).captured()
+		if pkt.info.unixNano <= sinceNano || !tl.savedIDs.add(pkt.id) {
+			return
+		}
+		data, err := pkt.data()
+		if err != nil {
+			tl.savedIDs.remove(pkt.id)
+			// Packets evicted since the save began are skipped.
+			if !errors.Is(err, errEvicted) {
+				tl.logError(fmt.Errorf("failed to read captured packet: %w", err))
+			}
+			return
 		}
+		// Note: writes to bytes.Buffers do not return errors.
+		newBuf := tl.savePool.Get()
+		newBuf.Write(data)
+		pkt.dataBuf, pkt.dataPool, pkt.ref = newBuf, tl.savePool, nil
+		tl.saveBuffer.putPacket(pkt, tl.savedIDs)
 	})
 }
 
@@ -307,21 +940,33 @@ func (tl *TrafficLog) WritePcapng(w io.Writer) error {
 		return fmt.Errorf("failed to initialize pcapng writer: %w", err)
 	}
 
-	// maps networkInterface.index() -> registration IDs
-	interfaceIDs := map[int]int{}
+	// An interface is registered once for each combination of settings with which it was captured.
+	type interfaceKey struct {
+		index, snapLen int
+		nano           bool
+	}
+	interfaceIDs := map[interfaceKey]int{}
 	registerInterface := func(iface *networkInterface) (id int, err error) {
-		if id, ok := interfaceIDs[iface.index()]; ok {
+		key := interfaceKey{iface.index(), iface.snapLen, iface.nanoTimestamps}
+		if id, ok := interfaceIDs[key]; ok {
 			return id, nil
 		}
-		id, err = pcapW.AddInterface(pcapgo.NgInterface{
-			Name:        iface.name(),
-			Description: iface.pcapInterface.Description,
-			OS:          runtime.GOOS,
-			LinkType:    iface.linkType.gopacketLinkType(),
-			SnapLength:  uint32(iface.mtu()),
-		})
+		ngIface := pcapgo.NgInterface{
+			Name:                iface.name(),
+			Description:         iface.pcapInterface.Description,
+			OS:                  runtime.GOOS,
+			LinkType:            iface.linkType.gopacketLinkType(),
+			SnapLength:          uint32(iface.snapLen),
+			TimestampResolution: 9,
+		}
+		if !iface.nanoTimestamps {
+			// The pcapgo package always writes timestamps in nanoseconds, so we note the precision
+			// with which they were captured.
+			ngIface.Comment = "timestamps captured with microsecond precision"
+		}
+		id, err = pcapW.AddInterface(ngIface)
 		if err == nil {
-			interfaceIDs[iface.index()] = id
+			interfaceIDs[key] = id
 		}
 		return
 	}
@@ -331,7 +976,7 @@ func (tl *TrafficLog) WritePcapng(w io.Writer) error {
 		lastError error
 	)
 	tl.saveBuffer.forEach(func(item bufferItem) {
-		pkt := item.(capturedPacket)
+		pkt := item.(packetItem).captured()
 		id, err := registerInterface(pkt.info.iface)
 		if err != nil {
 			numErrors++
@@ -341,7 +986,26 @@ func (tl *TrafficLog) WritePcapng(w io.Writer) error {
 		gopacketCI := pkt.info.gopacketCI()
 		// Oddly, the pcapgo package expects this to be the registration ID.
 		gopacketCI.InterfaceIndex = id
-		if err := pcapW.WritePacket(gopacketCI, pkt.dataBuf.Bytes()); err != nil {
+		data, err := pkt.data()
+		if errors.Is(err, errEvicted) {
+			return
+		}
+		if err != nil {
+			numErrors++
+			lastError = fmt.Errorf("failed to read packet: %w", err)
+			return
+		}
+		if pkt.info.iface.linkType == LinkTypeLinuxSLL2 {
+			// The pcapgo package cannot write SLL2 interfaces, so we write these packets as SLL.
+			if data, err = sll2ToSLL(data); err != nil {
+				numErrors++
+				lastError = fmt.Errorf("failed to convert packet: %w", err)
+				return
+			}
+			gopacketCI.CaptureLength = len(data)
+			gopacketCI.Length -= sll2HeaderLen - sllHeaderLen
+		}
+		if err := pcapW.WritePacket(gopacketCI, data); err != nil {
 			numErrors++
 			lastError = fmt.Errorf("failed to write packet: %w", err)
 			return
@@ -379,19 +1043,46 @@ func (tl *TrafficLog) Close() error {
 	for _, proc := range tl.captureProcs {
 		proc.stop()
 	}
+	for _, c := range tl.ifaceCaptures {
+		c.stop()
+	}
+	tl.captures.close()
+	tl.sweeper.close()
+	var err error
+	if tl.bufferFile != nil {
+		// Packets remaining in the file are recovered by the next traffic log to use the file. A
+		// failure to close the file is reported once the rest of the log has been torn down.
+		if closeErr := tl.bufferFile.close(); closeErr != nil {
+			err = ErrorBufferFile{tl.bufferFile.path, closeErr}
+		}
+	}
 	tl.captureBuffer = nil
 	tl.saveBuffer = nil
 	tl.captureProcs = nil
+	tl.ifaceCaptures = nil
+	tl.replayHooks = nil
 	tl.statsTracker.close()
 	close(tl.errorChan)
-	return nil
+	return err
+}
+
+// captureSettingsFor returns the capture settings for an address or interface-wide capture entry.
+func (tl *TrafficLog) captureSettingsFor(addr string) CaptureSettings {
+	if settings, ok := tl.addressSettings[addr]; ok {
+		return settings
+	}
+	return tl.captureSettings
 }
 
 func (tl *TrafficLog) watchErrors(errChan <-chan error) {
 	for err := range errChan {
-		select {
-		case tl.errorChan <- err:
-		default:
-		}
+		tl.logError(err)
+	}
+}
+
+func (tl *TrafficLog) logError(err error) {
+	select {
+	case tl.errorChan <- err:
+	default:
 	}
 }
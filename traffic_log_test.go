@@ -3,13 +3,19 @@ package trafficlog
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"math"
+	"net"
 	"os/exec"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/getlantern/trafficlog/tltest"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/pcapgo"
 	"github.com/stretchr/testify/require"
 )
 
@@ -24,8 +30,53 @@ func (ttl testTrafficLog) SaveCaptures(address string, d time.Duration) error {
 }
 
 func (ttl testTrafficLog) UpdateBufferSizes(captureBytes, saveBytes int) error {
-	ttl.TrafficLog.UpdateBufferSizes(captureBytes, saveBytes)
-	return nil
+	_, err := ttl.TrafficLog.UpdateBufferSizes(captureBytes, saveBytes)
+	return err
+}
+
+// fakeSourceFactory adapts tltest.FakeCapture to fit the PacketSourceFactory interface, recording
+// the config with which each source is opened. The tltest package cannot import this package, so
+// its fakes only mirror the PacketSource interface.
+type fakeSourceFactory struct {
+	*tltest.FakeCapture
+	configs []SourceConfig
+	mu      sync.Mutex
+}
+
+func newFakeSourceFactory() *fakeSourceFactory {
+	return &fakeSourceFactory{FakeCapture: tltest.NewFakeCapture()}
+}
+
+func (f *fakeSourceFactory) SourceFor(cfg SourceConfig) (PacketSource, error) {
+	f.mu.Lock()
+	f.configs = append(f.configs, cfg)
+	f.mu.Unlock()
+	return fakeSource{f.Open(cfg.Interface, cfg.SnapLen, cfg.ReadTimeout)}, nil
+}
+
+// openedConfigs returns the config of each source opened, in order.
+func (f *fakeSourceFactory) openedConfigs() []SourceConfig {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]SourceConfig{}, f.configs...)
+}
+
+// fakeSource adapts tltest.FakeSource to fit the PacketSource interface.
+type fakeSource struct {
+	*tltest.FakeSource
+}
+
+func (s fakeSource) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	data, ci, err := s.FakeSource.ZeroCopyReadPacketData()
+	if err == tltest.ErrFakeReadTimeout {
+		err = ErrReadTimeout
+	}
+	return data, ci, err
+}
+
+func (s fakeSource) Stats() (CaptureStats, error) {
+	received, dropped := s.FakeSource.Stats()
+	return CaptureStats{received, dropped}, nil
 }
 
 func TestTrafficLog(t *testing.T) {
@@ -36,6 +87,307 @@ func TestTrafficLog(t *testing.T) {
 	tltest.TestTrafficLog(t, testTrafficLog{tl})
 }
 
+func TestTrafficLogFakeCapture(t *testing.T) {
+	// Make the buffers large enough that we will not lose any packets.
+	const captureBufferSize, saveBufferSize = 1024 * 1024, 1024 * 1024
+
+	fc := tltest.NewFakeCapture()
+	tl := New(captureBufferSize, saveBufferSize, &Options{PacketSourceFactory: &fakeSourceFactory{FakeCapture: fc}})
+	tltest.TestTrafficLogFakeCapture(t, testTrafficLog{tl}, fc)
+}
+
+func TestUpdateAddressesBadFilter(t *testing.T) {
+	t.Parallel()
+
+	sf := newFakeSourceFactory()
+	tl := New(1024*1024, 1024*1024, &Options{PacketSourceFactory: sf})
+	defer tl.Close()
+
+	err := tl.UpdateAddresses([]string{"127.0.0.1:80", "127.0.0.1:81 and not a (filter"})
+	require.True(t, errors.As(err, new(ErrorMalformedAddress)), "unexpected error: %v", err)
+
+	// No capture should have started, even for the valid address.
+	require.Empty(t, sf.Sources())
+	require.Empty(t, tl.captureProcs)
+}
+
+func TestUpdateAddressesLinkTypeFilter(t *testing.T) {
+	t.Parallel()
+
+	loopback := loopbackInterface(t)
+	sf := &fakeSourceFactory{FakeCapture: tltest.NewFakeCaptureWithLinkType(layers.LinkTypeRaw)}
+	tl := New(1024*1024, 1024*1024, &Options{PacketSourceFactory: sf})
+	defer tl.Close()
+
+	// The expressions are valid for Ethernet, but not for the link type of the capture.
+	const filter = " and ether host 00:11:22:33:44:55"
+	err := tl.UpdateAddresses([]string{"127.0.0.1:80" + filter})
+	require.True(t, errors.As(err, new(ErrorMalformedAddress)), "unexpected error: %v", err)
+	err = tl.UpdateInterfaces([]string{loopback + filter})
+	require.True(t, errors.As(err, new(ErrorMalformedAddress)), "unexpected error: %v", err)
+
+	for _, src := range sf.Sources() {
+		require.True(t, src.Closed())
+	}
+	require.Empty(t, tl.captureProcs)
+}
+
+func TestSaveCapturesSavedIDs(t *testing.T) {
+	t.Parallel()
+
+	const (
+		client = "10.0.0.1:50000"
+		server = "10.0.0.2:443"
+	)
+
+	// The save buffer holds only one packet.
+	tl := New(1024*1024, 300, nil)
+	defer tl.Close()
+
+	frames := []testFrame{
+		{client, server, "request", time.Now()},
+		{server, client, "response", time.Now()},
+	}
+	require.NoError(t, tl.Replay(bytes.NewReader(writePcapng(t, frames)), []string{server}, nil))
+
+	savedPayloads := func() []string {
+		buf := new(bytes.Buffer)
+		require.NoError(t, tl.WritePcapng(buf))
+		return readPayloads(t, buf.Bytes())
+	}
+
+	// IDs of evicted packets are forgotten, so the packets may be saved again.
+	tl.SaveCaptures(server, time.Minute)
+	require.Equal(t, []string{"response"}, savedPayloads())
+	require.Len(t, tl.savedIDs.ids, 1)
+	tl.SaveCaptures(server, time.Minute)
+	require.Equal(t, []string{"response"}, savedPayloads())
+	require.Len(t, tl.savedIDs.ids, 1)
+}
+
+func TestUpdateBufferLimits(t *testing.T) {
+	t.Parallel()
+
+	const (
+		client = "10.0.0.1:50000"
+		server = "10.0.0.2:443"
+	)
+
+	tl := New(1024*1024, 1024*1024, &Options{SaveBufferLimits: BufferLimits{MaxPackets: 1}})
+	defer tl.Close()
+
+	frames := []testFrame{
+		{client, server, "request", time.Now()},
+		{server, client, "response", time.Now()},
+	}
+	require.NoError(t, tl.Replay(bytes.NewReader(writePcapng(t, frames)), []string{server}, nil))
+	tl.SaveCaptures(server, time.Minute)
+	require.Equal(t, 1, savedPackets(tl))
+
+	// Saved packets past the new maximum age are evicted right away.
+	tl.UpdateBufferLimits(BufferLimits{}, BufferLimits{MaxAge: time.Nanosecond})
+	require.Zero(t, savedPackets(tl))
+	require.Empty(t, tl.savedIDs.ids)
+}
+
+func TestUpdateBufferSizes(t *testing.T) {
+	t.Parallel()
+
+	const (
+		client = "10.0.0.1:50000"
+		server = "10.0.0.2:443"
+	)
+
+	tl := New(1024*1024, 1024*1024, nil)
+	defer tl.Close()
+
+	frames := []testFrame{
+		{client, server, "request", time.Now()},
+		{server, client, "response", time.Now()},
+	}
+	require.NoError(t, tl.Replay(bytes.NewReader(writePcapng(t, frames)), []string{server}, nil))
+	tl.SaveCaptures(server, time.Minute)
+	require.Equal(t, 2, savedPackets(tl))
+
+	// Invalid sizes are rejected without changing either buffer.
+	for _, sizes := range [][2]int{{0, 1024}, {1024, 0}, {-1, 1024}, {1024, -1}} {
+		_, err := tl.UpdateBufferSizes(sizes[0], sizes[1])
+		require.True(t, errors.As(err, new(ErrorBufferSize)), "unexpected error: %v", err)
+	}
+	require.Equal(t, 2, savedPackets(tl))
+
+	// The save buffer is shrunk to hold only one packet. The oldest packet is evicted right away.
+	evictions, err := tl.UpdateBufferSizes(1024*1024, 300)
+	require.NoError(t, err)
+	require.Equal(t, Evictions{}, evictions.Capture)
+	require.Equal(t, 1, evictions.Save.Packets)
+	require.Greater(t, evictions.Save.Bytes, overheadPerPacket)
+	buf := new(bytes.Buffer)
+	require.NoError(t, tl.WritePcapng(buf))
+	require.Equal(t, []string{"response"}, readPayloads(t, buf.Bytes()))
+	require.Len(t, tl.savedIDs.ids, 1)
+
+	// Growing the buffers evicts nothing.
+	evictions, err = tl.UpdateBufferSizes(2*1024*1024, 1024*1024)
+	require.NoError(t, err)
+	require.Equal(t, BufferEvictions{}, evictions)
+}
+
+func TestBufferStatus(t *testing.T) {
+	t.Parallel()
+
+	const (
+		client  = "10.0.0.1:50000"
+		serverA = "10.0.0.2:443"
+		serverB = "10.0.0.3:443"
+	)
+
+	tl := New(1024*1024, 1024*1024, nil)
+	defer tl.Close()
+
+	status := tl.BufferStatus()
+	require.Equal(t, BufferUsage{Cap: 1024 * 1024}, status.Capture)
+	require.Equal(t, BufferUsage{Cap: 1024 * 1024}, status.Save)
+
+	start := time.Unix(time.Now().Unix()-10, 0)
+	at := func(seconds int) time.Time { return start.Add(time.Duration(seconds) * time.Second) }
+	frames := []testFrame{
+		{client, serverA, "A request", at(0)},
+		{serverA, client, "A response", at(1)},
+		{client, serverB, "B request", at(2)},
+		{serverB, client, "B response", at(3)},
+	}
+	opts := &ReplayOptions{KeepTimestamps: true}
+	require.NoError(t, tl.Replay(bytes.NewReader(writePcapng(t, frames)), []string{serverA, serverB}, opts))
+	tl.SaveCaptures(serverA, time.Minute)
+
+	status = tl.BufferStatus()
+	requireUsage := func(expectedPackets int, oldest, newest time.Time, actual PacketUsage) {
+		t.Helper()
+		require.Equal(t, expectedPackets, actual.Packets)
+		require.Greater(t, actual.Bytes, expectedPackets*overheadPerPacket)
+		require.True(t, oldest.Equal(actual.Oldest), "expected oldest %v, got %v", oldest, actual.Oldest)
+		require.True(t, newest.Equal(actual.Newest), "expected newest %v, got %v", newest, actual.Newest)
+	}
+	requireUsage(4, at(0), at(3), status.Capture.PacketUsage)
+	require.Len(t, status.Capture.Addresses, 2)
+	requireUsage(2, at(0), at(1), status.Capture.Addresses[serverA])
+	requireUsage(2, at(2), at(3), status.Capture.Addresses[serverB])
+	addressBytes := status.Capture.Addresses[serverA].Bytes + status.Capture.Addresses[serverB].Bytes
+	require.Equal(t, status.Capture.Bytes, addressBytes)
+
+	requireUsage(2, at(0), at(1), status.Save.PacketUsage)
+	require.Equal(t, 1024*1024, status.Save.Cap)
+	require.Nil(t, status.Save.Addresses)
+
+	// Status reflects evictions.
+	_, err := tl.UpdateBufferSizes(1024*1024, 300)
+	require.NoError(t, err)
+	status = tl.BufferStatus()
+	requireUsage(1, at(1), at(1), status.Save.PacketUsage)
+	require.Equal(t, 300, status.Save.Cap)
+}
+
+func TestUpdateInterfaces(t *testing.T) {
+	t.Parallel()
+
+	loopback := loopbackInterface(t)
+	sf := newFakeSourceFactory()
+	tl := New(1024*1024, 1024*1024, &Options{PacketSourceFactory: sf})
+	defer tl.Close()
+
+	entry := loopback + " and port 53"
+	require.NoError(t, tl.UpdateInterfaces([]string{entry}))
+	require.Len(t, sf.Sources(), 1)
+	filter := sf.Sources()[0].Filter()
+	require.Equal(t, "(port 53)", filter)
+
+	injectFrames(sf.FakeCapture, testFrame{src: "127.0.0.1:5000", dst: "127.0.0.1:53"}.serialize(t))
+	waitForSavedPackets(t, tl, entry, 1)
+
+	// Failed updates should leave the existing capture untouched.
+	for _, entries := range [][]string{
+		{entry, loopback + " and not a (filter"},
+		{entry, "no-such-interface0"},
+	} {
+		require.Error(t, tl.UpdateInterfaces(entries))
+		require.Len(t, sf.Sources(), 1)
+		closed := sf.Sources()[0].Closed()
+		require.False(t, closed)
+	}
+	err := tl.UpdateInterfaces([]string{"and port 53"})
+	require.True(t, errors.As(err, new(ErrorMalformedAddress)), "unexpected error: %v", err)
+
+	require.NoError(t, tl.UpdateInterfaces(nil))
+	closed := sf.Sources()[0].Closed()
+	require.True(t, closed)
+}
+
+func TestWritePcapngCaptureSettings(t *testing.T) {
+	t.Parallel()
+
+	loopback := loopbackInterface(t)
+	sf := newFakeSourceFactory()
+	tl := New(1024*1024, 1024*1024, &Options{
+		PacketSourceFactory:    sf,
+		CaptureSettings:        CaptureSettings{SnapLen: 100},
+		AddressCaptureSettings: map[string]CaptureSettings{loopback: {SnapLen: 200, NanosecondTimestamps: true}},
+	})
+	defer tl.Close()
+
+	require.NoError(t, tl.UpdateInterfaces([]string{loopback}))
+	require.Len(t, sf.openedConfigs(), 1)
+	require.Equal(t, 200, sf.openedConfigs()[0].SnapLen)
+	require.True(t, sf.openedConfigs()[0].NanosecondTimestamps)
+
+	injectFrames(sf.FakeCapture, testFrame{src: "127.0.0.1:5000", dst: "127.0.0.1:53"}.serialize(t))
+	waitForSavedPackets(t, tl, loopback, 1)
+	w := new(bytes.Buffer)
+	require.NoError(t, tl.WritePcapng(w))
+
+	r, err := pcapgo.NewNgReader(w, pcapgo.DefaultNgReaderOptions)
+	require.NoError(t, err)
+	_, _, err = r.ReadPacketData()
+	require.NoError(t, err)
+	require.Equal(t, 2, r.NInterfaces()) // including the interface written by default
+	ngIface, err := r.Interface(1)
+	require.NoError(t, err)
+	require.Equal(t, uint32(200), ngIface.SnapLength)
+	require.Equal(t, loopback, ngIface.Name)
+}
+
+// waitForSavedPackets repeatedly saves the captures for an address or interface entry until n
+// packets have been saved, failing the test if this takes too long.
+func waitForSavedPackets(t *testing.T, tl *TrafficLog, address string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for savedPackets(tl) < n && time.Now().Before(deadline) {
+		tl.SaveCaptures(address, time.Minute)
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, n, savedPackets(tl))
+}
+
+func savedPackets(tl *TrafficLog) int {
+	n := 0
+	tl.saveBuffer.forEach(func(bufferItem) { n++ })
+	return n
+}
+
+// loopbackInterface returns the name of the loopback interface, skipping the test if none is up.
+func loopbackInterface(t *testing.T) string {
+	t.Helper()
+	ifaces, err := net.Interfaces()
+	require.NoError(t, err)
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 && iface.Flags&net.FlagUp != 0 {
+			return iface.Name
+		}
+	}
+	t.Skip("no loopback interface is up")
+	return ""
+}
+
 func TestStatsTracker(t *testing.T) {
 	t.Parallel()
 
@@ -125,3 +477,66 @@ func requireContainsOnce(t *testing.T, s, substring string) {
 		t.Fatalf("subslice appears more than once")
 	}
 }
+
+// BenchmarkSaveCapturesDrops measures the packets dropped by capture while SaveCaptures copies out
+// a full capture buffer. Packets arrive at a steady rate at a fake source, which drops packets
+// once its queue is full, as a kernel capture buffer would.
+func BenchmarkSaveCapturesDrops(b *testing.B) {
+	const (
+		server     = "10.0.0.1:443"
+		bufferSize = 16 * 1024 * 1024
+
+		// Packets arrive in bursts of arrivalBurst packets, every arrivalInterval.
+		arrivalBurst    = 10
+		arrivalInterval = 100 * time.Microsecond
+	)
+
+	sf := newFakeSourceFactory()
+	tl := New(bufferSize, bufferSize/4, &Options{PacketSourceFactory: sf, StatsInterval: time.Hour})
+	defer tl.Close()
+	tl.captureProcsLock.Lock()
+	hook := tl.replayHookFor(server)
+	tl.captureProcsLock.Unlock()
+	iface := networkInterface{pcapInterface: pcap.Interface{Name: "test0"}}
+	require.NoError(b, tl.captures.addRoute(iface, testRoute(b, server, hook)))
+
+	frame := testFrame{src: "192.168.0.2:5000", dst: server, payload: string(make([]byte, 500))}.serialize(b)
+	for i := 0; i < bufferSize/(len(frame)+overheadPerPacket); i++ {
+		sf.InjectFrame(frame)
+		if i%512 == 0 {
+			require.NoError(b, sf.Sync(time.Second))
+		}
+	}
+	require.NoError(b, sf.Sync(time.Second))
+
+	src := sf.Sources()[0]
+	receivedBefore, droppedBefore := src.Stats()
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(arrivalInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				for i := 0; i < arrivalBurst; i++ {
+					sf.InjectFrame(frame)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tl.SaveCaptures(server, time.Hour)
+	}
+	b.StopTimer()
+	close(stop)
+	<-stopped
+
+	received, dropped := src.Stats()
+	received, dropped = received-receivedBefore, dropped-droppedBefore
+	b.ReportMetric(100*float64(dropped)/float64(received+dropped), "%dropped")
+}